@@ -0,0 +1,88 @@
+package collect
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// counterWidths are bit widths of counter which may wrap around
+var counterWidths = []float64{math.MaxUint32 + 1, math.MaxUint64 + 1}
+
+// counterSamples are previous samples of counters. kept on memory only, because sample before restart is not used
+var counterSamples = struct {
+	sync.Mutex
+	data map[string]counterSample
+}{data: map[string]counterSample{}}
+
+type counterSample struct {
+	timestamp int64
+	value     float64
+	rate      float64 // 0 if unknown. used to tell wraparound from reset
+	maxAge    int64
+}
+
+// counterSampleKey returns key of previous sample. `<hostname>\t<plugin_name>\t<plugin_option>\t<metric name>`
+func counterSampleKey(pluginKey string, name string) string {
+	return fmt.Sprintf("%s\t%s", pluginKey, name)
+}
+
+// counterRate saves current sample, and returns per second rate from previous sample.
+// returns false for first sample of this process, and when previous sample is too old (older than maxAge seconds) or counter was reset
+func counterRate(key string, value float64, timestamp int64, maxAge int64) (float64, bool) {
+	counterSamples.Lock()
+	defer counterSamples.Unlock()
+
+	rate, ok := 0.0, false
+	if previous, found := counterSamples.data[key]; found {
+		rate, ok = counterRateFromSample(previous, value, timestamp, maxAge)
+	}
+	counterSamples.data[key] = counterSample{timestamp: timestamp, value: value, rate: rate, maxAge: maxAge}
+	return rate, ok
+}
+
+// retireCounterSamples removes samples which are too old to be used (e.g. of removed plugin or metric)
+func retireCounterSamples(unixTime int64) {
+	counterSamples.Lock()
+	defer counterSamples.Unlock()
+
+	for key, sample := range counterSamples.data {
+		if unixTime-sample.timestamp > sample.maxAge {
+			delete(counterSamples.data, key)
+		}
+	}
+}
+
+func counterRateFromSample(previous counterSample, value float64, timestamp int64, maxAge int64) (float64, bool) {
+	elapsed := timestamp - previous.timestamp
+	if elapsed <= 0 || elapsed > maxAge {
+		return 0, false
+	}
+	// unknown previous rate is 0, and decrease is regarded as reset
+	delta, ok := counterDelta(previous.value, value, previous.rate*float64(elapsed)*halib.MetricCounterWrapMaxRateRatio)
+	if !ok {
+		return 0, false
+	}
+	return delta / float64(elapsed), true
+}
+
+// counterDelta returns increase of counter. when counter decreased, it is wraparound only if wrapped delta is not more than maxDelta
+// (expected from previous rate) and less than half of the width, otherwise reset
+func counterDelta(previous float64, current float64, maxDelta float64) (float64, bool) {
+	if current >= previous {
+		return current - previous, true
+	}
+	for _, width := range counterWidths {
+		if previous >= width {
+			continue
+		}
+		delta := width - previous + current
+		if delta <= maxDelta && delta < width/2 {
+			return delta, true
+		}
+		return 0, false
+	}
+	return 0, false
+}
@@ -0,0 +1,152 @@
+package collect
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// --- Package Variables
+
+var graphitePrefixFuncs = template.FuncMap{
+	// escape replaces `.` to `_`, because `.` is path separator of graphite
+	"escape": func(s string) string {
+		return strings.Replace(s, ".", "_", -1)
+	},
+	// reverse reverses `.` separated components. e.g. web01.example.com => com.example.web01
+	"reverse": func(s string) string {
+		items := strings.Split(s, ".")
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+		return strings.Join(items, ".")
+	},
+}
+
+var graphiteNameReplacer = strings.NewReplacer(" ", "_", "\t", "_", "\n", "_")
+
+var influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+
+var influxKeyReplacer = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+// --- Struct
+
+// MetricFormatter formats MetricsData to text lines (each line ends with newline)
+type MetricFormatter interface {
+	Format(metrics halib.MetricsData) ([]string, error)
+}
+
+// GraphiteFormat formats metrics to graphite plaintext protocol
+type GraphiteFormat struct {
+	prefix *template.Template
+}
+
+type graphitePrefixData struct {
+	HostName string
+}
+
+// InfluxFormat formats metrics to InfluxDB line protocol. hostname is tag `hostname`, and Tags are added in order of key.
+//
+// metric name is split to measurement and field at `.`.
+// when MeasurementDepth > 0, first MeasurementDepth components are measurement. otherwise, last component is field.
+// when name has no field part, field is `value`.
+type InfluxFormat struct {
+	MeasurementDepth int
+}
+
+// --- Method
+
+// NewGraphiteFormat returns GraphiteFormat. prefixTemplate is text/template with {{.HostName}}, escape and reverse.
+// template is executed with sample hostname, so that wrong field or function is error here, not on every Format
+func NewGraphiteFormat(prefixTemplate string) (*GraphiteFormat, error) {
+	prefix, err := template.New("prefix").Funcs(graphitePrefixFuncs).Parse(prefixTemplate)
+	if err != nil {
+		return nil, err
+	}
+	err = prefix.Execute(ioutil.Discard, graphitePrefixData{HostName: "localhost.localdomain"})
+	if err != nil {
+		return nil, err
+	}
+	return &GraphiteFormat{prefix: prefix}, nil
+}
+
+// Format returns graphite plaintext protocol lines of metrics, sorted by name
+func (f *GraphiteFormat) Format(metrics halib.MetricsData) ([]string, error) {
+	var prefix bytes.Buffer
+	err := f.prefix.Execute(&prefix, graphitePrefixData{HostName: metrics.HostName})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(metrics.Metrics))
+	for name := range metrics.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		path := graphiteNameReplacer.Replace(name)
+		if prefix.Len() > 0 {
+			path = strings.TrimSuffix(prefix.String(), ".") + "." + path
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %d\n", path, strconv.FormatFloat(metrics.Metrics[name], 'f', -1, 64), metrics.Timestamp))
+	}
+	return lines, nil
+}
+
+// Split returns measurement and field of metric name
+func (f *InfluxFormat) Split(name string) (string, string) {
+	items := strings.Split(name, ".")
+	depth := f.MeasurementDepth
+	if depth <= 0 {
+		depth = len(items) - 1
+	}
+	if depth <= 0 || depth >= len(items) {
+		return name, "value"
+	}
+	return strings.Join(items[:depth], "."), strings.Join(items[depth:], ".")
+}
+
+// Format returns line protocol lines of metrics (one line per measurement, timestamp is nanoseconds), sorted by measurement
+func (f *InfluxFormat) Format(metrics halib.MetricsData) ([]string, error) {
+	fields := map[string][]string{}
+	for name, value := range metrics.Metrics {
+		measurement, field := f.Split(name)
+		fields[measurement] = append(fields[measurement],
+			fmt.Sprintf("%s=%s", influxKeyReplacer.Replace(field), strconv.FormatFloat(value, 'f', -1, 64)))
+	}
+
+	measurements := make([]string, 0, len(fields))
+	for measurement := range fields {
+		measurements = append(measurements, measurement)
+	}
+	sort.Strings(measurements)
+
+	tags := ""
+	if metrics.HostName != "" {
+		tags = ",hostname=" + influxKeyReplacer.Replace(metrics.HostName)
+	}
+	keys := make([]string, 0, len(metrics.Tags))
+	for key := range metrics.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tags += "," + influxKeyReplacer.Replace(key) + "=" + influxKeyReplacer.Replace(metrics.Tags[key])
+	}
+
+	lines := make([]string, 0, len(measurements))
+	for _, measurement := range measurements {
+		sort.Strings(fields[measurement])
+		lines = append(lines, fmt.Sprintf("%s%s %s %d\n",
+			influxMeasurementReplacer.Replace(measurement), tags, strings.Join(fields[measurement], ","), metrics.Timestamp*1000000000))
+	}
+	return lines, nil
+}
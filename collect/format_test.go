@@ -0,0 +1,59 @@
+package collect
+
+import (
+	"testing"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInfluxFormatSplit1(t *testing.T) {
+	f := &InfluxFormat{}
+	measurement, field := f.Split("linux.loadavg.load_avg_one")
+	assert.Equal(t, "linux.loadavg", measurement)
+	assert.Equal(t, "load_avg_one", field)
+	measurement, field = f.Split("uptime")
+	assert.Equal(t, "uptime", measurement)
+	assert.Equal(t, "value", field)
+
+	f = &InfluxFormat{MeasurementDepth: 1}
+	measurement, field = f.Split("linux.loadavg.load_avg_one")
+	assert.Equal(t, "linux", measurement)
+	assert.Equal(t, "loadavg.load_avg_one", field)
+	measurement, field = f.Split("uptime")
+	assert.Equal(t, "uptime", measurement)
+	assert.Equal(t, "value", field)
+}
+
+func TestInfluxFormatFormat1(t *testing.T) {
+	f := &InfluxFormat{}
+	lines, err := f.Format(halib.MetricsData{
+		HostName:  "web01",
+		Timestamp: 1505180794,
+		Metrics: map[string]float64{
+			"linux.loadavg.load_avg_one":  0.05,
+			"linux.loadavg.load_avg_five": 0.1,
+			"linux.disk.usage sda":        12,
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"linux.disk,hostname=web01 usage\\ sda=12 1505180794000000000\n",
+		"linux.loadavg,hostname=web01 load_avg_five=0.1,load_avg_one=0.05 1505180794000000000\n",
+	}, lines)
+}
+
+func TestInfluxFormatFormat2(t *testing.T) {
+	f := &InfluxFormat{}
+	lines, err := f.Format(halib.MetricsData{
+		HostName:  "web01",
+		Timestamp: 1505180794,
+		Metrics:   map[string]float64{"app.requests": 3},
+		Tags:      map[string]string{"role": "web", "env": "prod env"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"app,hostname=web01,env=prod\\ env,role=web requests=3 1505180794000000000\n",
+	}, lines)
+}
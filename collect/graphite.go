@@ -0,0 +1,190 @@
+package collect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// --- Package Variables
+
+// GraphiteOutput forwards every saved metrics to graphite when not nil
+var GraphiteOutput *GraphiteForwarder
+
+// --- Struct
+
+// GraphiteForwarder sends metrics to graphite(carbon) in plaintext protocol.
+// metrics are queued in LevelDB (key `g-<unixnano>`) and deleted after written to carbon
+type GraphiteForwarder struct {
+	*GraphiteFormat
+	Address    string // host:port
+	Timeout    time.Duration
+	MaxBackoff time.Duration
+
+	notify chan struct{}
+	conn   net.Conn
+	dial   func(network, address string, timeout time.Duration) (net.Conn, error)
+	mu     sync.Mutex
+}
+
+// --- Method
+
+// NewGraphiteForwarder returns GraphiteForwarder. prefixTemplate is text/template with {{.HostName}}, escape and reverse
+func NewGraphiteForwarder(address string, prefixTemplate string) (*GraphiteForwarder, error) {
+	format, err := NewGraphiteFormat(prefixTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &GraphiteForwarder{
+		GraphiteFormat: format,
+		Address:        address,
+		Timeout:        halib.DefaultGraphiteTimeoutSeconds * time.Second,
+		MaxBackoff:     halib.DefaultPushMaxBackoffSeconds * time.Second,
+		notify:         make(chan struct{}, 1),
+		dial:           net.DialTimeout,
+	}, nil
+}
+
+// Enqueue stores metrics to queue, and wakes up forwarder
+func (g *GraphiteForwarder) Enqueue(metricsData []halib.MetricsData) error {
+	if len(metricsData) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	err := enc.Encode(metricsData)
+	if err != nil {
+		return err
+	}
+	err = db.DB.Put([]byte(fmt.Sprintf("g-%019d", time.Now().UnixNano())), b.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case g.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run forwards queued metrics until stop is closed. on failure, reconnect with exponential backoff
+func (g *GraphiteForwarder) Run(stop <-chan struct{}) {
+	log := util.HappoAgentLogger()
+	var backoff time.Duration
+	retryAt := time.Now()
+
+	for {
+		select {
+		case <-stop:
+			g.close()
+			return
+		case <-g.notify:
+			if backoff > 0 && time.Now().Before(retryAt) {
+				continue // queued. wait for backoff
+			}
+		case <-time.After(time.Until(retryAt)):
+		}
+
+		err := g.Flush()
+		if err != nil {
+			backoff = nextBackoff(backoff, g.MaxBackoff)
+			log.Errorf("graphite forward failed (retry after %v): %s", backoff, err.Error())
+			retryAt = time.Now().Add(backoff)
+			continue
+		}
+		backoff = 0
+		retryAt = time.Now().Add(time.Minute)
+	}
+}
+
+// Flush sends all queued metrics. stops at first failure, and failed metrics are kept in queue
+func (g *GraphiteForwarder) Flush() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.retire(time.Now())
+
+	iter := db.DB.NewIterator(leveldbUtil.BytesPrefix([]byte("g-")), nil)
+	defer iter.Release()
+	for iter.Next() {
+		metricsData := []halib.MetricsData{}
+		dec := gob.NewDecoder(bytes.NewReader(iter.Value()))
+		err := dec.Decode(&metricsData)
+		if err == nil {
+			err = g.write(metricsData)
+			if err != nil {
+				g.closeLocked()
+				return err
+			}
+		} else {
+			util.HappoAgentLogger().Error(err)
+		}
+		err = db.DB.Delete(iter.Key(), nil)
+		if err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// retire deletes queued metrics older than MetricsMaxLifetimeSeconds
+func (g *GraphiteForwarder) retire(now time.Time) {
+	oldestThreshold := now.Add(time.Duration(-1*db.MetricsMaxLifetimeSeconds) * time.Second)
+	iter := db.DB.NewIterator(&leveldbUtil.Range{
+		Start: []byte("g-"),
+		Limit: []byte(fmt.Sprintf("g-%019d", oldestThreshold.UnixNano()))}, nil)
+	for iter.Next() {
+		util.HappoAgentLogger().Warnf("retire old graphite queue: key=%s", iter.Key())
+		db.DB.Delete(iter.Key(), nil)
+	}
+	iter.Release()
+}
+
+func (g *GraphiteForwarder) write(metricsData []halib.MetricsData) error {
+	if g.conn == nil {
+		conn, err := g.dial("tcp", g.Address, g.Timeout)
+		if err != nil {
+			return err
+		}
+		g.conn = conn
+	}
+	g.conn.SetWriteDeadline(time.Now().Add(g.Timeout))
+
+	w := bufio.NewWriter(g.conn)
+	for _, metrics := range metricsData {
+		lines, err := g.Format(metrics)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			_, err = w.WriteString(line)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
+
+func (g *GraphiteForwarder) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closeLocked()
+}
+
+func (g *GraphiteForwarder) closeLocked() {
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+}
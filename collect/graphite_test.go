@@ -0,0 +1,99 @@
+package collect
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"github.com/stretchr/testify/assert"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestGraphiteForwarderFormat1(t *testing.T) {
+	g, err := NewGraphiteForwarder("127.0.0.1:2003", halib.DefaultGraphitePrefixTemplate)
+	assert.Nil(t, err)
+	lines, err := g.Format(halib.MetricsData{
+		HostName:  "web01.example.com",
+		Timestamp: 1505180794,
+		Metrics:   map[string]float64{"linux.loadavg.load_avg_one": 0.05, "linux.disk.usage sda": 12},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"happo.web01_example_com.linux.disk.usage_sda 12 1505180794\n",
+		"happo.web01_example_com.linux.loadavg.load_avg_one 0.05 1505180794\n",
+	}, lines)
+
+	g, err = NewGraphiteForwarder("127.0.0.1:2003", "servers.{{reverse .HostName}}.")
+	assert.Nil(t, err)
+	lines, err = g.Format(halib.MetricsData{HostName: "web01.example.com", Timestamp: 1, Metrics: map[string]float64{"a": 1}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"servers.com.example.web01.a 1 1\n"}, lines)
+
+	g, err = NewGraphiteForwarder("127.0.0.1:2003", "")
+	assert.Nil(t, err)
+	lines, err = g.Format(halib.MetricsData{HostName: "web01", Timestamp: 1, Metrics: map[string]float64{"a": 1}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a 1 1\n"}, lines)
+
+	_, err = NewGraphiteForwarder("127.0.0.1:2003", "{{.HostName")
+	assert.NotNil(t, err)
+
+	// parsed, but fails on execute
+	for _, prefixTemplate := range []string{"{{.Host}}", "{{reverse .Timestamp}}", "{{index .HostName 100}}"} {
+		_, err = NewGraphiteForwarder("127.0.0.1:2003", prefixTemplate)
+		assert.NotNil(t, err, prefixTemplate)
+	}
+}
+
+func TestGraphiteForwarderFlush1(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	received := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			received <- scanner.Text()
+		}
+	}()
+
+	g, err := NewGraphiteForwarder(listener.Addr().String(), "happo.{{.HostName}}")
+	assert.Nil(t, err)
+
+	// carbon is down. metrics are kept in queue
+	g.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	assert.Nil(t, g.Enqueue([]halib.MetricsData{{HostName: "web01", Timestamp: 1, Metrics: map[string]float64{"a": 1}}}))
+	assert.Nil(t, g.Enqueue([]halib.MetricsData{{HostName: "web01", Timestamp: 2, Metrics: map[string]float64{"a": 2}}}))
+	assert.NotNil(t, g.Flush())
+	assert.Equal(t, 2, countGraphiteQueue())
+
+	// recovered
+	g.dial = net.DialTimeout
+	assert.Nil(t, g.Flush())
+	assert.Equal(t, 0, countGraphiteQueue())
+	assert.Equal(t, "happo.web01.a 1 1", <-received)
+	assert.Equal(t, "happo.web01.a 2 2", <-received)
+	g.close()
+}
+
+func countGraphiteQueue() int {
+	iter := db.DB.NewIterator(leveldbUtil.BytesPrefix([]byte("g-")), nil)
+	defer iter.Release()
+	i := 0
+	for iter.Next() {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,425 @@
+package collect
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+
+	"gopkg.in/yaml.v2"
+)
+
+// --- Package Variables
+
+// ActiveMetricConfig is metrics.yaml used by daemon. nil when metric collection is disabled
+var ActiveMetricConfig *MetricConfigLoader
+
+// MetricConfigBackups is number of previous versions of metrics.yaml kept by SaveMetricConfig
+var MetricConfigBackups = halib.DefaultMetricConfigBackups
+
+// ErrMetricConfigVersionNotFound is returned when backup of metrics.yaml is not found
+var ErrMetricConfigVersionNotFound = errors.New("metric config version not found")
+
+// version is time of backup. e.g. metrics.yaml.bak-20180401-123456.000000000
+const metricConfigVersionFormat = "20060102-150405.000000000"
+
+var metricConfigVersionPattern = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}\.[0-9]{9}$`)
+
+// --- Struct
+
+// MetricConfigLoader keeps last good metrics.yaml. broken config is rejected with reason, and last good config is kept
+type MetricConfigLoader struct {
+	Path string
+
+	config     halib.MetricConfig
+	generation int // incremented on each successful load
+	loadedAt   time.Time
+	lastError  error
+	errorAt    time.Time
+	modTime    time.Time
+	size       int64
+	mu         sync.Mutex
+}
+
+// MetricConfigError is error of config content (not IO error)
+type MetricConfigError struct {
+	Err error
+}
+
+func (e *MetricConfigError) Error() string {
+	return e.Err.Error()
+}
+
+// --- Method
+
+// ParseMetricConfig parses and validates metrics.yaml
+func ParseMetricConfig(buf []byte) (halib.MetricConfig, error) {
+	var config halib.MetricConfig
+
+	unknown, err := util.UnknownYAMLKeys(buf, config)
+	if err != nil {
+		return config, err
+	}
+	if len(unknown) > 0 {
+		return config, fmt.Errorf("unknown keys: %s", strings.Join(unknown, ", "))
+	}
+	err = yaml.Unmarshal(buf, &config)
+	if err != nil {
+		return config, err
+	}
+	return config, ValidateMetricConfig(config)
+}
+
+// ValidateMetricConfig checks hostname, plugin name, exec mode, interval, timeout, rules and duplicated entries.
+// all problems are reported in one error. plugin not installed is not an error of config, but of each run (like baseline)
+func ValidateMetricConfig(config halib.MetricConfig) error {
+	var problems []string
+	seen := map[string]bool{}
+	for i, metricHostList := range config.Metrics {
+		if metricHostList.Hostname == "" {
+			problems = append(problems, fmt.Sprintf("metrics[%d]: hostname is empty", i))
+		}
+		for j, metricPlugin := range metricHostList.Plugins {
+			where := fmt.Sprintf("metrics[%d].plugins[%d]", i, j)
+			if metricPlugin.PluginName == "" || strings.Contains(metricPlugin.PluginName, "/") {
+				problems = append(problems, fmt.Sprintf("%s: invalid plugin_name: %q", where, metricPlugin.PluginName))
+			} else if metricPlugin.PluginName == halib.NativeMetricPluginName {
+				if _, err := nativeCollectorNames(metricPlugin.PluginOption); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %s", where, err.Error()))
+				}
+			}
+			if err := util.ValidateExecMode(metricPlugin.ExecMode); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", where, err.Error()))
+			}
+			if metricPlugin.Interval < 0 || metricPlugin.Timeout < 0 {
+				problems = append(problems, fmt.Sprintf("%s: interval and timeout must not be negative", where))
+			}
+			if _, err := CompileMetricRules(metricPlugin); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", where, err.Error()))
+			}
+
+			key := metricPluginKey(metricHostList.Hostname, metricPlugin)
+			if seen[key] {
+				problems = append(problems, fmt.Sprintf("%s: duplicated entry: %s %q", where, metricPlugin.PluginName, metricPlugin.PluginOption))
+			}
+			seen[key] = true
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// missingMetricPlugins returns plugins of config which are not found in SensuPluginPaths
+func missingMetricPlugins(config halib.MetricConfig) []string {
+	var missing []string
+	for _, metricHostList := range config.Metrics {
+		for _, metricPlugin := range metricHostList.Plugins {
+			if metricPlugin.PluginName == halib.NativeMetricPluginName {
+				continue
+			}
+			if _, err := findSensuPlugin(metricPlugin.PluginName); err != nil {
+				missing = append(missing, fmt.Sprintf("%s %s", metricHostList.Hostname, metricPlugin.PluginName))
+			}
+		}
+	}
+	return missing
+}
+
+// findSensuPlugin returns path of plugin in SensuPluginPaths
+func findSensuPlugin(pluginName string) (string, error) {
+	for _, basePath := range strings.Split(SensuPluginPaths, ",") {
+		plugin := path.Join(basePath, pluginName)
+		if _, err := os.Stat(plugin); err == nil {
+			return plugin, nil
+		}
+	}
+	return "", errors.New("Plugin not found: " + pluginName)
+}
+
+// SaveMetricConfig writes config to config file atomically (temporary file and rename).
+// previous file is kept as backup up to MetricConfigBackups. when content is not changed, nothing is written
+func SaveMetricConfig(config halib.MetricConfig, configFile string) error {
+	buf, err := yaml.Marshal(&config)
+	if err != nil {
+		return err
+	}
+	return writeMetricConfigFile(configFile, buf)
+}
+
+func writeMetricConfigFile(configFile string, buf []byte) error {
+	current, err := ioutil.ReadFile(configFile)
+	if err == nil && bytes.Equal(current, buf) {
+		return nil
+	}
+	if err == nil && MetricConfigBackups > 0 {
+		version := time.Now().Format(metricConfigVersionFormat)
+		err = util.WriteFileAtomic(metricConfigVersionPath(configFile, version), current, 0644)
+		if err != nil {
+			return err
+		}
+		pruneMetricConfigVersions(configFile)
+	}
+	return util.WriteFileAtomic(configFile, buf, 0644)
+}
+
+func metricConfigVersionPath(configFile string, version string) string {
+	return configFile + ".bak-" + version
+}
+
+// pruneMetricConfigVersions deletes backups over MetricConfigBackups
+func pruneMetricConfigVersions(configFile string) {
+	versions, err := ListMetricConfigVersions(configFile)
+	if err != nil {
+		util.HappoAgentLogger().Error(err)
+		return
+	}
+	for i := MetricConfigBackups; i < len(versions); i++ {
+		err = os.Remove(metricConfigVersionPath(configFile, versions[i]))
+		if err != nil {
+			util.HappoAgentLogger().Error(err)
+		}
+	}
+}
+
+// ListMetricConfigVersions returns versions of backup, newest first
+func ListMetricConfigVersions(configFile string) ([]string, error) {
+	paths, err := filepath.Glob(metricConfigVersionPath(configFile, "*"))
+	if err != nil {
+		return nil, err
+	}
+	versions := []string{}
+	for _, p := range paths {
+		version := strings.TrimPrefix(p, metricConfigVersionPath(configFile, ""))
+		if metricConfigVersionPattern.MatchString(version) {
+			versions = append(versions, version)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+	return versions, nil
+}
+
+// RollbackMetricConfig restores backup of version (when empty, newest backup). current file is backed up, so rollback can be undone.
+// returns restored config
+func RollbackMetricConfig(configFile string, version string) (halib.MetricConfig, error) {
+	if version == "" {
+		versions, err := ListMetricConfigVersions(configFile)
+		if err != nil {
+			return halib.MetricConfig{}, err
+		}
+		if len(versions) == 0 {
+			return halib.MetricConfig{}, ErrMetricConfigVersionNotFound
+		}
+		version = versions[0]
+	}
+	if !metricConfigVersionPattern.MatchString(version) {
+		return halib.MetricConfig{}, ErrMetricConfigVersionNotFound
+	}
+
+	buf, err := ioutil.ReadFile(metricConfigVersionPath(configFile, version))
+	if os.IsNotExist(err) {
+		return halib.MetricConfig{}, ErrMetricConfigVersionNotFound
+	} else if err != nil {
+		return halib.MetricConfig{}, err
+	}
+	config, err := ParseMetricConfig(buf)
+	if err != nil {
+		return halib.MetricConfig{}, &MetricConfigError{err}
+	}
+	return config, writeMetricConfigFile(configFile, buf)
+}
+
+// DiffMetricConfig returns changes of plugins. `+` added, `-` removed, `~` changed (with changed keys)
+func DiffMetricConfig(before halib.MetricConfig, after halib.MetricConfig) []string {
+	beforeKeys, beforePlugins := indexMetricConfig(before)
+	afterKeys, afterPlugins := indexMetricConfig(after)
+
+	diff := []string{}
+	for _, key := range beforeKeys {
+		if _, ok := afterPlugins[key]; !ok {
+			diff = append(diff, "- "+describeMetricPlugin(key))
+		}
+	}
+	for _, key := range afterKeys {
+		beforePlugin, ok := beforePlugins[key]
+		if !ok {
+			diff = append(diff, "+ "+describeMetricPlugin(key))
+			continue
+		}
+		if changes := diffMetricPlugin(beforePlugin, afterPlugins[key]); len(changes) > 0 {
+			diff = append(diff, fmt.Sprintf("~ %s: %s", describeMetricPlugin(key), strings.Join(changes, ", ")))
+		}
+	}
+	return diff
+}
+
+func indexMetricConfig(config halib.MetricConfig) ([]string, map[string]halib.MetricPluginConfig) {
+	var keys []string
+	plugins := map[string]halib.MetricPluginConfig{}
+	for _, metricHostList := range config.Metrics {
+		for _, metricPlugin := range metricHostList.Plugins {
+			key := metricPluginKey(metricHostList.Hostname, metricPlugin)
+			keys = append(keys, key)
+			plugins[key] = metricPlugin
+		}
+	}
+	return keys, plugins
+}
+
+func describeMetricPlugin(key string) string {
+	items := strings.SplitN(key, "\t", 3)
+	return fmt.Sprintf("%s %s %q", items[0], items[1], items[2])
+}
+
+// diffMetricPlugin returns changed yaml keys of plugin config. e.g. `interval: 60 -> 30`
+func diffMetricPlugin(before halib.MetricPluginConfig, after halib.MetricPluginConfig) []string {
+	beforeFields := metricPluginFields(before)
+	afterFields := metricPluginFields(after)
+	names := []string{}
+	for name := range beforeFields {
+		names = append(names, name)
+	}
+	for name := range afterFields {
+		if _, ok := beforeFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []string
+	for _, name := range names {
+		beforeValue, ok := beforeFields[name]
+		if !ok {
+			beforeValue = "(none)"
+		}
+		afterValue, ok := afterFields[name]
+		if !ok {
+			afterValue = "(none)"
+		}
+		if beforeValue != afterValue {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, beforeValue, afterValue))
+		}
+	}
+	return changes
+}
+
+// metricPluginFields returns yaml key => value (yaml flow) of plugin config. omitted keys are not included
+func metricPluginFields(plugin halib.MetricPluginConfig) map[string]string {
+	fields := map[string]string{}
+	buf, err := yaml.Marshal(&plugin)
+	if err != nil {
+		return fields
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(buf, &values); err != nil {
+		return fields
+	}
+	for name, value := range values {
+		b, _ := yaml.Marshal(value)
+		fields[name] = strings.Replace(strings.TrimSpace(string(b)), "\n", " ", -1)
+	}
+	return fields
+}
+
+// NewMetricConfigLoader returns MetricConfigLoader. config is empty until Reload succeeded
+func NewMetricConfigLoader(configPath string) *MetricConfigLoader {
+	return &MetricConfigLoader{Path: configPath}
+}
+
+// Reload reads and validates config file. on error, last good config is kept and error is recorded
+func (l *MetricConfigLoader) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if fi, err := os.Stat(l.Path); err == nil {
+		l.modTime = fi.ModTime()
+		l.size = fi.Size()
+	}
+
+	buf, err := ioutil.ReadFile(l.Path)
+	var config halib.MetricConfig
+	if err == nil {
+		config, err = ParseMetricConfig(buf)
+	}
+	if err != nil {
+		l.lastError = err
+		l.errorAt = time.Now()
+		util.HappoAgentLogger().Errorf("metric config is not loaded (keep last good config): %s: %s", l.Path, err.Error())
+		return err
+	}
+
+	l.config = config
+	l.generation++
+	l.loadedAt = time.Now()
+	l.lastError = nil
+	util.HappoAgentLogger().Infof("metric config loaded: %s", l.Path)
+	for _, missing := range missingMetricPlugins(config) {
+		util.HappoAgentLogger().Warnf("metric plugin is not found, fails until installed: %s", missing)
+	}
+	return nil
+}
+
+// Get returns current config and its generation
+func (l *MetricConfigLoader) Get() (halib.MetricConfig, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.config, l.generation
+}
+
+// Watch reloads config when file is changed, until stop is closed
+func (l *MetricConfigLoader) Watch(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if l.changed() {
+			l.Reload()
+		}
+	}
+}
+
+// changed returns true when modification time or size of file differs from last Reload
+func (l *MetricConfigLoader) changed() bool {
+	fi, err := os.Stat(l.Path)
+	if err != nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !fi.ModTime().Equal(l.modTime) || fi.Size() != l.size
+}
+
+// Status returns load status
+func (l *MetricConfigLoader) Status() halib.MetricConfigStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := halib.MetricConfigStatus{Path: l.Path}
+	if l.generation > 0 {
+		status.LoadedAt = l.loadedAt.Unix()
+	}
+	for _, metricHostList := range l.config.Metrics {
+		status.Plugins += len(metricHostList.Plugins)
+	}
+	if l.lastError != nil {
+		status.LastError = l.lastError.Error()
+		status.LastErrorAt = l.errorAt.Unix()
+	}
+	return status
+}
@@ -0,0 +1,161 @@
+package collect
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMetricConfig1(t *testing.T) {
+	config, err := ParseMetricConfig([]byte(`metrics:
+- hostname: localhost
+  plugins:
+  - plugin_name: metrics_test_plugin
+    interval: 30
+    timeout: 5
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, 30, config.Metrics[0].Plugins[0].Interval)
+
+	_, err = ParseMetricConfig([]byte(`metrics:
+- hostname: localhost
+  plugins:
+  - plugin_name: metrics_test_plugin
+    plugin_opiton: "-x"
+`))
+	assert.EqualError(t, err, "unknown keys: metrics[0].plugins[0].plugin_opiton")
+
+	_, err = ParseMetricConfig([]byte(`metrics:
+- hostname: localhost
+  plugins:
+  - plugin_name: metrics_test_plugin
+  - plugin_name: metrics_test_plugin
+  - plugin_name: notfound
+  - plugin_name: ../bin/sh
+    exec_mode: unknown
+`))
+	assert.EqualError(t, err, `metrics[0].plugins[1]: duplicated entry: metrics_test_plugin ""; `+
+		`metrics[0].plugins[3]: invalid plugin_name: "../bin/sh"; `+
+		`metrics[0].plugins[3]: unknown exec mode: unknown`)
+
+	_, err = ParseMetricConfig([]byte("metrics: [\n"))
+	assert.NotNil(t, err)
+
+	// plugin not installed is not an error of config. it fails on each run
+	config, err = ParseMetricConfig([]byte("metrics:\n- hostname: localhost\n  plugins:\n  - plugin_name: notfound\n  - plugin_name: metrics_test_plugin\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(config.Metrics[0].Plugins))
+	assert.Equal(t, []string{"localhost notfound"}, missingMetricPlugins(config))
+}
+
+func TestMetricConfigLoader1(t *testing.T) {
+	f, err := ioutil.TempFile("", "metrics.yaml")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("metrics:\n- hostname: localhost\n  plugins:\n  - plugin_name: metrics_test_plugin\n")
+	f.Close()
+
+	loader := NewMetricConfigLoader(f.Name())
+	_, generation := loader.Get()
+	assert.Equal(t, 0, generation)
+	assert.EqualValues(t, 0, loader.Status().LoadedAt)
+
+	assert.Nil(t, loader.Reload())
+	config, generation := loader.Get()
+	assert.Equal(t, 1, generation)
+	assert.Equal(t, "metrics_test_plugin", config.Metrics[0].Plugins[0].PluginName)
+	assert.False(t, loader.changed())
+
+	// broken config is rejected, and last good config is kept
+	ioutil.WriteFile(f.Name(), []byte("metrics:\n- hostname: localhost\n  plugins:\n  - plugin_name: metrics_test_plugin\n    exec_mode: unknown\n"), 0644)
+	assert.True(t, loader.changed())
+	stop := make(chan struct{})
+	go loader.Watch(stop, 10*time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for loader.Status().LastError == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	status := loader.Status()
+	assert.Equal(t, "metrics[0].plugins[0]: unknown exec mode: unknown", status.LastError)
+	assert.Equal(t, 1, status.Plugins)
+	config, generation = loader.Get()
+	assert.Equal(t, 1, generation)
+	assert.Equal(t, "metrics_test_plugin", config.Metrics[0].Plugins[0].PluginName)
+	assert.False(t, loader.changed())
+}
+
+func TestSaveMetricConfig2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metric_config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	configFile := dir + "/metrics.yaml"
+
+	prevBackups := MetricConfigBackups
+	MetricConfigBackups = 2
+	defer func() { MetricConfigBackups = prevBackups }()
+
+	config := halib.MetricConfig{Metrics: []halib.MetricHostConfig{{Hostname: "localhost"}}}
+	for i := 1; i <= 4; i++ {
+		config.Metrics[0].Plugins = append(config.Metrics[0].Plugins, halib.MetricPluginConfig{PluginName: TestPlugin, PluginOption: strconv.Itoa(i)})
+		assert.Nil(t, SaveMetricConfig(config, configFile))
+	}
+	assert.Nil(t, SaveMetricConfig(config, configFile)) // not changed. no backup
+
+	fi, err := os.Stat(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644), fi.Mode())
+	versions, err := ListMetricConfigVersions(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(versions))
+
+	// newest backup has 3 plugins
+	restored, err := RollbackMetricConfig(configFile, "")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(restored.Metrics[0].Plugins))
+	current, err := GetMetricConfig(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, restored, current)
+
+	// rollback is backed up, too
+	versions, err = ListMetricConfigVersions(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(versions))
+	restored, err = RollbackMetricConfig(configFile, versions[0])
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(restored.Metrics[0].Plugins))
+
+	_, err = RollbackMetricConfig(configFile, "../../etc/passwd")
+	assert.Equal(t, ErrMetricConfigVersionNotFound, err)
+	_, err = RollbackMetricConfig(configFile, "20000101-000000.000000000")
+	assert.Equal(t, ErrMetricConfigVersionNotFound, err)
+}
+
+func TestDiffMetricConfig1(t *testing.T) {
+	before := halib.MetricConfig{Metrics: []halib.MetricHostConfig{{
+		Hostname: "localhost",
+		Plugins: []halib.MetricPluginConfig{
+			{PluginName: "a"},
+			{PluginName: "b", PluginOption: "-x", Interval: 60},
+		},
+	}}}
+	after := halib.MetricConfig{Metrics: []halib.MetricHostConfig{{
+		Hostname: "localhost",
+		Plugins: []halib.MetricPluginConfig{
+			{PluginName: "b", PluginOption: "-x", Interval: 30, ExecMode: "direct"},
+			{PluginName: "c"},
+		},
+	}}}
+	assert.Equal(t, []string{
+		`- localhost a ""`,
+		`~ localhost b "-x": exec_mode: (none) -> direct, interval: 60 -> 30`,
+		`+ localhost c ""`,
+	}, DiffMetricConfig(before, after))
+	assert.Equal(t, []string{}, DiffMetricConfig(after, after))
+}
@@ -0,0 +1,237 @@
+package collect
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// MetricFilter is condition to read collected metrics. zero value matches all
+type MetricFilter struct {
+	From         int64  // unix time. metrics timestamp >= From
+	To           int64  // unix time. metrics timestamp <= To (0 means unlimited)
+	HostName     string // glob (path.Match)
+	MetricPrefix string
+	Cursor       string // read keys after Cursor
+	Limit        int    // max number of keys. <= 0 means unlimited
+}
+
+// CollectedMetrics is result of reading collected metrics
+type CollectedMetrics struct {
+	MetricData []halib.MetricsData
+	HasMore    bool
+	NextCursor string
+	keys       []string
+	filter     MetricFilter
+}
+
+type metricIterable interface {
+	NewIterator(slice *leveldbUtil.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+type metricWriter interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	Put(key, value []byte, wo *opt.WriteOptions) error
+	Delete(key []byte, wo *opt.WriteOptions) error
+}
+
+// Validate returns error when filter is malformed
+func (f MetricFilter) Validate() error {
+	if f.HostName != "" {
+		if _, err := path.Match(f.HostName, ""); err != nil {
+			return fmt.Errorf("invalid hostname pattern: %s", f.HostName)
+		}
+	}
+	if f.Cursor != "" && !strings.HasPrefix(f.Cursor, "m-") && !strings.HasPrefix(f.Cursor, metricRollupKeyPrefix) {
+		return fmt.Errorf("invalid cursor: %s", f.Cursor)
+	}
+	if f.To > 0 && f.From > f.To {
+		return fmt.Errorf("from must be less than or equal to to")
+	}
+	return nil
+}
+
+// partial returns whether filter may select a part of stored metrics
+func (f MetricFilter) partial() bool {
+	return f.From > 0 || f.To > 0 || f.HostName != "" || f.MetricPrefix != ""
+}
+
+// split splits metricsData to matched and others
+func (f MetricFilter) split(metricsData []halib.MetricsData) ([]halib.MetricsData, []halib.MetricsData) {
+	if !f.partial() {
+		return metricsData, nil
+	}
+
+	var matched, rest []halib.MetricsData
+	for _, metrics := range metricsData {
+		if metrics.Timestamp < f.From || (f.To > 0 && metrics.Timestamp > f.To) {
+			rest = append(rest, metrics)
+			continue
+		}
+		if f.HostName != "" {
+			if ok, _ := path.Match(f.HostName, metrics.HostName); !ok {
+				rest = append(rest, metrics)
+				continue
+			}
+		}
+		if f.MetricPrefix == "" {
+			matched = append(matched, metrics)
+			continue
+		}
+
+		m, r := partitionMetrics(metrics, func(name string) bool {
+			return strings.HasPrefix(name, f.MetricPrefix)
+		})
+		if len(m.Metrics) > 0 {
+			matched = append(matched, m)
+		}
+		if len(r.Metrics) > 0 {
+			rest = append(rest, r)
+		}
+	}
+	return matched, rest
+}
+
+// partitionMetrics splits metrics by name. tags and aggregates are kept
+func partitionMetrics(metrics halib.MetricsData, match func(string) bool) (halib.MetricsData, halib.MetricsData) {
+	m := halib.MetricsData{HostName: metrics.HostName, Timestamp: metrics.Timestamp, Metrics: map[string]float64{}, Tags: metrics.Tags}
+	r := halib.MetricsData{HostName: metrics.HostName, Timestamp: metrics.Timestamp, Metrics: map[string]float64{}, Tags: metrics.Tags}
+	if metrics.Aggregated != nil {
+		m.Aggregated = newRolledUpMetrics(metrics.HostName, metrics.Tags, metrics.Timestamp).Aggregated
+		r.Aggregated = newRolledUpMetrics(metrics.HostName, metrics.Tags, metrics.Timestamp).Aggregated
+		m.Aggregated.Seconds, m.Aggregated.LastTimestamp = metrics.Aggregated.Seconds, metrics.Aggregated.LastTimestamp
+		r.Aggregated.Seconds, r.Aggregated.LastTimestamp = metrics.Aggregated.Seconds, metrics.Aggregated.LastTimestamp
+	}
+	for name, value := range metrics.Metrics {
+		target := r
+		if match(name) {
+			target = m
+		}
+		target.Metrics[name] = value
+		if metrics.Aggregated != nil {
+			target.Aggregated.Count[name] = metrics.Aggregated.Count[name]
+			target.Aggregated.Min[name] = metrics.Aggregated.Min[name]
+			target.Aggregated.Max[name] = metrics.Aggregated.Max[name]
+			target.Aggregated.Last[name] = metrics.Aggregated.Last[name]
+		}
+	}
+	return m, r
+}
+
+// scanCollectedMetrics reads metrics matched to filter. keys in skip are ignored
+func scanCollectedMetrics(reader metricIterable, filter MetricFilter, skip map[string]bool) (CollectedMetrics, error) {
+	var metricData []halib.MetricsData
+	result, err := walkCollectedMetrics(reader, filter, skip, func(metrics halib.MetricsData) error {
+		metricData = append(metricData, metrics)
+		return nil
+	})
+	result.MetricData = metricData
+	return result, err
+}
+
+// walkCollectedMetrics calls fn for each metrics matched to filter, rolled up metrics first. keys in skip are ignored.
+// returned CollectedMetrics does not have MetricData
+func walkCollectedMetrics(reader metricIterable, filter MetricFilter, skip map[string]bool, fn func(halib.MetricsData) error) (CollectedMetrics, error) {
+	result := CollectedMetrics{filter: filter}
+	for _, prefix := range []string{metricRollupKeyPrefix, "m-"} {
+		slice := leveldbUtil.BytesPrefix([]byte(prefix))
+		if filter.Cursor != "" {
+			if filter.Cursor >= string(slice.Limit) {
+				continue // cursor is after this prefix
+			}
+			if strings.HasPrefix(filter.Cursor, prefix) {
+				// next key of cursor
+				slice.Start = append([]byte(filter.Cursor), 0)
+			}
+		}
+		err := walkCollectedMetricsRange(reader, slice, filter, skip, fn, &result)
+		if err != nil || result.HasMore {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func walkCollectedMetricsRange(reader metricIterable, slice *leveldbUtil.Range, filter MetricFilter, skip map[string]bool, fn func(halib.MetricsData) error, result *CollectedMetrics) error {
+	log := util.HappoAgentLogger()
+	iter := reader.NewIterator(slice, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := string(iter.Key())
+		if skip[key] {
+			continue
+		}
+
+		metricsData := []halib.MetricsData{}
+		dec := gob.NewDecoder(bytes.NewReader(iter.Value()))
+		err := dec.Decode(&metricsData)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		matched, _ := filter.split(metricsData)
+		if len(matched) == 0 {
+			continue
+		}
+
+		if filter.Limit > 0 && len(result.keys) >= filter.Limit {
+			result.HasMore = true
+			result.NextCursor = result.keys[len(result.keys)-1]
+			break
+		}
+		for _, metrics := range matched {
+			err = fn(metrics)
+			if err != nil {
+				return err
+			}
+		}
+		result.keys = append(result.keys, key)
+	}
+	return iter.Error()
+}
+
+// removeMatchedMetrics deletes metrics matched to filter from keys. unmatched metrics are kept
+func removeMatchedMetrics(writer metricWriter, keys []string, filter MetricFilter) error {
+	for _, key := range keys {
+		if !filter.partial() {
+			writer.Delete([]byte(key), nil)
+			continue
+		}
+
+		got, err := writer.Get([]byte(key), nil)
+		if err != nil {
+			continue // already deleted
+		}
+		metricsData := []halib.MetricsData{}
+		dec := gob.NewDecoder(bytes.NewReader(got))
+		err = dec.Decode(&metricsData)
+		if err != nil {
+			return err
+		}
+		_, rest := filter.split(metricsData)
+		if len(rest) == 0 {
+			writer.Delete([]byte(key), nil)
+			continue
+		}
+		var b bytes.Buffer
+		enc := gob.NewEncoder(&b)
+		err = enc.Encode(rest)
+		if err != nil {
+			return err
+		}
+		err = writer.Put([]byte(key), b.Bytes(), nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
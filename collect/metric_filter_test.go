@@ -0,0 +1,81 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricFilterValidate1(t *testing.T) {
+	assert.Nil(t, MetricFilter{}.Validate())
+	assert.Nil(t, MetricFilter{HostName: "web*", Cursor: "m-1505180794", From: 1, To: 2}.Validate())
+	assert.NotNil(t, MetricFilter{HostName: "web["}.Validate())
+	assert.Nil(t, MetricFilter{Cursor: "a-1505180700"}.Validate())
+	assert.NotNil(t, MetricFilter{Cursor: "s-1505180794"}.Validate())
+	assert.NotNil(t, MetricFilter{From: 2, To: 1}.Validate())
+}
+
+func TestMetricFilterSplit1(t *testing.T) {
+	metricsData := []halib.MetricsData{
+		{HostName: "web01", Timestamp: 100, Metrics: map[string]float64{"linux.a": 1, "app.b": 2}},
+		{HostName: "db01", Timestamp: 100, Metrics: map[string]float64{"linux.a": 3}},
+		{HostName: "web02", Timestamp: 200, Metrics: map[string]float64{"linux.a": 4}},
+	}
+
+	matched, rest := MetricFilter{}.split(metricsData)
+	assert.Equal(t, metricsData, matched)
+	assert.Nil(t, rest)
+
+	matched, rest = MetricFilter{HostName: "web*", To: 150, MetricPrefix: "linux."}.split(metricsData)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "web01", Timestamp: 100, Metrics: map[string]float64{"linux.a": 1}},
+	}, matched)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "web01", Timestamp: 100, Metrics: map[string]float64{"app.b": 2}},
+		{HostName: "db01", Timestamp: 100, Metrics: map[string]float64{"linux.a": 3}},
+		{HostName: "web02", Timestamp: 200, Metrics: map[string]float64{"linux.a": 4}},
+	}, rest)
+}
+
+func TestGetCollectedMetricsWithFilter1(t *testing.T) {
+	GetCollectedMetrics() // cleanup
+
+	base := time.Now()
+	for i := 0; i < 3; i++ {
+		err := SaveMetrics(base.Add(time.Duration(i)*time.Second), []halib.MetricsData{
+			{HostName: "web01", Timestamp: base.Unix() + int64(i), Metrics: map[string]float64{"test.value": float64(i)}},
+			{HostName: "db01", Timestamp: base.Unix() + int64(i), Metrics: map[string]float64{"test.value": float64(i)}},
+		})
+		assert.Nil(t, err)
+	}
+
+	// page through web01
+	result, err := GetCollectedMetricsWithFilter(MetricFilter{HostName: "web*", Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(result.MetricData))
+	assert.True(t, result.HasMore)
+	assert.NotEqual(t, "", result.NextCursor)
+
+	result, err = GetCollectedMetricsWithFilter(MetricFilter{HostName: "web*", Limit: 2, Cursor: result.NextCursor})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(result.MetricData))
+	assert.Equal(t, float64(2), result.MetricData[0].Metrics["test.value"])
+	assert.False(t, result.HasMore)
+	assert.Equal(t, "", result.NextCursor)
+
+	// web01 is drained, db01 is kept
+	result, err = GetCollectedMetricsWithFilter(MetricFilter{From: base.Unix() + 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(result.MetricData))
+	for _, metrics := range result.MetricData {
+		assert.Equal(t, "db01", metrics.HostName)
+	}
+
+	ret := GetCollectedMetrics()
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, "db01", ret[0].HostName)
+	assert.Equal(t, base.Unix(), ret[0].Timestamp)
+}
@@ -0,0 +1,392 @@
+package collect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// --- Struct
+
+// metricsGrouper groups metric values to MetricsData by hostname, timestamp and tags, in order of appearance
+type metricsGrouper struct {
+	hostname string
+	now      time.Time
+	order    []string
+	groups   map[string]*halib.MetricsData
+}
+
+// --- Method
+
+// ParseMetricInput parses metrics in format (halib.MetricFormat*, blank is sensu).
+// each timestamp is kept as separate MetricsData. hostname is taken from `hostname` or `host` tag when exists,
+// otherwise hostname. when timestamp is missing, now is used. non-finite values (NaN, Inf) are skipped
+func ParseMetricInput(format string, data []byte, hostname string, now time.Time) ([]halib.MetricsData, error) {
+	g := &metricsGrouper{hostname: hostname, now: now, groups: map[string]*halib.MetricsData{}}
+
+	var parseLine func(line string) error
+	switch format {
+	case "", halib.MetricFormatSensu:
+		parseLine = g.parseSensuLine
+	case halib.MetricFormatGraphite:
+		parseLine = g.parseGraphiteLine
+	case halib.MetricFormatInflux:
+		parseLine = g.parseInfluxLine
+	case halib.MetricFormatPrometheus:
+		parseLine = g.parsePrometheusLine
+	case halib.MetricFormatJSON, halib.MetricFormatNDJSON:
+		err := g.parseJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		return g.result(), nil
+	default:
+		return nil, fmt.Errorf("unknown format: %s", format)
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %q", i+1, err.Error(), line)
+		}
+	}
+	return g.result(), nil
+}
+
+func (g *metricsGrouper) add(hostname string, timestamp int64, tags map[string]string, name string, value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	for _, tag := range []string{"hostname", "host"} {
+		if tagHostname, ok := tags[tag]; ok {
+			if tagHostname != "" {
+				hostname = tagHostname
+			}
+			delete(tags, tag)
+		}
+	}
+	if hostname == "" {
+		hostname = g.hostname
+	}
+	if timestamp <= 0 {
+		timestamp = g.now.Unix()
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+
+	key := fmt.Sprintf("%s\t%d\t%s", hostname, timestamp, tagsKey(tags))
+	metrics, ok := g.groups[key]
+	if !ok {
+		metrics = &halib.MetricsData{HostName: hostname, Timestamp: timestamp, Metrics: map[string]float64{}, Tags: tags}
+		g.groups[key] = metrics
+		g.order = append(g.order, key)
+	}
+	metrics.Metrics[name] = value
+}
+
+func (g *metricsGrouper) result() []halib.MetricsData {
+	result := make([]halib.MetricsData, 0, len(g.order))
+	for _, key := range g.order {
+		result = append(result, *g.groups[key])
+	}
+	return result
+}
+
+// parseSensuLine parses `<name>\t<value>\t<timestamp>`. lines without 3 fields are ignored, same as ParseMetricData
+func (g *metricsGrouper) parseSensuLine(line string) error {
+	items := strings.Split(line, "\t")
+	if len(items) != 3 {
+		return nil
+	}
+	value, err := strconv.ParseFloat(items[1], 64)
+	if err != nil {
+		return errors.New("invalid value")
+	}
+	timestamp, err := strconv.ParseInt(items[2], 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	g.add("", timestamp, nil, items[0], value)
+	return nil
+}
+
+// parseGraphiteLine parses `<path>[;<tag>=<value>...] <value> [<timestamp>]`
+func (g *metricsGrouper) parseGraphiteLine(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return errors.New("invalid number of fields")
+	}
+	items := strings.Split(fields[0], ";")
+	var tags map[string]string
+	for _, tag := range items[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			return errors.New("invalid tag")
+		}
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		tags[kv[0]] = kv[1]
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return errors.New("invalid value")
+	}
+	var timestamp int64
+	if len(fields) == 3 {
+		timestamp, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return errors.New("invalid timestamp")
+		}
+	}
+	g.add("", timestamp, tags, items[0], value)
+	return nil
+}
+
+// parseInfluxLine parses `<measurement>[,<tag>=<value>...] <field>=<value>[,...] [<timestamp nanoseconds>]`.
+// metric name is `<measurement>.<field>`, or `<measurement>` when field is `value`. string fields are skipped
+func (g *metricsGrouper) parseInfluxLine(line string) error {
+	if strings.HasPrefix(line, "#") {
+		return nil
+	}
+	parts := splitUnescaped(line, ' ', true)
+	if len(parts) != 2 && len(parts) != 3 {
+		return errors.New("invalid number of fields")
+	}
+
+	keys := splitUnescaped(parts[0], ',', false)
+	measurement := unescapeInflux(keys[0])
+	if measurement == "" {
+		return errors.New("no measurement")
+	}
+	var tags map[string]string
+	for _, tag := range keys[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) != 2 {
+			return errors.New("invalid tag")
+		}
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		tags[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+
+	var timestamp int64
+	if len(parts) == 3 {
+		ns, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return errors.New("invalid timestamp")
+		}
+		timestamp = ns / int64(time.Second)
+	}
+
+	for _, field := range splitUnescaped(parts[1], ',', true) {
+		kv := splitUnescaped(field, '=', true)
+		if len(kv) != 2 {
+			return errors.New("invalid field")
+		}
+		name := measurement
+		if key := unescapeInflux(kv[0]); key != "value" {
+			name = measurement + "." + key
+		}
+
+		var value float64
+		switch raw := kv[1]; {
+		case strings.HasPrefix(raw, `"`):
+			continue // string
+		case raw == "t" || raw == "T" || raw == "true" || raw == "True" || raw == "TRUE":
+			value = 1
+		case raw == "f" || raw == "F" || raw == "false" || raw == "False" || raw == "FALSE":
+			value = 0
+		default:
+			var err error
+			value, err = strconv.ParseFloat(strings.TrimRight(raw, "iu"), 64)
+			if err != nil {
+				return errors.New("invalid field value")
+			}
+		}
+		// copy tags, as add removes hostname tag
+		fieldTags := map[string]string{}
+		for k, v := range tags {
+			fieldTags[k] = v
+		}
+		g.add("", timestamp, fieldTags, name, value)
+	}
+	return nil
+}
+
+// parsePrometheusLine parses `<name>[{<label>="<value>",...}] <value> [<timestamp milliseconds>]`. labels are tags
+func (g *metricsGrouper) parsePrometheusLine(line string) error {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return errors.New("no value")
+	}
+	name := line[:end]
+	rest := line[end:]
+	var tags map[string]string
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		tags, rest, err = parsePrometheusLabels(rest[1:])
+		if err != nil {
+			return err
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) != 1 && len(fields) != 2 {
+		return errors.New("invalid number of fields")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return errors.New("invalid value")
+	}
+	var timestamp int64
+	if len(fields) == 2 {
+		ms, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return errors.New("invalid timestamp")
+		}
+		timestamp = ms / 1000
+	}
+	g.add("", timestamp, tags, name, value)
+	return nil
+}
+
+// parsePrometheusLabels parses labels after `{`, and returns labels and rest of line after `}`
+func parsePrometheusLabels(s string) (map[string]string, string, error) {
+	var labels map[string]string
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+		eq := strings.Index(s, "=")
+		if eq <= 0 || len(s) < eq+2 || s[eq+1] != '"' {
+			return nil, "", errors.New("invalid label")
+		}
+		name := strings.TrimSpace(s[:eq])
+
+		var value bytes.Buffer
+		i := eq + 2
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				if s[i] == 'n' {
+					value.WriteByte('\n')
+					continue
+				}
+			}
+			value.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return nil, "", errors.New("unterminated label value")
+		}
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[name] = value.String()
+		s = s[i+1:]
+	}
+}
+
+// parseJSON parses output of /metric (`{"metric_data": [...]}`), array of MetricsData, or stream of MetricsData (NDJSON)
+func (g *metricsGrouper) parseJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	var metricsData []halib.MetricsData
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		err := json.Unmarshal(trimmed, &metricsData)
+		if err != nil {
+			return err
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		for {
+			var item struct {
+				halib.MetricsData
+				MetricData []halib.MetricsData `json:"metric_data"`
+			}
+			err := dec.Decode(&item)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if item.MetricData != nil {
+				metricsData = append(metricsData, item.MetricData...)
+			} else {
+				metricsData = append(metricsData, item.MetricsData)
+			}
+		}
+	}
+
+	for _, metrics := range metricsData {
+		for name, value := range metrics.Metrics {
+			tags := map[string]string{}
+			for k, v := range metrics.Tags {
+				tags[k] = v
+			}
+			g.add(metrics.HostName, metrics.Timestamp, tags, name, value)
+		}
+	}
+	return nil
+}
+
+// splitUnescaped splits s by sep which is not escaped by backslash (and not in double quotes, when quotes is true).
+// empty items made by repeated sep are removed
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var items []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			if i > start {
+				items = append(items, s[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		items = append(items, s[start:])
+	}
+	return items
+}
+
+// unescapeInflux removes backslash escape of line protocol
+func unescapeInflux(s string) string {
+	return strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\"`, `"`, `\\`, `\`).Replace(s)
+}
+
+// tagsKey returns identity of tags
+func tagsKey(tags map[string]string) string {
+	items := make([]string, 0, len(tags))
+	for key, value := range tags {
+		items = append(items, key+"="+value)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,83 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMetricInput1(t *testing.T) {
+	now := time.Unix(1500000100, 0)
+
+	// sensu: each timestamp is separate MetricsData
+	metricsData, err := ParseMetricInput("", []byte("usr.cpu\t1.5\t1500000000\nsys.cpu\t2\t1500000000\nusr.cpu\t3\t1500000060\nnot metrics\n"), "web01", now)
+	assert.Nil(t, err)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "web01", Timestamp: 1500000000, Metrics: map[string]float64{"usr.cpu": 1.5, "sys.cpu": 2}},
+		{HostName: "web01", Timestamp: 1500000060, Metrics: map[string]float64{"usr.cpu": 3}},
+	}, metricsData)
+
+	// graphite: tags, and missing timestamp is now
+	metricsData, err = ParseMetricInput(halib.MetricFormatGraphite, []byte("app.requests;env=prod;host=web02 10 1500000000\napp.errors 1 -1\napp.users 2\n"), "web01", now)
+	assert.Nil(t, err)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "web02", Timestamp: 1500000000, Metrics: map[string]float64{"app.requests": 10}, Tags: map[string]string{"env": "prod"}},
+		{HostName: "web01", Timestamp: 1500000100, Metrics: map[string]float64{"app.errors": 1, "app.users": 2}},
+	}, metricsData)
+
+	// influx: escapes, integer, boolean and string fields
+	metricsData, err = ParseMetricInput(halib.MetricFormatInflux, []byte(
+		`disk,hostname=db01,path=/var\ log used=10i,full=false,label="a b,c=d" 1500000000000000000`+"\n"+
+			`load value=0.5`+"\n"), "web01", now)
+	assert.Nil(t, err)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "db01", Timestamp: 1500000000, Metrics: map[string]float64{"disk.used": 10, "disk.full": 0}, Tags: map[string]string{"path": "/var log"}},
+		{HostName: "web01", Timestamp: 1500000100, Metrics: map[string]float64{"load": 0.5}},
+	}, metricsData)
+
+	// prometheus: labels, comments, timestamp in milliseconds and NaN
+	metricsData, err = ParseMetricInput(halib.MetricFormatPrometheus, []byte(
+		"# HELP http_requests_total requests\n# TYPE http_requests_total counter\n"+
+			`http_requests_total{method="post",code="200"} 1027 1500000000000`+"\n"+
+			`http_requests_total{code="200",method="post"} 3 1500000060000`+"\n"+
+			"go_goroutines 8\nbroken NaN\n"), "web01", now)
+	assert.Nil(t, err)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "web01", Timestamp: 1500000000, Metrics: map[string]float64{"http_requests_total": 1027}, Tags: map[string]string{"method": "post", "code": "200"}},
+		{HostName: "web01", Timestamp: 1500000060, Metrics: map[string]float64{"http_requests_total": 3}, Tags: map[string]string{"method": "post", "code": "200"}},
+		{HostName: "web01", Timestamp: 1500000100, Metrics: map[string]float64{"go_goroutines": 8}},
+	}, metricsData)
+
+	// json: /metric response, array and NDJSON
+	expected := []halib.MetricsData{
+		{HostName: "db01", Timestamp: 1500000000, Metrics: map[string]float64{"a": 1}},
+		{HostName: "web01", Timestamp: 1500000100, Metrics: map[string]float64{"b": 2}, Tags: map[string]string{"env": "prod"}},
+	}
+	for _, input := range []string{
+		`{"metric_data": [{"hostname": "db01", "timestamp": 1500000000, "metrics": {"a": 1}}, {"metrics": {"b": 2}, "tags": {"env": "prod"}}]}`,
+		`[{"hostname": "db01", "timestamp": 1500000000, "metrics": {"a": 1}}, {"metrics": {"b": 2}, "tags": {"env": "prod"}}]`,
+		"{\"hostname\": \"db01\", \"timestamp\": 1500000000, \"metrics\": {\"a\": 1}}\n{\"metrics\": {\"b\": 2}, \"tags\": {\"env\": \"prod\"}}\n",
+	} {
+		metricsData, err = ParseMetricInput(halib.MetricFormatJSON, []byte(input), "web01", now)
+		assert.Nil(t, err, input)
+		assert.Equal(t, expected, metricsData, input)
+	}
+}
+
+func TestParseMetricInput2(t *testing.T) {
+	now := time.Unix(1500000100, 0)
+	for format, input := range map[string]string{
+		halib.MetricFormatSensu:      "usr.cpu\tone\t1500000000\n",
+		halib.MetricFormatGraphite:   "app.requests\n",
+		halib.MetricFormatInflux:     "disk used=abc\n",
+		halib.MetricFormatPrometheus: `http_requests_total{method="post} 1` + "\n",
+		halib.MetricFormatJSON:       "{",
+		"xml":                        "<metrics/>",
+	} {
+		_, err := ParseMetricInput(format, []byte(input), "web01", now)
+		assert.NotNil(t, err, format)
+	}
+}
@@ -0,0 +1,151 @@
+package collect
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// ErrMetricLeaseNotFound shows lease is unknown, already acked or expired
+var ErrMetricLeaseNotFound = errors.New("lease not found or expired")
+
+// metricLease is keys of metrics which are handed to collector and waiting ack
+type metricLease struct {
+	keys      []string
+	filter    MetricFilter
+	expiresAt time.Time
+}
+
+// leases are kept on memory. after restart, unacked metrics become visible again
+var metricLeases = struct {
+	sync.Mutex
+	leases map[string]metricLease
+}{leases: map[string]metricLease{}}
+
+// leasedKeys returns keys of active leases, and forgets expired leases. caller must hold metricLeases lock
+func leasedKeys(now time.Time) map[string]bool {
+	keys := map[string]bool{}
+	for id, lease := range metricLeases.leases {
+		if now.After(lease.expiresAt) {
+			delete(metricLeases.leases, id)
+			continue
+		}
+		for _, key := range lease.keys {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// LeaseCollectedMetrics returns collected metrics matched to filter without deleting
+//
+// returned metrics are hidden from other reads until leaseDuration passed.
+// call AckCollectedMetrics with returned lease id to delete them.
+// when no metrics found, lease id is blank.
+func LeaseCollectedMetrics(filter MetricFilter, leaseDuration time.Duration) (CollectedMetrics, string, error) {
+	metricLeases.Lock()
+	defer metricLeases.Unlock()
+
+	now := time.Now()
+	result, err := scanCollectedMetrics(db.DB, filter, leasedKeys(now))
+	if err != nil {
+		return CollectedMetrics{}, "", err
+	}
+	if len(result.keys) == 0 {
+		return result, "", nil
+	}
+
+	leaseID, err := NewMetricLeaseID()
+	if err != nil {
+		return CollectedMetrics{}, "", err
+	}
+	metricLeases.leases[leaseID] = metricLease{keys: result.keys, filter: filter, expiresAt: now.Add(leaseDuration)}
+	return result, leaseID, nil
+}
+
+// WalkCollectedMetrics calls fn for each collected metrics matched to filter, without loading all metrics on memory.
+// metrics are not deleted. call Delete or Lease of returned CollectedMetrics after fn succeeded for all metrics.
+// metrics saved while walking have their own keys, so they are neither walked nor deleted
+func WalkCollectedMetrics(filter MetricFilter, fn func(halib.MetricsData) error) (CollectedMetrics, error) {
+	metricLeases.Lock()
+	leased := leasedKeys(time.Now())
+	metricLeases.Unlock()
+
+	return walkCollectedMetrics(db.DB, filter, leased, fn)
+}
+
+// Delete deletes walked metrics only
+func (c CollectedMetrics) Delete() error {
+	transaction, err := db.DB.OpenTransaction()
+	if err != nil {
+		return err
+	}
+	err = removeMatchedMetrics(transaction, c.keys, c.filter)
+	if err != nil {
+		transaction.Discard()
+		return err
+	}
+	return transaction.Commit()
+}
+
+// Lease hides walked metrics from other reads until leaseDuration passed, and waits AckCollectedMetrics(leaseID)
+func (c CollectedMetrics) Lease(leaseID string, leaseDuration time.Duration) {
+	if len(c.keys) == 0 {
+		return
+	}
+	metricLeases.Lock()
+	defer metricLeases.Unlock()
+
+	metricLeases.leases[leaseID] = metricLease{keys: c.keys, filter: c.filter, expiresAt: time.Now().Add(leaseDuration)}
+}
+
+// AckCollectedMetrics deletes metrics of lease. returns number of acked keys
+func AckCollectedMetrics(leaseID string) (int, error) {
+	metricLeases.Lock()
+	defer metricLeases.Unlock()
+
+	leasedKeys(time.Now()) // forget expired leases
+	lease, ok := metricLeases.leases[leaseID]
+	if !ok {
+		return 0, ErrMetricLeaseNotFound
+	}
+
+	transaction, err := db.DB.OpenTransaction()
+	if err != nil {
+		return 0, err
+	}
+	err = removeMatchedMetrics(transaction, lease.keys, lease.filter)
+	if err != nil {
+		transaction.Discard()
+		return 0, err
+	}
+	err = transaction.Commit()
+	if err != nil {
+		return 0, err
+	}
+	delete(metricLeases.leases, leaseID)
+	return len(lease.keys), nil
+}
+
+// ReleaseMetricLease makes metrics of lease visible again without deleting
+func ReleaseMetricLease(leaseID string) {
+	metricLeases.Lock()
+	defer metricLeases.Unlock()
+
+	delete(metricLeases.leases, leaseID)
+}
+
+// NewMetricLeaseID returns random lease id
+func NewMetricLeaseID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,135 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaseCollectedMetrics1(t *testing.T) {
+	GetCollectedMetrics() // cleanup
+
+	base := time.Now()
+	for i := 0; i < 3; i++ {
+		err := SaveMetrics(base.Add(time.Duration(i)*time.Second), []halib.MetricsData{
+			{HostName: "localhost", Timestamp: base.Unix() + int64(i), Metrics: map[string]float64{"test.value": float64(i)}},
+		})
+		assert.Nil(t, err)
+	}
+
+	ret, leaseID, err := LeaseCollectedMetrics(MetricFilter{Limit: 2}, time.Minute)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", leaseID)
+	assert.Equal(t, 2, len(ret.MetricData))
+	assert.True(t, ret.HasMore)
+
+	// leased metrics are hidden, but not deleted
+	ret2, leaseID2, err := LeaseCollectedMetrics(MetricFilter{}, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ret2.MetricData))
+	assert.Equal(t, float64(2), ret2.MetricData[0].Metrics["test.value"])
+	assert.Equal(t, int64(3), GetMetricDataBufferStatus(true)["length"])
+
+	deleted, err := AckCollectedMetrics(leaseID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, deleted)
+	assert.Equal(t, int64(1), GetMetricDataBufferStatus(true)["length"])
+
+	_, err = AckCollectedMetrics(leaseID)
+	assert.Equal(t, ErrMetricLeaseNotFound, err)
+
+	// nothing to lease
+	ret3, leaseID3, err := LeaseCollectedMetrics(MetricFilter{}, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ret3.MetricData))
+	assert.Equal(t, "", leaseID3)
+
+	deleted, err = AckCollectedMetrics(leaseID2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.Equal(t, int64(0), GetMetricDataBufferStatus(true)["length"])
+}
+
+func TestLeaseCollectedMetrics2(t *testing.T) {
+	GetCollectedMetrics() // cleanup
+
+	err := SaveMetrics(time.Now(), []halib.MetricsData{
+		{HostName: "localhost", Timestamp: time.Now().Unix(), Metrics: map[string]float64{"test.value": 1}},
+	})
+	assert.Nil(t, err)
+
+	ret, leaseID, err := LeaseCollectedMetrics(MetricFilter{}, 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ret.MetricData))
+
+	// legacy read does not drain leased metrics
+	assert.Nil(t, GetCollectedMetrics())
+
+	// visible again after lease expired
+	time.Sleep(200 * time.Millisecond)
+	_, err = AckCollectedMetrics(leaseID)
+	assert.Equal(t, ErrMetricLeaseNotFound, err)
+	ret, leaseID, err = LeaseCollectedMetrics(MetricFilter{}, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ret.MetricData))
+
+	_, err = AckCollectedMetrics(leaseID)
+	assert.Nil(t, err)
+}
+
+func TestLeaseCollectedMetrics3(t *testing.T) {
+	GetCollectedMetrics() // cleanup
+
+	now := time.Now()
+	err := SaveMetrics(now, []halib.MetricsData{
+		{HostName: "localhost", Timestamp: now.Unix(), Metrics: map[string]float64{"test.value": 1}},
+	})
+	assert.Nil(t, err)
+
+	ret, leaseID, err := LeaseCollectedMetrics(MetricFilter{}, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ret.MetricData))
+
+	// saved in the same second after lease
+	err = SaveMetrics(now, []halib.MetricsData{
+		{HostName: "localhost", Timestamp: now.Unix(), Metrics: map[string]float64{"test.value": 2}},
+	})
+	assert.Nil(t, err)
+
+	deleted, err := AckCollectedMetrics(leaseID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+
+	got := GetCollectedMetrics()
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, float64(2), got[0].Metrics["test.value"])
+}
+
+func TestWalkCollectedMetrics1(t *testing.T) {
+	GetCollectedMetrics() // cleanup
+
+	now := time.Now()
+	err := SaveMetrics(now, []halib.MetricsData{
+		{HostName: "localhost", Timestamp: now.Unix(), Metrics: map[string]float64{"test.value": 1}},
+	})
+	assert.Nil(t, err)
+
+	// saved in the same second while streaming
+	streamed := []halib.MetricsData{}
+	result, err := WalkCollectedMetrics(MetricFilter{}, func(metrics halib.MetricsData) error {
+		streamed = append(streamed, metrics)
+		return SaveMetrics(now, []halib.MetricsData{
+			{HostName: "localhost", Timestamp: now.Unix(), Metrics: map[string]float64{"test.value": 2}},
+		})
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(streamed))
+	assert.Nil(t, result.Delete())
+
+	got := GetCollectedMetrics()
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, float64(2), got[0].Metrics["test.value"])
+}
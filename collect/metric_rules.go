@@ -0,0 +1,210 @@
+package collect
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// --- Struct
+
+// MetricRules is compiled include/exclude, types, rename, prefix and tags rules of metric plugin
+type MetricRules struct {
+	plugin  halib.MetricPluginConfig
+	include []metricNamePattern
+	exclude []metricNamePattern
+	types   []metricTypeRule
+	rename  []metricRenameRule
+	prefix  *template.Template
+	tags    map[string]string
+}
+
+type metricNamePattern struct {
+	glob   string
+	regexp *regexp.Regexp
+}
+
+type metricTypeRule struct {
+	pattern metricNamePattern
+	counter bool
+}
+
+type metricRenameRule struct {
+	pattern *regexp.Regexp
+	replace string
+}
+
+type metricPrefixData struct {
+	HostName   string
+	PluginName string
+}
+
+// --- Method
+
+// CompileMetricRules compiles rules of plugin. returns nil when plugin has no rules
+func CompileMetricRules(plugin halib.MetricPluginConfig) (*MetricRules, error) {
+	if len(plugin.Include) == 0 && len(plugin.Exclude) == 0 && len(plugin.Types) == 0 && len(plugin.Rename) == 0 && plugin.Prefix == "" && len(plugin.Tags) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	rules := &MetricRules{plugin: plugin, tags: plugin.Tags}
+	rules.include, err = compileMetricNamePatterns("include", plugin.Include)
+	if err != nil {
+		return nil, err
+	}
+	rules.exclude, err = compileMetricNamePatterns("exclude", plugin.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	for _, metricType := range plugin.Types {
+		if metricType.Type != halib.MetricTypeGauge && metricType.Type != halib.MetricTypeCounter {
+			return nil, fmt.Errorf("types: invalid type: %q", metricType.Type)
+		}
+		patterns, err := compileMetricNamePatterns("types", []string{metricType.Pattern})
+		if err != nil {
+			return nil, err
+		}
+		rules.types = append(rules.types, metricTypeRule{pattern: patterns[0], counter: metricType.Type == halib.MetricTypeCounter})
+	}
+	for _, rename := range plugin.Rename {
+		re, err := regexp.Compile(rename.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rename: %s", err.Error())
+		}
+		rules.rename = append(rules.rename, metricRenameRule{pattern: re, replace: rename.Replace})
+	}
+	if plugin.Prefix != "" {
+		rules.prefix, err = template.New("prefix").Funcs(graphitePrefixFuncs).Parse(plugin.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("prefix: %s", err.Error())
+		}
+		// check unknown fields such as {{.Host}} on load, not on each run
+		err = rules.prefix.Execute(&bytes.Buffer{}, metricPrefixData{})
+		if err != nil {
+			return nil, fmt.Errorf("prefix: %s", err.Error())
+		}
+	}
+	for key := range plugin.Tags {
+		if key == "" || key == "hostname" {
+			return nil, fmt.Errorf("tags: invalid tag key: %q", key)
+		}
+	}
+	return rules, nil
+}
+
+// compileMetricNamePatterns compiles patterns. pattern enclosed in `/` is regexp, otherwise glob (`*` matches `.`)
+func compileMetricNamePatterns(kind string, patterns []string) ([]metricNamePattern, error) {
+	var compiled []metricNamePattern
+	for _, pattern := range patterns {
+		if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", kind, err.Error())
+			}
+			compiled = append(compiled, metricNamePattern{regexp: re})
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: %s: %q", kind, err.Error(), pattern)
+		}
+		compiled = append(compiled, metricNamePattern{glob: pattern})
+	}
+	return compiled, nil
+}
+
+func (p metricNamePattern) match(name string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(name)
+	}
+	matched, _ := path.Match(p.glob, name)
+	return matched
+}
+
+func matchMetricName(patterns []metricNamePattern, name string) bool {
+	for _, pattern := range patterns {
+		if pattern.match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply filters metrics, converts counters to rate, renames metrics, and adds tags. patterns are matched with original name.
+// first sample of counter (and sample after reset) is dropped
+func (r *MetricRules) Apply(metrics *halib.MetricsData) error {
+	if r == nil {
+		return nil
+	}
+
+	interval := int64(r.plugin.Interval)
+	if interval <= 0 {
+		interval = halib.DefaultMetricIntervalSeconds
+	}
+	pluginKey := metricPluginKey(metrics.HostName, r.plugin)
+
+	prefix := ""
+	if r.prefix != nil {
+		var b bytes.Buffer
+		err := r.prefix.Execute(&b, metricPrefixData{HostName: metrics.HostName, PluginName: r.plugin.PluginName})
+		if err != nil {
+			return err
+		}
+		prefix = b.String()
+		if prefix != "" && !strings.HasSuffix(prefix, ".") {
+			prefix += "."
+		}
+	}
+
+	result := make(map[string]float64, len(metrics.Metrics))
+	for name, value := range metrics.Metrics {
+		if len(r.include) > 0 && !matchMetricName(r.include, name) {
+			continue
+		}
+		if matchMetricName(r.exclude, name) {
+			continue
+		}
+		if r.isCounter(name) {
+			rate, ok := counterRate(counterSampleKey(pluginKey, name), value, metrics.Timestamp, interval*halib.MetricCounterStaleIntervals)
+			if !ok {
+				continue
+			}
+			value = rate
+		}
+		renamed := name
+		for _, rename := range r.rename {
+			if rename.pattern.MatchString(name) {
+				renamed = rename.pattern.ReplaceAllString(name, rename.replace)
+				break
+			}
+		}
+		result[prefix+renamed] = value
+	}
+	metrics.Metrics = result
+
+	if len(r.tags) > 0 {
+		tags := make(map[string]string, len(metrics.Tags)+len(r.tags))
+		for key, value := range metrics.Tags {
+			tags[key] = value
+		}
+		for key, value := range r.tags {
+			tags[key] = value
+		}
+		metrics.Tags = tags
+	}
+	return nil
+}
+
+func (r *MetricRules) isCounter(name string) bool {
+	for _, rule := range r.types {
+		if rule.pattern.match(name) {
+			return rule.counter
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileMetricRules1(t *testing.T) {
+	rules, err := CompileMetricRules(halib.MetricPluginConfig{PluginName: "metrics_test_plugin"})
+	assert.Nil(t, err)
+	assert.Nil(t, rules)
+
+	var cases = []struct {
+		name   string
+		plugin halib.MetricPluginConfig
+	}{
+		{"bad glob", halib.MetricPluginConfig{Include: []string{"linux.[ss"}}},
+		{"bad regexp", halib.MetricPluginConfig{Exclude: []string{"/linux.(ss/"}}},
+		{"bad rename", halib.MetricPluginConfig{Rename: []halib.MetricRenameConfig{{Pattern: "(", Replace: "x"}}}},
+		{"bad prefix", halib.MetricPluginConfig{Prefix: "{{.Host}}"}},
+		{"bad type", halib.MetricPluginConfig{Types: []halib.MetricTypeConfig{{Pattern: "*", Type: "derive"}}}},
+		{"bad type pattern", halib.MetricPluginConfig{Types: []halib.MetricTypeConfig{{Pattern: "/(/", Type: "counter"}}}},
+		{"bad tag", halib.MetricPluginConfig{Tags: map[string]string{"hostname": "x"}}},
+	}
+	for _, c := range cases {
+		_, err := CompileMetricRules(c.plugin)
+		assert.NotNil(t, err, c.name)
+	}
+}
+
+func TestMetricRulesApply1(t *testing.T) {
+	rules, err := CompileMetricRules(halib.MetricPluginConfig{
+		PluginName: "metrics_test_plugin",
+		Include:    []string{"linux.ss.*", "/^linux\\.loadavg\\./"},
+		Exclude:    []string{"linux.ss.*_WAIT"},
+		Rename: []halib.MetricRenameConfig{
+			{Pattern: `^linux\.ss\.(.*)$`, Replace: "tcp.$1"},
+			{Pattern: `^linux\.`, Replace: "never."},
+		},
+		Prefix: "{{.HostName | escape}}.{{.PluginName}}",
+		Tags:   map[string]string{"role": "web"},
+	})
+	assert.Nil(t, err)
+
+	metrics := halib.MetricsData{
+		HostName:  "web01.example.com",
+		Timestamp: 1505180794,
+		Metrics: map[string]float64{
+			"linux.ss.ESTAB":                 1,
+			"linux.ss.TIME_WAIT":             2,
+			"linux.loadavg.load_avg_one":     0.05,
+			"linux.disk.sda.ios_in_progress": 0,
+		},
+		Tags: map[string]string{"env": "prod"},
+	}
+	err = rules.Apply(&metrics)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]float64{
+		"web01_example_com.metrics_test_plugin.tcp.ESTAB":                  1,
+		"web01_example_com.metrics_test_plugin.never.loadavg.load_avg_one": 0.05,
+	}, metrics.Metrics)
+	assert.Equal(t, map[string]string{"env": "prod", "role": "web"}, metrics.Tags)
+
+	// nil rules do nothing
+	var noRules *MetricRules
+	metrics = halib.MetricsData{Metrics: map[string]float64{"a": 1}}
+	assert.Nil(t, noRules.Apply(&metrics))
+	assert.Equal(t, map[string]float64{"a": 1}, metrics.Metrics)
+}
+
+func TestMetricRulesApply2(t *testing.T) {
+	rules, err := CompileMetricRules(halib.MetricPluginConfig{
+		PluginName: "metrics_test_plugin",
+		Interval:   10,
+		Types: []halib.MetricTypeConfig{
+			{Pattern: "linux.forks.forks", Type: "gauge"},
+			{Pattern: "linux.*", Type: "counter"},
+		},
+		Rename: []halib.MetricRenameConfig{{Pattern: `^linux\.`, Replace: "os."}},
+	})
+	assert.Nil(t, err)
+
+	var cases = []struct {
+		timestamp int64
+		value     float64
+		expected  map[string]float64
+	}{
+		{1000, 100, map[string]float64{"os.forks.forks": 100}}, // first sample
+		{1010, 150, map[string]float64{"os.forks.forks": 150, "os.context_switches": 5}},
+		{1020, 120, map[string]float64{"os.forks.forks": 120}}, // reset
+		{1030, 220, map[string]float64{"os.forks.forks": 220, "os.context_switches": 10}},
+		{1061, 230, map[string]float64{"os.forks.forks": 230}}, // previous sample is stale
+		{1061, 240, map[string]float64{"os.forks.forks": 240}}, // same timestamp
+	}
+	for _, c := range cases {
+		metrics := halib.MetricsData{
+			HostName:  "counter01",
+			Timestamp: c.timestamp,
+			Metrics:   map[string]float64{"linux.forks.forks": c.value, "linux.context_switches": c.value},
+		}
+		err = rules.Apply(&metrics)
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, metrics.Metrics, "timestamp=%d", c.timestamp)
+	}
+}
+
+func TestCounterDelta1(t *testing.T) {
+	var cases = []struct {
+		previous float64
+		current  float64
+		maxDelta float64
+		delta    float64
+		ok       bool
+	}{
+		{10, 15, 0, 5, true},
+		{4294967290, 10, 100, 16, true},                // 32bit wraparound
+		{18446744073709549568, 2048, 8192, 4096, true}, // 64bit wraparound
+		{1000, 10, 1e10, 0, false},                     // reset
+		{4294967290 + 4294967296, 0, 1e10, 0, false},   // reset of large counter
+		{3e9, 10, 4000, 0, false},                      // reset, not plausible as wraparound
+		{4294967290, 10, 0, 0, false},                  // previous rate is unknown
+	}
+	for _, c := range cases {
+		delta, ok := counterDelta(c.previous, c.current, c.maxDelta)
+		assert.Equal(t, c.ok, ok, "%v -> %v", c.previous, c.current)
+		assert.Equal(t, c.delta, delta, "%v -> %v", c.previous, c.current)
+	}
+}
+
+func TestCounterRate1(t *testing.T) {
+	resetKey := counterSampleKey("counter02\tmetrics_test_plugin\t", "if.bytes")
+	wrapKey := counterSampleKey("counter02\tmetrics_test_plugin\t", "if.packets")
+
+	var cases = []struct {
+		key       string
+		timestamp int64
+		value     float64
+		rate      float64
+		ok        bool
+	}{
+		{resetKey, 1000, 3000000000, 0, false},
+		{resetKey, 1010, 3000001000, 100, true},
+		{resetKey, 1020, 10, 0, false}, // reset (e.g. reboot), not wraparound
+		{resetKey, 1030, 1010, 100, true},
+		{wrapKey, 1000, 4294966296, 0, false},
+		{wrapKey, 1010, 4294967096, 80, true},
+		{wrapKey, 1020, 600, 80, true}, // 32bit wraparound
+	}
+	for _, c := range cases {
+		rate, ok := counterRate(c.key, c.value, c.timestamp, 30)
+		assert.Equal(t, c.ok, ok, "%s timestamp=%d", c.key, c.timestamp)
+		assert.Equal(t, c.rate, rate, "%s timestamp=%d", c.key, c.timestamp)
+	}
+}
+
+func TestRetireCounterSamples1(t *testing.T) {
+	key := counterSampleKey("counter03\tmetrics_test_plugin\t", "if.bytes")
+	counterRate(key, 100, 1000, 30)
+
+	retireCounterSamples(1030)
+	counterSamples.Lock()
+	_, found := counterSamples.data[key]
+	counterSamples.Unlock()
+	assert.True(t, found)
+
+	// stale sample is removed
+	retireCounterSamples(1031)
+	counterSamples.Lock()
+	_, found = counterSamples.data[key]
+	counterSamples.Unlock()
+	assert.False(t, found)
+
+	// samples saved by older version are removed
+	legacyKey := []byte("c-counter03\tmetrics_test_plugin\t\tif.bytes")
+	assert.Nil(t, db.DB.Put(legacyKey, []byte("990 100"), nil))
+	assert.Nil(t, SaveMetrics(time.Now(), []halib.MetricsData{
+		{HostName: "counter03", Timestamp: time.Now().Unix(), Metrics: map[string]float64{"val1": 1}},
+	}))
+	_, err := db.DB.Get(legacyKey, nil)
+	assert.NotNil(t, err)
+	GetCollectedMetricsWithLimit(-1)
+}
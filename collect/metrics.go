@@ -6,16 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
-	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/heartbeatsjp/happo-agent/db"
 	"github.com/heartbeatsjp/happo-agent/halib"
 	"github.com/heartbeatsjp/happo-agent/util"
-	leveldbErrors "github.com/syndtr/goleveldb/leveldb/errors"
 	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
 
 	"gopkg.in/yaml.v2"
@@ -24,67 +23,126 @@ import (
 var (
 	// SensuPluginPaths is sensu plugin search paths. combined with `,`
 	SensuPluginPaths = halib.DefaultSensuPluginPaths
+
+	latestMetrics = struct {
+		sync.Mutex
+		data map[string]LatestMetric // hostname, tags and metric name => value
+	}{data: map[string]LatestMetric{}}
 )
 
-// --- Method
+// --- Struct
 
-// Metrics is main function of metric collection
-func Metrics(configPath string) error {
-	var metricsDataBuffer []halib.MetricsData
+// LatestMetric is latest value of collected metric
+type LatestMetric struct {
+	HostName  string
+	Name      string
+	Tags      map[string]string
+	Value     float64
+	Timestamp int64
+}
 
-	metricList, err := GetMetricConfig(configPath)
-	if err != nil {
-		return err
-	}
+// --- Method
 
-	metricTotalCount := 0
-	for _, metricHostList := range metricList.Metrics {
-		for _, metricPlugin := range metricHostList.Plugins {
-			metricTotalCount++
-			rawMetrics, err := getMetrics(metricPlugin.PluginName, metricPlugin.PluginOption)
-			if err != nil {
-				return err
-			} else if rawMetrics == "" {
-				continue
+// collectMetricPlugin executes plugin, parses output and applies rules. returns nil metrics when plugin outputs nothing or failed to parse
+func collectMetricPlugin(hostname string, plugin halib.MetricPluginConfig, rules *MetricRules) (*halib.MetricsData, halib.MetricPluginStatus) {
+	status := halib.MetricPluginStatus{
+		Hostname:     hostname,
+		PluginName:   plugin.PluginName,
+		PluginOption: plugin.PluginOption,
+		LastRunAt:    time.Now().Unix(),
+	}
+	begin := time.Now()
+
+	var metrics *halib.MetricsData
+	stdout, stderr, outcome, err := execMetricPlugin(plugin.PluginName, plugin.PluginOption, plugin.ExecMode, time.Duration(plugin.Timeout)*time.Second)
+	if stdout != "" {
+		metricData, timestamp, parseErr := ParseMetricData(stdout)
+		if parseErr != nil {
+			if outcome == halib.MetricPluginOutcomeOK {
+				outcome = halib.MetricPluginOutcomeError
+				err = parseErr
 			}
-			metricData, timestamp, err := ParseMetricData(rawMetrics)
-			if err != nil {
-				return err
+		} else {
+			metrics = &halib.MetricsData{HostName: hostname, Timestamp: timestamp, Metrics: metricData}
+			if ruleErr := rules.Apply(metrics); ruleErr != nil {
+				metrics = nil
+				if outcome == halib.MetricPluginOutcomeOK {
+					outcome = halib.MetricPluginOutcomeError
+					err = ruleErr
+				}
 			}
+		}
+	}
+	status.Outcome = outcome
+	status.DurationSeconds = time.Since(begin).Seconds()
+	if len(stderr) > halib.MetricPluginStderrMaxBytes {
+		stderr = stderr[:halib.MetricPluginStderrMaxBytes]
+	}
+	status.Stderr = stderr
+	if err != nil {
+		status.Message = err.Error()
+		util.HappoAgentLogger().Errorf("metric plugin %s failed: %s, stderr=%s", plugin.PluginName, status.Message, stderr)
+	}
+	return metrics, status
+}
+
+type metricKeySequence struct {
+	unixTime int64
+	seq      int
+}
 
-			var metrics halib.MetricsData
-			metrics.HostName = metricHostList.Hostname
-			metrics.Timestamp = timestamp
-			metrics.Metrics = metricData
-			metricsDataBuffer = append(metricsDataBuffer, metrics)
+// metricKeySeqs are sequences of keys in the same second, by key prefix. guarded by write transaction
+var metricKeySeqs = map[string]*metricKeySequence{}
+
+// newMetricKey returns unused key `<prefix><unixtime>-<seq>` of metrics buffer (e.g. `m-<unixtime>-<seq>`).
+// every save has its own key, so that metrics once read (and leased) are not changed by later saves.
+// caller must hold write transaction
+func newMetricKey(transaction metricWriter, prefix string, unixTime int64) []byte {
+	sequence, ok := metricKeySeqs[prefix]
+	if !ok {
+		sequence = &metricKeySequence{}
+		metricKeySeqs[prefix] = sequence
+	}
+	if sequence.unixTime != unixTime {
+		sequence.unixTime = unixTime
+		sequence.seq = 0
+	}
+	for {
+		sequence.seq++
+		key := []byte(fmt.Sprintf("%s%d-%06d", prefix, unixTime, sequence.seq))
+		// keys of previous process may remain
+		if _, err := transaction.Get(key, nil); err != nil {
+			return key
 		}
 	}
+}
 
-	now := time.Now()
-	err = SaveMetrics(now, metricsDataBuffer)
-	return err
+// metricKeyUnixTime returns unixtime of metric key `m-<unixtime>-<seq>` (or `m-<unixtime>` of older version)
+func metricKeyUnixTime(key string) (int64, error) {
+	parts := strings.SplitN(key, "-", 3)
+	if len(parts) < 2 {
+		return 0, fmt.Errorf("invalid metric key: %s", key)
+	}
+	return strconv.ParseInt(parts[1], 10, 64)
 }
 
 //SaveMetrics save metrics to dbms
 func SaveMetrics(now time.Time, metricsData []halib.MetricsData) error {
 	log := util.HappoAgentLogger()
 
+	if GraphiteOutput != nil {
+		err := GraphiteOutput.Enqueue(metricsData)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
 	// Save Metrics
 	transaction, err := db.DB.OpenTransaction()
 	if err != nil {
 		log.Error(err)
 	}
 
-	got, err := transaction.Get(
-		[]byte(fmt.Sprintf("m-%d", now.Unix())),
-		nil)
-	if err != leveldbErrors.ErrNotFound {
-		savedMetricsData := []halib.MetricsData{}
-		dec := gob.NewDecoder(bytes.NewReader(got))
-		dec.Decode(&savedMetricsData)
-		metricsData = append(savedMetricsData, metricsData...)
-	}
-
 	var b bytes.Buffer
 	enc := gob.NewEncoder(&b)
 	err = enc.Encode(metricsData)
@@ -92,7 +150,7 @@ func SaveMetrics(now time.Time, metricsData []halib.MetricsData) error {
 		log.Error(err)
 	} else {
 		transaction.Put(
-			[]byte(fmt.Sprintf("m-%d", now.Unix())),
+			newMetricKey(transaction, "m-", now.Unix()),
 			b.Bytes(),
 			nil)
 	}
@@ -102,6 +160,7 @@ func SaveMetrics(now time.Time, metricsData []halib.MetricsData) error {
 		//Fatal
 		log.Fatalln(err)
 	}
+	updateLatestMetrics(metricsData)
 
 	// retire old metrics
 	transaction, err = db.DB.OpenTransaction()
@@ -120,11 +179,18 @@ func SaveMetrics(now time.Time, metricsData []halib.MetricsData) error {
 		transaction.Delete(key, nil)
 
 		// logging
-		unixTime, _ := strconv.Atoi(strings.SplitN(string(key), "-", 2)[1])
+		unixTime, _ := metricKeyUnixTime(string(key))
 		expired := []halib.MetricsData{}
 		dec := gob.NewDecoder(bytes.NewReader(value))
 		dec.Decode(&expired)
-		log.Warn("retire old metrics: key=%v(%v), value=%v\n", string(key), time.Unix(int64(unixTime), 0), expired)
+		log.Warn("retire old metrics: key=%v(%v), value=%v\n", string(key), time.Unix(unixTime, 0), expired)
+	}
+	iter.Release()
+
+	// previous samples of counters saved by older version
+	iter = transaction.NewIterator(leveldbUtil.BytesPrefix([]byte("c-")), nil)
+	for iter.Next() {
+		transaction.Delete(iter.Key(), nil)
 	}
 	iter.Release()
 
@@ -132,10 +198,54 @@ func SaveMetrics(now time.Time, metricsData []halib.MetricsData) error {
 	if err != nil {
 		log.Error(err)
 	}
+	retireCounterSamples(now.Unix())
 
 	return nil
 }
 
+// updateLatestMetrics keeps latest value of each metric on memory. metrics with different tags are kept separately
+func updateLatestMetrics(metricsData []halib.MetricsData) {
+	latestMetrics.Lock()
+	defer latestMetrics.Unlock()
+
+	for _, metrics := range metricsData {
+		series := metrics.HostName + "\t" + tagsKey(metrics.Tags) + "\t"
+		for name, value := range metrics.Metrics {
+			if latest, ok := latestMetrics.data[series+name]; ok && latest.Timestamp > metrics.Timestamp {
+				continue
+			}
+			latestMetrics.data[series+name] = LatestMetric{
+				HostName:  metrics.HostName,
+				Name:      name,
+				Tags:      metrics.Tags,
+				Value:     value,
+				Timestamp: metrics.Timestamp,
+			}
+		}
+	}
+}
+
+// GetLatestMetrics returns latest value of each collected metric, sorted by hostname, name and tags. buffer is not drained
+func GetLatestMetrics() []LatestMetric {
+	latestMetrics.Lock()
+	defer latestMetrics.Unlock()
+
+	var result []LatestMetric
+	for _, latest := range latestMetrics.data {
+		result = append(result, latest)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].HostName != result[j].HostName {
+			return result[i].HostName < result[j].HostName
+		}
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return tagsKey(result[i].Tags) < tagsKey(result[j].Tags)
+	})
+	return result
+}
+
 // GetCollectedMetrics returns collected metrics. with no limit
 func GetCollectedMetrics() []halib.MetricsData {
 	return GetCollectedMetricsWithLimit(-1)
@@ -146,89 +256,88 @@ func GetCollectedMetricsWithLimit(limit int) []halib.MetricsData {
 	/*
 		limit > 0 works fine. (otherwise, means unlimited)
 	*/
-	log := util.HappoAgentLogger()
-	var collectedMetricsData []halib.MetricsData
-
-	transaction, err := db.DB.OpenTransaction()
+	result, err := GetCollectedMetricsWithFilter(MetricFilter{Limit: limit})
 	if err != nil {
-		log.Error(err)
+		util.HappoAgentLogger().Error(err)
 	}
+	return result.MetricData
+}
 
-	var metricsData []halib.MetricsData
-	var dec *gob.Decoder
-	iter := transaction.NewIterator(
-		leveldbUtil.BytesPrefix([]byte("m-")),
-		nil)
+// GetCollectedMetricsWithFilter returns collected metrics matched to filter, and delete them.
+// unmatched metrics (other hosts, other metric names) are kept
+func GetCollectedMetricsWithFilter(filter MetricFilter) (CollectedMetrics, error) {
+	// leased metrics are deleted by ack
+	metricLeases.Lock()
+	leased := leasedKeys(time.Now())
+	metricLeases.Unlock()
 
-	i := 0
-	for iter.Next() {
-		key := iter.Key()
-		value := iter.Value()
-
-		metricsData = []halib.MetricsData{}
-		dec = gob.NewDecoder(bytes.NewReader(value))
-		err = dec.Decode(&metricsData)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		collectedMetricsData = append(collectedMetricsData, metricsData...)
-		transaction.Delete(key, nil)
+	transaction, err := db.DB.OpenTransaction()
+	if err != nil {
+		return CollectedMetrics{}, err
+	}
 
-		i = i + 1
-		if limit > 0 && i >= limit {
-			break
-		}
+	result, err := scanCollectedMetrics(transaction, filter, leased)
+	if err == nil {
+		err = removeMatchedMetrics(transaction, result.keys, filter)
+	}
+	if err != nil {
+		transaction.Discard()
+		return CollectedMetrics{}, err
 	}
-	iter.Release()
 
 	err = transaction.Commit()
 	if err != nil {
-		log.Error(err)
+		return CollectedMetrics{}, err
 	}
-	return collectedMetricsData
+	return result, nil
 }
 
 // getMetrics exec sensu plugin and get metrics
-func getMetrics(pluginName string, pluginOption string) (string, error) {
+func getMetrics(pluginName string, pluginOption string, execMode string) (string, error) {
+	stdout, _, outcome, err := execMetricPlugin(pluginName, pluginOption, execMode, 0)
+	switch outcome {
+	case halib.MetricPluginOutcomeOK, halib.MetricPluginOutcomeTimeout:
+		// timeout is onetime/runtime error, does not handle as serious error
+		return stdout, nil
+	case halib.MetricPluginOutcomeError:
+		return "", err
+	}
+	return "", nil
+}
+
+// execMetricPlugin exec sensu plugin (or native collectors), and returns stdout, stderr and outcome (halib.MetricPluginOutcome*).
+// when timeout <= 0, --command-timeout is used
+func execMetricPlugin(pluginName string, pluginOption string, execMode string, timeout time.Duration) (string, string, string, error) {
 	log := util.HappoAgentLogger()
-	var plugin string
-
-	for _, basePath := range strings.Split(SensuPluginPaths, ",") {
-		plugin = path.Join(basePath, pluginName)
-		_, err := os.Stat(plugin)
-		if err == nil {
-			if !util.Production {
-				log.Debug(plugin)
-			}
-			break
-		}
+
+	if pluginName == halib.NativeMetricPluginName {
+		return execNativeMetricPlugin(pluginOption)
 	}
-	_, err := os.Stat(plugin)
+
+	plugin, err := findSensuPlugin(pluginName)
 	if err != nil {
-		log.Error("Plugin not found:" + plugin)
-		return "", nil
+		log.Error(err.Error())
+		return "", "", halib.MetricPluginOutcomeNotFound, err
 	}
 
 	if !util.Production {
 		log.Debug("Execute metric plugin:" + plugin)
 	}
-	exitstatus, stdout, _, err := util.ExecCommand(plugin, pluginOption)
+	exitstatus, stdout, stderr, err := util.ExecCommandWithTimeout(execMode, timeout, plugin, pluginOption)
 
 	if err != nil {
-		// timeout is onetime/runtime error, does not handle as serious error
 		if timeoutError, ok := err.(*util.TimeoutError); ok {
 			log.Errorf("Plugin timeout: %s %s", pluginName, timeoutError.Error())
-			return stdout, nil
+			return stdout, stderr, halib.MetricPluginOutcomeTimeout, err
 		}
-		return "", err
+		return "", stderr, halib.MetricPluginOutcomeError, err
 	}
 	if exitstatus != 0 {
 		log.Error("Fail to get metrics:" + plugin)
-		return "", nil
+		return "", stderr, halib.MetricPluginOutcomeFailed, fmt.Errorf("exit status %d", exitstatus)
 	}
 
-	return stdout, nil
+	return stdout, stderr, halib.MetricPluginOutcomeOK, nil
 }
 
 // ParseMetricData parse sensu-stype metrics output
@@ -278,30 +387,11 @@ func GetMetricConfig(configFile string) (halib.MetricConfig, error) {
 	return metricConfig, nil
 }
 
-// SaveMetricConfig save metric config to config file
-func SaveMetricConfig(config halib.MetricConfig, configFile string) error {
-	buf, err := yaml.Marshal(&config)
-	if err != nil {
-		return err
-	}
-
-	err = ioutil.WriteFile(configFile, buf, os.ModePerm)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// GetMetricDataBufferStatus returns metric collection status
+// GetMetricDataBufferStatus returns metric collection status.
+// reads snapshot of buffer, so that SaveMetrics and ack are not blocked while counting
 func GetMetricDataBufferStatus(extended bool) map[string]int64 {
 	log := util.HappoAgentLogger()
-	transaction, err := db.DB.OpenTransaction()
-	if err != nil {
-		log.Error(err)
-		return map[string]int64{}
-	}
-	iter := transaction.NewIterator(
+	iter := db.DB.NewIterator(
 		leveldbUtil.BytesPrefix([]byte("m-")),
 		nil)
 	i := 0
@@ -323,25 +413,24 @@ func GetMetricDataBufferStatus(extended bool) map[string]int64 {
 		copy(lastKey, iter.Key())
 	}
 	iter.Release()
-	transaction.Discard()
 
 	length := i
 
 	oldestTimestamp := int64(0)
 	newestTimestamp := int64(0)
 	if i > 0 {
-		firstUnixTime, err := strconv.Atoi(strings.SplitN(string(firstKey), "-", 2)[1])
+		firstUnixTime, err := metricKeyUnixTime(string(firstKey))
 		if err != nil {
 			log.Error(err)
 		} else {
-			oldestTimestamp = int64(firstUnixTime)
+			oldestTimestamp = firstUnixTime
 		}
 
-		lastUnixTime, err := strconv.Atoi(strings.SplitN(string(lastKey), "-", 2)[1])
+		lastUnixTime, err := metricKeyUnixTime(string(lastKey))
 		if err != nil {
 			log.Error(err)
 		} else {
-			newestTimestamp = int64(lastUnixTime)
+			newestTimestamp = lastUnixTime
 		}
 	}
 
@@ -360,3 +449,14 @@ func GetMetricDataBufferStatus(extended bool) map[string]int64 {
 	return result
 
 }
+
+// GetMetricDataBufferSize returns approximate size in bytes of buffered metric collections on disk.
+// it is cheap (no iteration), but metrics not yet compacted from memtable are not counted
+func GetMetricDataBufferSize() int64 {
+	sizes, err := db.DB.SizeOf([]leveldbUtil.Range{*leveldbUtil.BytesPrefix([]byte("m-"))})
+	if err != nil {
+		util.HappoAgentLogger().Error(err)
+		return 0
+	}
+	return sizes.Sum()
+}
@@ -2,6 +2,7 @@ package collect
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
 	"time"
@@ -13,25 +14,17 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
 )
 
 const TestConfigFile = "./metrics_test.yaml"
 const TestPlugin = "metrics_test_plugin"
 
 var ConfigData = halib.MetricConfig{
-	Metrics: []struct {
-		Hostname string `yaml:"hostname" json:"Hostname"`
-		Plugins  []struct {
-			PluginName   string `yaml:"plugin_name" json:"Plugin_Name"`
-			PluginOption string `yaml:"plugin_option" json:"Plugin_Option"`
-		} `yaml:"plugins" json:"Plugins"`
-	}{
+	Metrics: []halib.MetricHostConfig{
 		{
 			Hostname: "localhost",
-			Plugins: []struct {
-				PluginName   string `yaml:"plugin_name" json:"Plugin_Name"`
-				PluginOption string `yaml:"plugin_option" json:"Plugin_Option"`
-			}{
+			Plugins: []halib.MetricPluginConfig{
 				{
 					PluginName:   "metrics_test_plugin",
 					PluginOption: "",
@@ -41,14 +34,73 @@ var ConfigData = halib.MetricConfig{
 	},
 }
 
+// runMetricPlugins runs every plugin of config file once, and saves results at once like MetricScheduler
+func runMetricPlugins(t *testing.T, configPath string) {
+	config, err := GetMetricConfig(configPath)
+	assert.Nil(t, err)
+	s := NewMetricScheduler(nil, 1)
+	s.reload(config, time.Now())
+	for _, p := range s.plugins {
+		s.finish(p, s.run(metricJob{plugin: p, hostname: p.hostname, config: p.config, rules: p.rules}))
+	}
+	s.save(time.Now())
+}
+
 func TestMetrics1(t *testing.T) {
-	err := Metrics(TestConfigFile)
+	GetCollectedMetrics() // cleanup
+	runMetricPlugins(t, TestConfigFile)
+	assert.Equal(t, 1, len(GetCollectedMetrics()))
+	resetMetricPluginStatus()
+}
+
+func TestMetrics2(t *testing.T) {
+	GetCollectedMetrics() // cleanup
+
+	f, err := ioutil.TempFile("", "metrics.yaml")
 	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`metrics:
+- hostname: localhost
+  plugins:
+  - plugin_name: dummy
+  - plugin_name: metrics_test_plugin
+    plugin_option: "'1 2'"
+  - plugin_name: metrics_test_plugin
+`)
+	f.Close()
+
+	// broken plugins do not stop others
+	for i := 0; i < 2; i++ {
+		runMetricPlugins(t, f.Name())
+	}
+	collected := GetCollectedMetrics()
+	assert.Equal(t, 2, len(collected))
+	for _, metrics := range collected {
+		assert.Equal(t, 1, len(metrics.Metrics))
+	}
+
+	status := GetMetricPluginStatus()
+	assert.Equal(t, 3, len(status))
+	assert.Equal(t, "dummy", status[0].PluginName)
+	assert.Equal(t, halib.MetricPluginOutcomeNotFound, status[0].Outcome)
+	assert.Equal(t, 2, status[0].ConsecutiveFailures)
+	assert.Equal(t, halib.MetricPluginOutcomeOK, status[1].Outcome)
+	assert.Equal(t, 0, status[1].ConsecutiveFailures)
+	assert.Equal(t, "'1 2'", status[2].PluginOption)
+	assert.Equal(t, halib.MetricPluginOutcomeError, status[2].Outcome) // parse error
+	assert.Equal(t, 2, status[2].ConsecutiveFailures)
+
+	resetMetricPluginStatus()
+}
+
+func resetMetricPluginStatus() {
+	metricPluginStatus.Lock()
+	metricPluginStatus.data = map[string]halib.MetricPluginStatus{}
+	metricPluginStatus.Unlock()
 }
 
 func TestGetCollectedMetrics1(t *testing.T) {
-	err := Metrics(TestConfigFile)
-	assert.Nil(t, err)
+	runMetricPlugins(t, TestConfigFile)
 
 	ret := GetCollectedMetrics()
 	assert.NotNil(t, ret)
@@ -56,11 +108,9 @@ func TestGetCollectedMetrics1(t *testing.T) {
 }
 
 func TestGetCollectedMetricsWithLimit1(t *testing.T) {
-	err := Metrics(TestConfigFile)
-	assert.Nil(t, err)
+	runMetricPlugins(t, TestConfigFile)
 	time.Sleep(1 * time.Second)
-	err = Metrics(TestConfigFile)
-	assert.Nil(t, err)
+	runMetricPlugins(t, TestConfigFile)
 
 	ret := GetCollectedMetricsWithLimit(1)
 	assert.NotNil(t, ret)
@@ -69,14 +119,14 @@ func TestGetCollectedMetricsWithLimit1(t *testing.T) {
 }
 
 func TestGetMetrics1(t *testing.T) {
-	ret, err := getMetrics(TestPlugin, "")
+	ret, err := getMetrics(TestPlugin, "", "")
 	assert.NotNil(t, ret)
 	assert.Contains(t, ret, "usr.local.bin.metrics_test_plugin")
 	assert.Nil(t, err)
 }
 
 func TestGetMetrics2(t *testing.T) {
-	_, err := getMetrics("dummy", "")
+	_, err := getMetrics("dummy", "", "")
 	assert.Nil(t, err) // If plugin not found, not stop app.
 }
 
@@ -85,13 +135,19 @@ func TestGetMetrics3(t *testing.T) {
 	prevCommandTimeout := util.CommandTimeout
 
 	util.CommandTimeout = 1
-	_, err := getMetrics("sleep", "2")
+	_, err := getMetrics("sleep", "2", "")
 
 	util.CommandTimeout = prevCommandTimeout
 
 	assert.Nil(t, err)
 }
 
+func TestGetMetrics4(t *testing.T) {
+	ret, err := getMetrics(TestPlugin, "'1 2'", halib.ExecModeDirect)
+	assert.Nil(t, err)
+	assert.Contains(t, ret, "usr.local.bin.metrics_test_plugin\t1 2\t")
+}
+
 func TestParseMetricData1(t *testing.T) {
 	RetAssert := map[string]float64{"hoge": 10}
 
@@ -269,6 +325,39 @@ func TestGetMetricDataBufferStatus1(t *testing.T) {
 	assert.Equal(t, int64(0), savedMetricData["length"])
 }
 
+func TestGetMetricDataBufferStatus2(t *testing.T) {
+	//cleanup
+	GetCollectedMetricsWithLimit(-1)
+
+	err := SaveMetrics(time.Unix(1000, 0), []halib.MetricsData{
+		halib.MetricsData{HostName: "host1", Timestamp: 101, Metrics: map[string]float64{"val1": 111}},
+	})
+	assert.Nil(t, err)
+
+	// status does not wait for write transaction (e.g. SaveMetrics, ack)
+	transaction, err := db.DB.OpenTransaction()
+	assert.Nil(t, err)
+	done := make(chan map[string]int64)
+	go func() {
+		done <- GetMetricDataBufferStatus(true)
+	}()
+	select {
+	case savedMetricData := <-done:
+		assert.Equal(t, int64(1), savedMetricData["length"])
+		assert.Equal(t, int64(1000), savedMetricData["oldest_timestamp"])
+	case <-time.After(time.Second):
+		t.Error("GetMetricDataBufferStatus is blocked by write transaction")
+	}
+	transaction.Discard()
+
+	assert.Nil(t, db.DB.CompactRange(leveldbUtil.Range{}))
+	assert.True(t, GetMetricDataBufferSize() > 0)
+
+	GetCollectedMetricsWithLimit(-1)
+	assert.Nil(t, db.DB.CompactRange(leveldbUtil.Range{}))
+	assert.Equal(t, int64(0), GetMetricDataBufferSize())
+}
+
 func TestGetMetricDataBufferStatusPerformance(t *testing.T) {
 	var err error
 	var savedMetricData map[string]int64
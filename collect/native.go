@@ -0,0 +1,325 @@
+package collect
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// --- Package Variables
+
+// procPath is mount point of procfs. replaced by tests
+var procPath = "/proc"
+
+// nativeCollectors are in-process collectors of halib.NativeMetricPluginName. key is name in plugin_option
+var nativeCollectors = map[string]func() (map[string]float64, error){
+	"cpu":        collectNativeCPU,
+	"loadavg":    collectNativeLoadavg,
+	"memory":     collectNativeMemory,
+	"disk":       collectNativeDisk,
+	"interface":  collectNativeInterface,
+	"filesystem": collectNativeFilesystem,
+	"processes":  collectNativeProcesses,
+}
+
+// cpuFields are columns of `cpu` line of /proc/stat
+var cpuFields = []string{"user", "nice", "system", "idle", "iowait", "irq", "softirq", "steal", "guest", "guest_nice"}
+
+// --- Method
+
+// nativeCollectorNames returns collector names in plugin option (separated by space or `,`). blank means all
+func nativeCollectorNames(pluginOption string) ([]string, error) {
+	names := strings.FieldsFunc(pluginOption, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	if len(names) == 0 {
+		for name := range nativeCollectors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	for _, name := range names {
+		if _, ok := nativeCollectors[name]; !ok {
+			return nil, fmt.Errorf("unknown native collector: %q", name)
+		}
+	}
+	return names, nil
+}
+
+// execNativeMetricPlugin runs native collectors, and returns output same as sensu plugin.
+// when some collectors failed, output of others is returned with failed outcome
+func execNativeMetricPlugin(pluginOption string) (string, string, string, error) {
+	names, err := nativeCollectorNames(pluginOption)
+	if err != nil {
+		return "", "", halib.MetricPluginOutcomeError, err
+	}
+
+	timestamp := time.Now().Unix()
+	var lines, failures []string
+	for _, name := range names {
+		metrics, err := nativeCollectors[name]()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+		keys := make([]string, 0, len(metrics))
+		for key := range metrics {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			lines = append(lines, fmt.Sprintf("%s\t%s\t%d\n", key, strconv.FormatFloat(metrics[key], 'f', -1, 64), timestamp))
+		}
+	}
+
+	stdout := strings.Join(lines, "")
+	if len(failures) > 0 {
+		stderr := strings.Join(failures, "\n") + "\n"
+		return stdout, stderr, halib.MetricPluginOutcomeFailed, errors.New(strings.Join(failures, ", "))
+	}
+	return stdout, "", halib.MetricPluginOutcomeOK, nil
+}
+
+// readProcFields calls fn with white space separated fields of each line of procfs file
+func readProcFields(name string, fn func(fields []string)) error {
+	fp, err := os.Open(filepath.Join(procPath, name))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			fn(fields)
+		}
+	}
+	return scanner.Err()
+}
+
+// metricNameComponent replaces characters which can not be used in metric name component
+func metricNameComponent(s string) string {
+	return strings.NewReplacer(".", "_", "/", "_", " ", "_").Replace(s)
+}
+
+// collectNativeCPU collects /proc/stat. values are counters (jiffies or times)
+func collectNativeCPU() (map[string]float64, error) {
+	metrics := map[string]float64{}
+	err := readProcFields("stat", func(fields []string) {
+		switch fields[0] {
+		case "cpu":
+			for i, field := range cpuFields {
+				if i+1 >= len(fields) {
+					break
+				}
+				if value, err := strconv.ParseFloat(fields[i+1], 64); err == nil {
+					metrics["linux.cpu."+field] = value
+				}
+			}
+		case "ctxt":
+			metrics["linux.context_switches.context_switches"], _ = strconv.ParseFloat(fields[1], 64)
+		case "processes":
+			metrics["linux.forks.forks"], _ = strconv.ParseFloat(fields[1], 64)
+		case "intr":
+			metrics["linux.interrupts.interrupts"], _ = strconv.ParseFloat(fields[1], 64)
+		}
+	})
+	return metrics, err
+}
+
+// collectNativeLoadavg collects /proc/loadavg
+func collectNativeLoadavg() (map[string]float64, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(procPath, "loadavg"))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(buf))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("malformed loadavg: %q", string(buf))
+	}
+
+	metrics := map[string]float64{}
+	for i, name := range []string{"load_avg_one", "load_avg_five", "load_avg_fifteen"} {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, err
+		}
+		metrics["linux.loadavg."+name] = value
+	}
+	return metrics, nil
+}
+
+// collectNativeMemory collects /proc/meminfo (bytes) and swap in/out of /proc/vmstat (counters)
+func collectNativeMemory() (map[string]float64, error) {
+	meminfo := map[string]float64{}
+	err := readProcFields("meminfo", func(fields []string) {
+		if len(fields) < 2 {
+			return
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+		meminfo[strings.TrimSuffix(fields[0], ":")] = value
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := map[string]float64{
+		"linux.memory.total":      meminfo["MemTotal"],
+		"linux.memory.free":       meminfo["MemFree"],
+		"linux.memory.buffers":    meminfo["Buffers"],
+		"linux.memory.cached":     meminfo["Cached"],
+		"linux.memory.used":       meminfo["MemTotal"] - meminfo["MemFree"] - meminfo["Buffers"] - meminfo["Cached"],
+		"linux.memory.swap_total": meminfo["SwapTotal"],
+		"linux.memory.swap_free":  meminfo["SwapFree"],
+		"linux.memory.swap_used":  meminfo["SwapTotal"] - meminfo["SwapFree"],
+	}
+	if available, ok := meminfo["MemAvailable"]; ok {
+		metrics["linux.memory.available"] = available
+	}
+
+	err = readProcFields("vmstat", func(fields []string) {
+		if len(fields) == 2 && (fields[0] == "pswpin" || fields[0] == "pswpout") {
+			metrics["linux.swap."+fields[0]], _ = strconv.ParseFloat(fields[1], 64)
+		}
+	})
+	return metrics, err
+}
+
+// collectNativeDisk collects /proc/diskstats. loop, ram and unused devices are skipped. values are counters except ios_in_progress
+func collectNativeDisk() (map[string]float64, error) {
+	metrics := map[string]float64{}
+	err := readProcFields("diskstats", func(fields []string) {
+		if len(fields) < 14 {
+			return
+		}
+		device := fields[2]
+		if strings.HasPrefix(device, "loop") || strings.HasPrefix(device, "ram") {
+			return
+		}
+		values := make([]float64, 11)
+		for i := range values {
+			values[i], _ = strconv.ParseFloat(fields[i+3], 64)
+		}
+		if values[0] == 0 && values[4] == 0 {
+			return
+		}
+		device = metricNameComponent(device)
+		metrics["linux.disk.ios.reads_"+device] = values[0]
+		metrics["linux.disk.ios.writes_"+device] = values[4]
+		metrics["linux.disk.sectors.reads_"+device] = values[2]
+		metrics["linux.disk.sectors.writes_"+device] = values[6]
+		metrics["linux.disk.rwtime.tsreading_"+device] = values[3]
+		metrics["linux.disk.rwtime.tswriting_"+device] = values[7]
+		metrics["linux.disk.ios_in_progress.ios_in_progress_"+device] = values[8]
+		metrics["linux.disk.elapsed.iotime_"+device] = values[9]
+		metrics["linux.disk.elapsed.iotime_weighted_"+device] = values[10]
+	})
+	return metrics, err
+}
+
+// collectNativeInterface collects /proc/net/dev except lo. values are counters
+func collectNativeInterface() (map[string]float64, error) {
+	metrics := map[string]float64{}
+	columns := map[string]int{"rx_bytes": 0, "rx_packets": 1, "rx_errors": 2, "rx_drops": 3, "tx_bytes": 8, "tx_packets": 9, "tx_errors": 10, "tx_drops": 11}
+	err := readProcFields("net/dev", func(fields []string) {
+		line := strings.Join(fields, " ")
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return
+		}
+		name := strings.TrimSpace(line[:i])
+		values := strings.Fields(line[i+1:])
+		if name == "lo" || len(values) < 16 {
+			return
+		}
+		name = metricNameComponent(name)
+		for column, index := range columns {
+			metrics["linux.interface."+column+"_"+name], _ = strconv.ParseFloat(values[index], 64)
+		}
+	})
+	return metrics, err
+}
+
+// collectNativeFilesystem collects usage of filesystems on block device in /proc/mounts (bytes).
+// mount point `/` is `root`, and others are joined by `_` (e.g. `/var/log` => `var_log`)
+func collectNativeFilesystem() (map[string]float64, error) {
+	metrics := map[string]float64{}
+	seen := map[string]bool{}
+	var failures []string
+	err := readProcFields("mounts", func(fields []string) {
+		if len(fields) < 3 || seen[fields[1]] {
+			return
+		}
+		if !strings.HasPrefix(fields[0], "/dev/") {
+			return // not block device (e.g. tmpfs, nfs)
+		}
+		seen[fields[1]] = true
+
+		mountPoint := strings.Replace(fields[1], `\040`, " ", -1)
+		size, free, avail, err := filesystemUsage(mountPoint)
+		if err != nil {
+			failures = append(failures, err.Error())
+			return
+		}
+		name := "root"
+		if mountPoint != "/" {
+			name = metricNameComponent(strings.TrimPrefix(mountPoint, "/"))
+		}
+		used := size - free
+		metrics["linux.filesystem.size_"+name] = size
+		metrics["linux.filesystem.used_"+name] = used
+		metrics["linux.filesystem.avail_"+name] = avail
+		if used+avail > 0 {
+			metrics["linux.filesystem.used_percentage_"+name] = used / (used + avail) * 100
+		}
+	})
+	if err == nil && len(failures) > 0 {
+		err = errors.New(strings.Join(failures, ", "))
+	}
+	return metrics, err
+}
+
+// collectNativeProcesses collects number of processes
+func collectNativeProcesses() (map[string]float64, error) {
+	metrics := map[string]float64{}
+	err := readProcFields("stat", func(fields []string) {
+		switch fields[0] {
+		case "procs_running":
+			metrics["linux.processes.running"], _ = strconv.ParseFloat(fields[1], 64)
+		case "procs_blocked":
+			metrics["linux.processes.blocked"], _ = strconv.ParseFloat(fields[1], 64)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			total++
+		}
+	}
+	metrics["linux.processes.total"] = float64(total)
+	return metrics, nil
+}
@@ -0,0 +1,16 @@
+package collect
+
+import (
+	"syscall"
+)
+
+// filesystemUsage returns size, free and available (for non-root user) bytes of filesystem
+func filesystemUsage(mountPoint string) (float64, float64, float64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(mountPoint, &stat)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	blockSize := float64(stat.Bsize)
+	return float64(stat.Blocks) * blockSize, float64(stat.Bfree) * blockSize, float64(stat.Bavail) * blockSize, nil
+}
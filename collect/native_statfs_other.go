@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package collect
+
+import (
+	"errors"
+)
+
+// filesystemUsage is supported only on linux
+func filesystemUsage(mountPoint string) (float64, float64, float64, error) {
+	return 0, 0, 0, errors.New("filesystem usage is not supported on this platform")
+}
@@ -0,0 +1,139 @@
+package collect
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupNativeTestProc(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "happo-agent-proc")
+	assert.Nil(t, err)
+	files := map[string]string{
+		"stat": `cpu  100 2 30 4000 5 0 6 0 0 0
+cpu0 100 2 30 4000 5 0 6 0 0 0
+intr 12345 0 0
+ctxt 32662
+processes 88
+procs_running 2
+procs_blocked 1
+`,
+		"loadavg": "0.05 0.10 0.15 1/234 5678\n",
+		"meminfo": `MemTotal:        1000 kB
+MemFree:          400 kB
+MemAvailable:     700 kB
+Buffers:          100 kB
+Cached:           200 kB
+SwapTotal:        500 kB
+SwapFree:         300 kB
+`,
+		"vmstat": "pswpin 3\npswpout 4\npgfault 100\n",
+		"diskstats": `   7       0 loop0 10 0 10 0 0 0 0 0 0 0 0 0 0 0 0 0 0
+   8       0 sda 1 2 3 4 5 6 7 8 9 10 11 0 0 0 0 0 0
+   8      16 sdb 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0
+`,
+		"net/dev": `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo: 100 1 0 0 0 0 0 0 100 1 0 0 0 0 0 0
+  eth0:1000 10 1 2 0 0 0 0 2000 20 3 4 0 0 0 0
+`,
+		"mounts": "proc /proc proc rw 0 0\n/dev/sda1 " + os.TempDir() + " ext4 rw 0 0\n",
+	}
+	for name, content := range files {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	for _, pid := range []string{"1", "22", "self"} {
+		assert.Nil(t, os.Mkdir(filepath.Join(dir, pid), 0755))
+	}
+	return dir
+}
+
+func TestNativeCollectors1(t *testing.T) {
+	dir := setupNativeTestProc(t)
+	defer os.RemoveAll(dir)
+	defer func(path string) { procPath = path }(procPath)
+	procPath = dir
+
+	var cases = []struct {
+		name     string
+		expected map[string]float64
+	}{
+		{"cpu", map[string]float64{
+			"linux.cpu.user": 100, "linux.cpu.nice": 2, "linux.cpu.system": 30, "linux.cpu.idle": 4000, "linux.cpu.iowait": 5,
+			"linux.cpu.irq": 0, "linux.cpu.softirq": 6, "linux.cpu.steal": 0, "linux.cpu.guest": 0, "linux.cpu.guest_nice": 0,
+			"linux.interrupts.interrupts": 12345, "linux.context_switches.context_switches": 32662, "linux.forks.forks": 88,
+		}},
+		{"loadavg", map[string]float64{"linux.loadavg.load_avg_one": 0.05, "linux.loadavg.load_avg_five": 0.1, "linux.loadavg.load_avg_fifteen": 0.15}},
+		{"memory", map[string]float64{
+			"linux.memory.total": 1024000, "linux.memory.free": 409600, "linux.memory.available": 716800, "linux.memory.buffers": 102400,
+			"linux.memory.cached": 204800, "linux.memory.used": 307200,
+			"linux.memory.swap_total": 512000, "linux.memory.swap_free": 307200, "linux.memory.swap_used": 204800,
+			"linux.swap.pswpin": 3, "linux.swap.pswpout": 4,
+		}},
+		{"disk", map[string]float64{
+			"linux.disk.ios.reads_sda": 1, "linux.disk.ios.writes_sda": 5, "linux.disk.sectors.reads_sda": 3, "linux.disk.sectors.writes_sda": 7,
+			"linux.disk.rwtime.tsreading_sda": 4, "linux.disk.rwtime.tswriting_sda": 8, "linux.disk.ios_in_progress.ios_in_progress_sda": 9,
+			"linux.disk.elapsed.iotime_sda": 10, "linux.disk.elapsed.iotime_weighted_sda": 11,
+		}},
+		{"interface", map[string]float64{
+			"linux.interface.rx_bytes_eth0": 1000, "linux.interface.rx_packets_eth0": 10, "linux.interface.rx_errors_eth0": 1, "linux.interface.rx_drops_eth0": 2,
+			"linux.interface.tx_bytes_eth0": 2000, "linux.interface.tx_packets_eth0": 20, "linux.interface.tx_errors_eth0": 3, "linux.interface.tx_drops_eth0": 4,
+		}},
+		{"processes", map[string]float64{"linux.processes.running": 2, "linux.processes.blocked": 1, "linux.processes.total": 2}},
+	}
+	for _, c := range cases {
+		metrics, err := nativeCollectors[c.name]()
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, c.expected, metrics, c.name)
+	}
+
+	metrics, err := collectNativeFilesystem()
+	assert.Nil(t, err)
+	name := metricNameComponent(strings.TrimPrefix(os.TempDir(), "/"))
+	assert.True(t, metrics["linux.filesystem.size_"+name] > 0)
+	assert.True(t, metrics["linux.filesystem.used_"+name]+metrics["linux.filesystem.avail_"+name] <= metrics["linux.filesystem.size_"+name])
+	assert.Equal(t, 4, len(metrics))
+}
+
+func TestExecNativeMetricPlugin1(t *testing.T) {
+	dir := setupNativeTestProc(t)
+	defer os.RemoveAll(dir)
+	defer func(path string) { procPath = path }(procPath)
+	procPath = dir
+
+	stdout, stderr, outcome, err := execMetricPlugin(halib.NativeMetricPluginName, "loadavg,processes", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "", stderr)
+	assert.Equal(t, halib.MetricPluginOutcomeOK, outcome)
+	metrics, _, err := ParseMetricData(stdout)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(metrics))
+
+	_, _, outcome, err = execMetricPlugin(halib.NativeMetricPluginName, "loadavg nosuch", "", 0)
+	assert.NotNil(t, err)
+	assert.Equal(t, halib.MetricPluginOutcomeError, outcome)
+
+	// output of succeeded collectors is returned
+	os.Remove(filepath.Join(dir, "loadavg"))
+	stdout, stderr, outcome, err = execMetricPlugin(halib.NativeMetricPluginName, "loadavg processes", "", 0)
+	assert.NotNil(t, err)
+	assert.Contains(t, stderr, "loadavg: ")
+	assert.Equal(t, halib.MetricPluginOutcomeFailed, outcome)
+	metrics, _, err = ParseMetricData(stdout)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(metrics))
+
+	assert.Nil(t, ValidateMetricConfig(halib.MetricConfig{Metrics: []halib.MetricHostConfig{
+		{Hostname: "localhost", Plugins: []halib.MetricPluginConfig{{PluginName: halib.NativeMetricPluginName}}},
+	}}))
+	assert.NotNil(t, ValidateMetricConfig(halib.MetricConfig{Metrics: []halib.MetricHostConfig{
+		{Hostname: "localhost", Plugins: []halib.MetricPluginConfig{{PluginName: halib.NativeMetricPluginName, PluginOption: "cpus"}}},
+	}}))
+}
@@ -0,0 +1,205 @@
+package collect
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// --- Package Variables
+
+var (
+	// MetricRollupAfterSeconds is age of metrics to be rolled up. 0 means rollup is disabled
+	MetricRollupAfterSeconds int64
+	// MetricRollupSeconds is period of rolled up metrics
+	MetricRollupSeconds = int64(halib.DefaultMetricRollupSeconds)
+)
+
+// metricRollupKeyPrefix is key prefix of rolled up metrics `a-<start of period>-<seq>`. sorted before `m-`, as rolled up metrics are older
+const metricRollupKeyPrefix = "a-"
+
+// --- Method
+
+// RunMetricRollup rolls up old metrics every interval until stop is closed
+func RunMetricRollup(stop <-chan struct{}, interval time.Duration) {
+	log := util.HappoAgentLogger()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		rolled, err := RollupMetrics(time.Now())
+		if err != nil {
+			log.Errorf("metric rollup failed: %s", err.Error())
+			continue
+		}
+		if rolled > 0 {
+			log.Infof("metric rollup: %d collections are rolled up", rolled)
+		}
+	}
+}
+
+// RollupMetrics aggregates metrics older than MetricRollupAfterSeconds to min/max/avg/last of each MetricRollupSeconds period,
+// and retires old rolled up metrics. leased metrics are not rolled up. returns number of rolled up collections
+func RollupMetrics(now time.Time) (int, error) {
+	if MetricRollupAfterSeconds <= 0 || MetricRollupSeconds <= 0 {
+		return 0, nil
+	}
+
+	metricLeases.Lock()
+	defer metricLeases.Unlock()
+	leased := leasedKeys(now)
+
+	transaction, err := db.DB.OpenTransaction()
+	if err != nil {
+		return 0, err
+	}
+	defer transaction.Discard()
+
+	// aligned to period, to roll up all collections of a period at once
+	threshold := now.Unix() - MetricRollupAfterSeconds
+	threshold -= threshold % MetricRollupSeconds
+
+	rolled := 0
+	periods := map[int64]map[string]*halib.MetricsData{} // start of period => hostname and tags => rolled up metrics
+	iter := transaction.NewIterator(
+		&leveldbUtil.Range{
+			Start: []byte("m-0"),
+			Limit: []byte(fmt.Sprintf("m-%d", threshold))},
+		nil)
+	for iter.Next() {
+		key := string(iter.Key())
+		if leased[key] {
+			continue
+		}
+		metricsData := []halib.MetricsData{}
+		dec := gob.NewDecoder(bytes.NewReader(iter.Value()))
+		err = dec.Decode(&metricsData)
+		if err != nil {
+			util.HappoAgentLogger().Error(err)
+			continue
+		}
+		for _, metrics := range metricsData {
+			start := metrics.Timestamp - metrics.Timestamp%MetricRollupSeconds
+			if periods[start] == nil {
+				periods[start] = map[string]*halib.MetricsData{}
+			}
+			series := metrics.HostName + "\t" + tagsKey(metrics.Tags)
+			if periods[start][series] == nil {
+				periods[start][series] = newRolledUpMetrics(metrics.HostName, metrics.Tags, start)
+			}
+			mergeRolledUpMetrics(periods[start][series], metrics)
+		}
+		transaction.Delete([]byte(key), nil)
+		rolled++
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return 0, err
+	}
+
+	// late collections of rolled up period are stored to new key, as rolled up metrics may be read (and leased) already
+	for start, series := range periods {
+		keys := make([]string, 0, len(series))
+		for key := range series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		rolledUp := make([]halib.MetricsData, 0, len(keys))
+		for _, key := range keys {
+			rolledUp = append(rolledUp, *series[key])
+		}
+
+		var b bytes.Buffer
+		enc := gob.NewEncoder(&b)
+		err = enc.Encode(rolledUp)
+		if err != nil {
+			return 0, err
+		}
+		transaction.Put(newMetricKey(transaction, metricRollupKeyPrefix, start), b.Bytes(), nil)
+	}
+
+	// retire old rolled up metrics
+	oldestThreshold := now.Unix() - db.MetricRollupsMaxLifetimeSeconds
+	iter = transaction.NewIterator(
+		&leveldbUtil.Range{
+			Start: []byte(metricRollupKeyPrefix + "0"),
+			Limit: []byte(fmt.Sprintf("%s%d", metricRollupKeyPrefix, oldestThreshold))},
+		nil)
+	for iter.Next() {
+		transaction.Delete(iter.Key(), nil)
+	}
+	iter.Release()
+
+	err = transaction.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return rolled, nil
+}
+
+func newRolledUpMetrics(hostname string, tags map[string]string, start int64) *halib.MetricsData {
+	return &halib.MetricsData{
+		HostName:  hostname,
+		Timestamp: start,
+		Metrics:   map[string]float64{},
+		Tags:      tags,
+		Aggregated: &halib.MetricsAggregate{
+			Seconds: MetricRollupSeconds,
+			Count:   map[string]int64{},
+			Min:     map[string]float64{},
+			Max:     map[string]float64{},
+			Last:    map[string]float64{},
+		},
+	}
+}
+
+// mergeRolledUpMetrics merges metrics (raw or rolled up) of the same hostname and tags to rolledUp. Metrics of rolledUp are average
+func mergeRolledUpMetrics(rolledUp *halib.MetricsData, metrics halib.MetricsData) {
+	aggregate := rolledUp.Aggregated
+	lastTimestamp := metrics.Timestamp
+	if metrics.Aggregated != nil {
+		lastTimestamp = metrics.Aggregated.LastTimestamp
+	}
+	newer := lastTimestamp >= aggregate.LastTimestamp
+
+	for name, value := range metrics.Metrics {
+		count, min, max, last := int64(1), value, value, value
+		if metrics.Aggregated != nil {
+			count = metrics.Aggregated.Count[name]
+			min, max, last = metrics.Aggregated.Min[name], metrics.Aggregated.Max[name], metrics.Aggregated.Last[name]
+		}
+		if count <= 0 {
+			continue
+		}
+
+		total := aggregate.Count[name]
+		if total == 0 {
+			aggregate.Min[name], aggregate.Max[name] = min, max
+		} else {
+			if min < aggregate.Min[name] {
+				aggregate.Min[name] = min
+			}
+			if max > aggregate.Max[name] {
+				aggregate.Max[name] = max
+			}
+		}
+		if _, ok := aggregate.Last[name]; !ok || newer {
+			aggregate.Last[name] = last
+		}
+		rolledUp.Metrics[name] = (rolledUp.Metrics[name]*float64(total) + value*float64(count)) / float64(total+count)
+		aggregate.Count[name] = total + count
+	}
+	if newer {
+		aggregate.LastTimestamp = lastTimestamp
+	}
+}
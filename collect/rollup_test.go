@@ -0,0 +1,73 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollupMetrics1(t *testing.T) {
+	GetCollectedMetricsWithFilter(MetricFilter{}) // cleanup
+	defer GetCollectedMetricsWithFilter(MetricFilter{})
+	defer func(after, seconds int64) {
+		MetricRollupAfterSeconds, MetricRollupSeconds = after, seconds
+	}(MetricRollupAfterSeconds, MetricRollupSeconds)
+
+	base := time.Unix(1505180700, 0) // aligned to 300 seconds
+	save := func(offset int64, metricsData ...halib.MetricsData) {
+		err := SaveMetrics(base.Add(time.Duration(offset)*time.Second), metricsData)
+		assert.Nil(t, err)
+	}
+	save(0, halib.MetricsData{HostName: "web01", Timestamp: base.Unix(), Metrics: map[string]float64{"test.value": 1}})
+	save(60, halib.MetricsData{HostName: "web01", Timestamp: base.Unix() + 60, Metrics: map[string]float64{"test.value": 3}},
+		halib.MetricsData{HostName: "db01", Timestamp: base.Unix() + 60, Metrics: map[string]float64{"test.value": 5}})
+	save(120, halib.MetricsData{HostName: "web01", Timestamp: base.Unix() + 120, Metrics: map[string]float64{"test.value": 2}, Tags: map[string]string{"role": "web"}})
+	save(300, halib.MetricsData{HostName: "web01", Timestamp: base.Unix() + 300, Metrics: map[string]float64{"test.value": 10}})
+
+	// disabled
+	MetricRollupAfterSeconds = 0
+	rolled, err := RollupMetrics(base.Add(1000 * time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, rolled)
+
+	MetricRollupAfterSeconds, MetricRollupSeconds = 600, 300
+	rolled, err = RollupMetrics(base.Add(1000 * time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, rolled)
+
+	// late collection of rolled up period is stored separately
+	save(200, halib.MetricsData{HostName: "web01", Timestamp: base.Unix() + 200, Metrics: map[string]float64{"test.value": 0}})
+	rolled, err = RollupMetrics(base.Add(1000 * time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, rolled)
+
+	// rolled up metrics are returned first. series of different tags are rolled up separately
+	result, err := GetCollectedMetricsWithFilter(MetricFilter{Limit: 1, MetricPrefix: "test."})
+	assert.Nil(t, err)
+	assert.True(t, result.HasMore)
+	assert.Equal(t, "a-1505180700-000001", result.NextCursor)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "db01", Timestamp: base.Unix(), Metrics: map[string]float64{"test.value": 5},
+			Aggregated: &halib.MetricsAggregate{Seconds: 300, LastTimestamp: base.Unix() + 60,
+				Count: map[string]int64{"test.value": 1}, Min: map[string]float64{"test.value": 5}, Max: map[string]float64{"test.value": 5}, Last: map[string]float64{"test.value": 5}}},
+		{HostName: "web01", Timestamp: base.Unix(), Metrics: map[string]float64{"test.value": 2},
+			Aggregated: &halib.MetricsAggregate{Seconds: 300, LastTimestamp: base.Unix() + 60,
+				Count: map[string]int64{"test.value": 2}, Min: map[string]float64{"test.value": 1}, Max: map[string]float64{"test.value": 3}, Last: map[string]float64{"test.value": 3}}},
+		{HostName: "web01", Timestamp: base.Unix(), Metrics: map[string]float64{"test.value": 2}, Tags: map[string]string{"role": "web"},
+			Aggregated: &halib.MetricsAggregate{Seconds: 300, LastTimestamp: base.Unix() + 120,
+				Count: map[string]int64{"test.value": 1}, Min: map[string]float64{"test.value": 2}, Max: map[string]float64{"test.value": 2}, Last: map[string]float64{"test.value": 2}}},
+	}, result.MetricData)
+
+	result, err = GetCollectedMetricsWithFilter(MetricFilter{Cursor: result.NextCursor})
+	assert.Nil(t, err)
+	assert.False(t, result.HasMore)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "web01", Timestamp: base.Unix(), Metrics: map[string]float64{"test.value": 0},
+			Aggregated: &halib.MetricsAggregate{Seconds: 300, LastTimestamp: base.Unix() + 200,
+				Count: map[string]int64{"test.value": 1}, Min: map[string]float64{"test.value": 0}, Max: map[string]float64{"test.value": 0}, Last: map[string]float64{"test.value": 0}}},
+		{HostName: "web01", Timestamp: base.Unix() + 300, Metrics: map[string]float64{"test.value": 10}},
+	}, result.MetricData)
+}
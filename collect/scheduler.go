@@ -0,0 +1,280 @@
+package collect
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// --- Package Variables
+
+var metricPluginStatus = struct {
+	sync.Mutex
+	data map[string]halib.MetricPluginStatus // plugin key => status
+}{data: map[string]halib.MetricPluginStatus{}}
+
+// --- Struct
+
+// MetricScheduler runs metric plugins in metrics.yaml by bounded worker pool.
+// each plugin runs on own interval, and first run is jittered in the interval to avoid thundering herds.
+// results are saved to metric buffer together every DefaultMetricIntervalSeconds, so that a buffer key is a collection period
+type MetricScheduler struct {
+	Config  *MetricConfigLoader
+	Workers int
+
+	generation   int // generation of applied config
+	plugins      map[string]*scheduledPlugin
+	jobs         chan metricJob
+	tick         time.Duration
+	saveInterval time.Duration
+	savedAt      time.Time
+	pending      []halib.MetricsData // results not saved yet
+	random       *rand.Rand
+	mu           sync.Mutex
+}
+
+type scheduledPlugin struct {
+	key       string
+	hostname  string
+	config    halib.MetricPluginConfig
+	rules     *MetricRules
+	interval  time.Duration
+	nextRunAt time.Time
+	running   bool
+}
+
+// metricJob is a run of plugin. config and rules are snapshot at dispatch, so that reload does not change running plugin
+type metricJob struct {
+	plugin   *scheduledPlugin
+	hostname string
+	config   halib.MetricPluginConfig
+	rules    *MetricRules
+}
+
+// --- Method
+
+// NewMetricScheduler returns MetricScheduler. when workers <= 0, DefaultMetricWorkers
+func NewMetricScheduler(config *MetricConfigLoader, workers int) *MetricScheduler {
+	if workers <= 0 {
+		workers = halib.DefaultMetricWorkers
+	}
+	return &MetricScheduler{
+		Config:  config,
+		Workers: workers,
+		plugins: map[string]*scheduledPlugin{},
+		jobs:    make(chan metricJob),
+		tick:    time.Second,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+
+		saveInterval: halib.DefaultMetricIntervalSeconds * time.Second,
+	}
+}
+
+// Run dispatches due plugins to workers until stop is closed. pending results are saved before return
+func (s *MetricScheduler) Run(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for i := 0; i < s.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range s.jobs {
+				s.finish(job.plugin, s.run(job))
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(s.tick)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		if config, generation := s.Config.Get(); generation != s.generation {
+			s.generation = generation
+			s.reload(config, now)
+		}
+		s.dispatch(now)
+		if now.Sub(s.savedAt) >= s.saveInterval {
+			s.save(now)
+		}
+
+		select {
+		case <-stop:
+			close(s.jobs)
+			wg.Wait()
+			s.save(time.Now())
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reload applies config. schedule of unchanged plugins is kept
+func (s *MetricScheduler) reload(config halib.MetricConfig, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := map[string]bool{}
+	for _, metricHostList := range config.Metrics {
+		for _, metricPlugin := range metricHostList.Plugins {
+			key := metricPluginKey(metricHostList.Hostname, metricPlugin)
+			rules, err := CompileMetricRules(metricPlugin)
+			if err != nil {
+				util.HappoAgentLogger().Errorf("metric plugin %s is not scheduled: %s", metricPlugin.PluginName, err.Error())
+				continue
+			}
+			current[key] = true
+
+			interval := time.Duration(metricPlugin.Interval) * time.Second
+			if interval <= 0 {
+				interval = halib.DefaultMetricIntervalSeconds * time.Second
+			}
+			p, ok := s.plugins[key]
+			if !ok {
+				p = &scheduledPlugin{key: key, hostname: metricHostList.Hostname}
+				s.plugins[key] = p
+			}
+			if !ok || p.interval != interval {
+				p.nextRunAt = now.Add(time.Duration(s.random.Int63n(int64(interval))))
+			}
+			p.config = metricPlugin
+			p.rules = rules
+			p.interval = interval
+			s.updateStatus(p)
+		}
+	}
+
+	for key := range s.plugins {
+		if !current[key] {
+			delete(s.plugins, key)
+			metricPluginStatus.Lock()
+			delete(metricPluginStatus.data, key)
+			metricPluginStatus.Unlock()
+		}
+	}
+}
+
+// dispatch sends due plugins to idle workers, in order of nextRunAt. plugins not sent are retried in next tick
+func (s *MetricScheduler) dispatch(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*scheduledPlugin
+	for _, p := range s.plugins {
+		if !p.running && !p.nextRunAt.After(now) {
+			due = append(due, p)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].nextRunAt.Before(due[j].nextRunAt)
+	})
+
+	for _, p := range due {
+		select {
+		case s.jobs <- metricJob{plugin: p, hostname: p.hostname, config: p.config, rules: p.rules}:
+		default:
+			return // all workers are busy
+		}
+		p.running = true
+		p.nextRunAt = p.nextRunAt.Add(p.interval)
+		if !p.nextRunAt.After(now) {
+			// too late. skip missed runs
+			p.nextRunAt = now.Add(p.interval)
+		}
+	}
+}
+
+// run executes plugin and queues metrics to be saved. returns status of this run
+func (s *MetricScheduler) run(job metricJob) halib.MetricPluginStatus {
+	metrics, status := collectMetricPlugin(job.hostname, job.config, job.rules)
+	if metrics != nil {
+		s.mu.Lock()
+		s.pending = append(s.pending, *metrics)
+		s.mu.Unlock()
+	}
+	return status
+}
+
+// save saves queued metrics to metric buffer at once
+func (s *MetricScheduler) save(now time.Time) {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.savedAt = now
+	s.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	err := SaveMetrics(now, pending)
+	if err != nil {
+		util.HappoAgentLogger().Error(err)
+	}
+}
+
+// finish marks plugin as idle and records status. removed plugins are ignored
+func (s *MetricScheduler) finish(p *scheduledPlugin, status halib.MetricPluginStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.running = false
+	if s.plugins[p.key] == p {
+		status.IntervalSeconds = int(p.interval / time.Second)
+		status.NextRunAt = p.nextRunAt.Unix()
+		recordMetricPluginResult(p.key, status)
+	}
+}
+
+// updateStatus writes schedule of plugin to status. last result is kept
+func (s *MetricScheduler) updateStatus(p *scheduledPlugin) {
+	metricPluginStatus.Lock()
+	defer metricPluginStatus.Unlock()
+
+	status := metricPluginStatus.data[p.key]
+	status.Hostname = p.hostname
+	status.PluginName = p.config.PluginName
+	status.PluginOption = p.config.PluginOption
+	status.IntervalSeconds = int(p.interval / time.Second)
+	status.NextRunAt = p.nextRunAt.Unix()
+	metricPluginStatus.data[p.key] = status
+}
+
+// metricPluginKey returns identifier of plugin in metrics.yaml
+func metricPluginKey(hostname string, plugin halib.MetricPluginConfig) string {
+	return fmt.Sprintf("%s\t%s\t%s", hostname, plugin.PluginName, plugin.PluginOption)
+}
+
+// recordMetricPluginResult stores result of plugin run, and counts consecutive failures
+func recordMetricPluginResult(key string, status halib.MetricPluginStatus) {
+	metricPluginStatus.Lock()
+	defer metricPluginStatus.Unlock()
+
+	if status.Outcome != halib.MetricPluginOutcomeOK {
+		status.ConsecutiveFailures = metricPluginStatus.data[key].ConsecutiveFailures + 1
+	}
+	metricPluginStatus.data[key] = status
+}
+
+// GetMetricPluginStatus returns status of each scheduled metric plugin, sorted by hostname, plugin name and option
+func GetMetricPluginStatus() []halib.MetricPluginStatus {
+	metricPluginStatus.Lock()
+	defer metricPluginStatus.Unlock()
+
+	result := []halib.MetricPluginStatus{}
+	for _, status := range metricPluginStatus.data {
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Hostname != result[j].Hostname {
+			return result[i].Hostname < result[j].Hostname
+		}
+		if result[i].PluginName != result[j].PluginName {
+			return result[i].PluginName < result[j].PluginName
+		}
+		return result[i].PluginOption < result[j].PluginOption
+	})
+	return result
+}
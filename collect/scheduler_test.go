@@ -0,0 +1,179 @@
+package collect
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricSchedulerReload1(t *testing.T) {
+	resetMetricPluginStatus()
+	s := NewMetricScheduler(NewMetricConfigLoader(TestConfigFile), 0)
+	assert.Equal(t, halib.DefaultMetricWorkers, s.Workers)
+
+	now := time.Now()
+	s.reload(halib.MetricConfig{Metrics: []halib.MetricHostConfig{{
+		Hostname: "localhost",
+		Plugins: []halib.MetricPluginConfig{
+			{PluginName: TestPlugin},
+			{PluginName: TestPlugin, PluginOption: "1", Interval: 10},
+		},
+	}}}, now)
+	status := GetMetricPluginStatus()
+	assert.Equal(t, 2, len(status))
+	assert.Equal(t, halib.DefaultMetricIntervalSeconds, status[0].IntervalSeconds)
+	assert.Equal(t, 10, status[1].IntervalSeconds)
+	for _, st := range status {
+		// jittered in interval
+		assert.True(t, st.NextRunAt >= now.Unix())
+		assert.True(t, st.NextRunAt <= now.Unix()+int64(st.IntervalSeconds))
+		assert.EqualValues(t, 0, st.LastRunAt)
+	}
+
+	// schedule is kept, removed plugin is forgotten
+	nextRunAt := status[1].NextRunAt
+	s.reload(halib.MetricConfig{Metrics: []halib.MetricHostConfig{{
+		Hostname: "localhost",
+		Plugins:  []halib.MetricPluginConfig{{PluginName: TestPlugin, PluginOption: "1", Interval: 10}},
+	}}}, now.Add(time.Second))
+	status = GetMetricPluginStatus()
+	assert.Equal(t, 1, len(status))
+	assert.Equal(t, nextRunAt, status[0].NextRunAt)
+
+	s.reload(halib.MetricConfig{}, now)
+	assert.Equal(t, 0, len(GetMetricPluginStatus()))
+}
+
+func TestMetricSchedulerRun1(t *testing.T) {
+	GetCollectedMetrics() // cleanup
+	resetMetricPluginStatus()
+
+	f, err := ioutil.TempFile("", "metrics.yaml")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`metrics:
+- hostname: localhost
+  plugins:
+  - plugin_name: metrics_test_plugin
+    plugin_option: "5"
+    interval: 1
+  - plugin_name: monitor_test_plugin
+    plugin_option: "2"
+    interval: 1
+`)
+	f.Close()
+
+	config := NewMetricConfigLoader(f.Name())
+	assert.Nil(t, config.Reload())
+	s := NewMetricScheduler(config, 2)
+	s.tick = 100 * time.Millisecond
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Run(stop)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	var status []halib.MetricPluginStatus
+	for time.Now().Before(deadline) {
+		status = GetMetricPluginStatus()
+		if len(status) == 2 && status[0].LastRunAt > 0 && status[1].LastRunAt > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	close(stop)
+	<-done // pending results are saved
+
+	assert.Equal(t, 2, len(status))
+	assert.Equal(t, TestPlugin, status[0].PluginName)
+	assert.Equal(t, halib.MetricPluginOutcomeOK, status[0].Outcome)
+	assert.Equal(t, "monitor_test_plugin", status[1].PluginName)
+	assert.Equal(t, halib.MetricPluginOutcomeFailed, status[1].Outcome)
+	assert.Equal(t, "exit status 2", status[1].Message)
+
+	collected := GetCollectedMetrics()
+	assert.NotEqual(t, 0, len(collected))
+	for _, value := range collected[0].Metrics {
+		assert.Equal(t, float64(5), value)
+	}
+
+	resetMetricPluginStatus()
+}
+
+func TestMetricSchedulerReload2(t *testing.T) {
+	GetCollectedMetrics() // cleanup
+	resetMetricPluginStatus()
+
+	// reload while plugins are running (detected by go test -race)
+	s := NewMetricScheduler(NewMetricConfigLoader(TestConfigFile), 2)
+	s.tick = 10 * time.Millisecond
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Run(stop)
+		close(done)
+	}()
+
+	for i := 0; i < 100; i++ {
+		s.reload(halib.MetricConfig{Metrics: []halib.MetricHostConfig{{
+			Hostname: "localhost",
+			Plugins: []halib.MetricPluginConfig{
+				{PluginName: TestPlugin, PluginOption: "5", Interval: 1, Prefix: fmt.Sprintf("p%d", i%2)},
+			},
+		}}}, time.Now())
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+
+	collected := GetCollectedMetrics()
+	assert.NotEqual(t, 0, len(collected))
+	for _, metrics := range collected {
+		for name := range metrics.Metrics {
+			assert.Regexp(t, `^p[01]\.`, name)
+		}
+	}
+
+	resetMetricPluginStatus()
+}
+
+func TestMetricSchedulerRun2(t *testing.T) {
+	GetCollectedMetrics() // cleanup
+	resetMetricPluginStatus()
+
+	// results of plugins in a save interval are saved to one buffer key
+	s := NewMetricScheduler(NewMetricConfigLoader(TestConfigFile), 4)
+	s.tick = 10 * time.Millisecond
+	s.saveInterval = time.Hour
+	s.reload(halib.MetricConfig{Metrics: []halib.MetricHostConfig{{
+		Hostname: "localhost",
+		Plugins: []halib.MetricPluginConfig{
+			{PluginName: TestPlugin, PluginOption: "1", Interval: 1},
+			{PluginName: TestPlugin, PluginOption: "2", Interval: 1},
+			{PluginName: TestPlugin, PluginOption: "3", Interval: 1},
+		},
+	}}}, time.Now())
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.Run(stop)
+		close(done)
+	}()
+	time.Sleep(2500 * time.Millisecond)
+	close(stop)
+	<-done
+
+	collected := GetCollectedMetricsWithLimit(1)
+	assert.True(t, len(collected) >= 6, "%d", len(collected))
+	assert.Nil(t, GetCollectedMetrics())
+
+	resetMetricPluginStatus()
+}
@@ -0,0 +1,140 @@
+package collect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// MetricShipper pushes buffered metrics to remote endpoint (push mode).
+// metrics are deleted from buffer only after endpoint returns 2xx
+type MetricShipper struct {
+	Endpoint   string // full URL. e.g. https://bastion:6777/metric/append
+	APIKey     string
+	BatchSize  int
+	Interval   time.Duration
+	Timeout    time.Duration
+	MaxBackoff time.Duration
+
+	client *http.Client
+}
+
+// NewMetricShipper returns MetricShipper with default parameters. connection to endpoint is configured by clientConfig
+// (Timeout is overridden by MetricShipper.Timeout)
+func NewMetricShipper(endpoint string, apiKey string, clientConfig util.HTTPClientConfig) (*MetricShipper, error) {
+	clientConfig.Timeout = 0
+	client, err := util.NewHTTPClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &MetricShipper{
+		Endpoint:   endpoint,
+		APIKey:     apiKey,
+		BatchSize:  halib.DefaultMetricFetchLimit,
+		Interval:   halib.DefaultPushIntervalSeconds * time.Second,
+		Timeout:    halib.DefaultPushTimeoutSeconds * time.Second,
+		MaxBackoff: halib.DefaultPushMaxBackoffSeconds * time.Second,
+		client:     client,
+	}, nil
+}
+
+// Run ships metrics every Interval until stop is closed. on failure, retry with exponential backoff
+func (s *MetricShipper) Run(stop <-chan struct{}) {
+	log := util.HappoAgentLogger()
+	var backoff time.Duration
+	wait := s.Interval
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+
+		hasMore, err := s.ShipOnce()
+		if err != nil {
+			backoff = nextBackoff(backoff, s.MaxBackoff)
+			log.Errorf("metric push failed (retry after %v): %s", backoff, err.Error())
+			wait = backoff
+			continue
+		}
+		backoff = 0
+		wait = s.Interval
+		if hasMore {
+			// drain backlog without waiting
+			wait = 0
+		}
+	}
+}
+
+// ShipOnce sends one batch. returns whether more metrics remain
+func (s *MetricShipper) ShipOnce() (bool, error) {
+	// lease prevents /metric poller from reading same metrics while sending
+	result, leaseID, err := LeaseCollectedMetrics(MetricFilter{Limit: s.BatchSize}, s.Timeout+time.Minute)
+	if err != nil {
+		return false, err
+	}
+	if leaseID == "" {
+		return false, nil
+	}
+
+	err = s.send(result.MetricData)
+	if err != nil {
+		ReleaseMetricLease(leaseID)
+		return false, err
+	}
+	_, err = AckCollectedMetrics(leaseID)
+	if err != nil {
+		return false, err
+	}
+	return result.HasMore, nil
+}
+
+func (s *MetricShipper) send(metricData []halib.MetricsData) error {
+	data, err := json.Marshal(halib.MetricAppendRequest{APIKey: s.APIKey, MetricData: metricData})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body) // for keep-alive
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+// nextBackoff doubles backoff from DefaultPushInitialBackoffSeconds up to max
+func nextBackoff(backoff time.Duration, max time.Duration) time.Duration {
+	backoff = backoff * 2
+	if backoff < halib.DefaultPushInitialBackoffSeconds*time.Second {
+		backoff = halib.DefaultPushInitialBackoffSeconds * time.Second
+	}
+	if max > 0 && backoff > max {
+		backoff = max
+	}
+	return backoff
+}
@@ -0,0 +1,146 @@
+package collect
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricShipperShipOnce1(t *testing.T) {
+	GetCollectedMetrics() // cleanup
+
+	base := time.Now()
+	for i := 0; i < 3; i++ {
+		err := SaveMetrics(base.Add(time.Duration(i)*time.Second), []halib.MetricsData{
+			{HostName: "localhost", Timestamp: base.Unix() + int64(i), Metrics: map[string]float64{"test.value": float64(i)}},
+		})
+		assert.Nil(t, err)
+	}
+
+	status := http.StatusInternalServerError
+	var received []halib.MetricAppendRequest
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request halib.MetricAppendRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		received = append(received, request)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	shipper, err := NewMetricShipper(ts.URL+"/metric/append", "secret", util.HTTPClientConfig{InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	shipper.BatchSize = 2
+
+	// failure keeps metrics
+	_, err = shipper.ShipOnce()
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(3), GetMetricDataBufferStatus(true)["length"])
+
+	status = http.StatusOK
+	hasMore, err := shipper.ShipOnce()
+	assert.Nil(t, err)
+	assert.True(t, hasMore)
+	assert.Equal(t, int64(1), GetMetricDataBufferStatus(true)["length"])
+
+	hasMore, err = shipper.ShipOnce()
+	assert.Nil(t, err)
+	assert.False(t, hasMore)
+	assert.Equal(t, int64(0), GetMetricDataBufferStatus(true)["length"])
+
+	// nothing to send
+	hasMore, err = shipper.ShipOnce()
+	assert.Nil(t, err)
+	assert.False(t, hasMore)
+
+	assert.Equal(t, 3, len(received))
+	assert.Equal(t, "secret", received[0].APIKey)
+	assert.Equal(t, received[0].MetricData, received[1].MetricData) // retried same batch
+	assert.Equal(t, float64(2), received[2].MetricData[0].Metrics["test.value"])
+}
+
+func TestMetricShipperShipOnce2(t *testing.T) {
+	GetCollectedMetrics() // cleanup
+
+	now := time.Now()
+	err := SaveMetrics(now, []halib.MetricsData{
+		{HostName: "localhost", Timestamp: now.Unix(), Metrics: map[string]float64{"test.value": 1}},
+	})
+	assert.Nil(t, err)
+
+	// metrics saved in the same second while pushing
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SaveMetrics(now, []halib.MetricsData{
+			{HostName: "localhost", Timestamp: now.Unix(), Metrics: map[string]float64{"test.value": 2}},
+		})
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	shipper, err := NewMetricShipper(ts.URL+"/metric/append", "secret", util.HTTPClientConfig{InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	_, err = shipper.ShipOnce()
+	assert.Nil(t, err)
+
+	got := GetCollectedMetrics()
+	assert.Equal(t, 1, len(got))
+	assert.Equal(t, float64(2), got[0].Metrics["test.value"])
+}
+
+func TestMetricShipperShipOnce3(t *testing.T) {
+	GetCollectedMetrics() // cleanup
+
+	now := time.Now()
+	err := SaveMetrics(now, []halib.MetricsData{
+		{HostName: "localhost", Timestamp: now.Unix(), Metrics: map[string]float64{"test.value": 1}},
+	})
+	assert.Nil(t, err)
+
+	stall := make(chan struct{})
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stall" {
+			<-stall
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(stall)
+
+	// certificate is not pinned
+	shipper, err := NewMetricShipper(ts.URL+"/metric/append", "secret", util.HTTPClientConfig{Fingerprints: []string{strings.Repeat("00", 32)}})
+	assert.Nil(t, err)
+	_, err = shipper.ShipOnce()
+	assert.NotNil(t, err)
+
+	// stalled endpoint times out
+	fingerprint := util.CertificateFingerprint(ts.Certificate().Raw)
+	shipper, err = NewMetricShipper(ts.URL+"/stall", "secret", util.HTTPClientConfig{Fingerprints: []string{fingerprint}})
+	assert.Nil(t, err)
+	shipper.Timeout = 100 * time.Millisecond
+	_, err = shipper.ShipOnce()
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(1), GetMetricDataBufferStatus(true)["length"])
+
+	// pinned certificate is accepted
+	shipper, err = NewMetricShipper(ts.URL+"/metric/append", "secret", util.HTTPClientConfig{Fingerprints: []string{fingerprint}})
+	assert.Nil(t, err)
+	_, err = shipper.ShipOnce()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(GetCollectedMetrics()))
+}
+
+func TestNextBackoff1(t *testing.T) {
+	backoff := nextBackoff(0, 30*time.Second)
+	assert.Equal(t, halib.DefaultPushInitialBackoffSeconds*time.Second, backoff)
+	backoff = nextBackoff(backoff, 30*time.Second)
+	assert.Equal(t, 2*halib.DefaultPushInitialBackoffSeconds*time.Second, backoff)
+	backoff = nextBackoff(backoff, 12*time.Second)
+	assert.Equal(t, 12*time.Second, backoff)
+}
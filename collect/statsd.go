@@ -0,0 +1,310 @@
+package collect
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// --- Package Variables
+
+var statsdNameReplacer = strings.NewReplacer(" ", "_", "\t", "_", "/", "-")
+
+// --- Struct
+
+// StatsdServer receives StatsD (and DogStatsD) metrics, and saves aggregates to metric buffer every FlushInterval.
+//
+// counter is `<name>.count` and `<name>.rate` (per second), gauge and set (number of unique values) are `<name>`,
+// timer and histogram are `<name>.{count,min,max,mean,median,p95,sum}` (`<name>.timer.*` if <name> is also a counter).
+// metrics with different DogStatsD tags are saved separately. gauges and tags without samples for StatsdExpireIntervals are forgotten
+type StatsdServer struct {
+	HostName      string
+	FlushInterval time.Duration
+
+	buckets map[string]*statsdBucket // tags => metrics
+	mu      sync.Mutex
+}
+
+type statsdBucket struct {
+	tags     map[string]string
+	counters map[string]float64
+	gauges   map[string]float64 // kept after flush, like etsy statsd
+	timers   map[string][]float64
+	sets     map[string]map[string]bool
+
+	timerCounts  map[string]float64 // adjusted by sample rate
+	counterNames map[string]bool    // names ever used as counter, to keep timer metric names stable
+	gaugeIdle    map[string]int     // flushes since last sample
+	idle         int                // flushes since last sample
+}
+
+type statsdSample struct {
+	name       string
+	value      string
+	metricType string
+	rate       float64
+	tags       map[string]string
+}
+
+// --- Method
+
+// NewStatsdServer returns StatsdServer. when flushInterval <= 0, DefaultMetricIntervalSeconds
+func NewStatsdServer(hostname string, flushInterval time.Duration) *StatsdServer {
+	if flushInterval <= 0 {
+		flushInterval = halib.DefaultMetricIntervalSeconds * time.Second
+	}
+	return &StatsdServer{HostName: hostname, FlushInterval: flushInterval, buckets: map[string]*statsdBucket{}}
+}
+
+// Listen opens udp (`host:port`) or unixgram (socket path) listener. stale socket file is removed
+func (s *StatsdServer) Listen(network string, address string) (net.PacketConn, error) {
+	if network == "unixgram" {
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return net.ListenPacket(network, address)
+}
+
+// Serve reads packets from conn until conn is closed
+func (s *StatsdServer) Serve(conn net.PacketConn) {
+	buf := make([]byte, halib.StatsdMaxPacketBytes)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if opError, ok := err.(*net.OpError); ok && opError.Temporary() {
+				continue
+			}
+			util.HappoAgentLogger().Debugf("statsd listener closed: %s", err.Error())
+			return
+		}
+		s.Handle(buf[:n])
+	}
+}
+
+// Run flushes aggregates every FlushInterval until stop is closed
+func (s *StatsdServer) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			err := s.Flush(now)
+			if err != nil {
+				util.HappoAgentLogger().Errorf("statsd flush failed: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Handle aggregates lines in packet. returns number of invalid lines
+func (s *StatsdServer) Handle(packet []byte) int {
+	log := util.HappoAgentLogger()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invalid := 0
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+			continue // DogStatsD events and service checks are not supported
+		}
+		sample, err := parseStatsdLine(line)
+		if err == nil {
+			err = s.add(sample)
+		}
+		if err != nil {
+			log.Debugf("invalid statsd line: %q: %s", line, err.Error())
+			invalid++
+		}
+	}
+	return invalid
+}
+
+// add aggregates sample. caller must hold lock
+func (s *StatsdServer) add(sample statsdSample) error {
+	key := tagsKey(sample.tags)
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &statsdBucket{
+			tags:     sample.tags,
+			counters: map[string]float64{},
+			gauges:   map[string]float64{},
+			timers:   map[string][]float64{},
+			sets:     map[string]map[string]bool{},
+
+			timerCounts:  map[string]float64{},
+			counterNames: map[string]bool{},
+			gaugeIdle:    map[string]int{},
+		}
+	}
+
+	switch sample.metricType {
+	case "s":
+		if bucket.sets[sample.name] == nil {
+			bucket.sets[sample.name] = map[string]bool{}
+		}
+		bucket.sets[sample.name][sample.value] = true
+	case "g":
+		value, err := strconv.ParseFloat(sample.value, 64)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(sample.value, "+") || strings.HasPrefix(sample.value, "-") {
+			value += bucket.gauges[sample.name] // relative
+		}
+		bucket.gauges[sample.name] = value
+		bucket.gaugeIdle[sample.name] = 0
+	case "c", "ms", "h", "d":
+		value, err := strconv.ParseFloat(sample.value, 64)
+		if err != nil {
+			return err
+		}
+		if sample.metricType == "c" {
+			bucket.counters[sample.name] += value / sample.rate
+			bucket.counterNames[sample.name] = true
+		} else {
+			bucket.timers[sample.name] = append(bucket.timers[sample.name], value)
+			bucket.timerCounts[sample.name] += 1 / sample.rate
+		}
+	default:
+		return fmt.Errorf("unknown type: %s", sample.metricType)
+	}
+	bucket.idle = 0
+	s.buckets[key] = bucket
+	return nil
+}
+
+// Flush saves aggregates of current interval to metric buffer, and resets counters, timers and sets
+func (s *StatsdServer) Flush(now time.Time) error {
+	s.mu.Lock()
+	var metricsData []halib.MetricsData
+	for key, bucket := range s.buckets {
+		if bucket.idle >= halib.StatsdExpireIntervals {
+			delete(s.buckets, key)
+			continue
+		}
+		metrics := bucket.flush(s.FlushInterval)
+		if len(metrics) == 0 {
+			continue
+		}
+		metricsData = append(metricsData, halib.MetricsData{HostName: s.HostName, Timestamp: now.Unix(), Metrics: metrics, Tags: bucket.tags})
+	}
+	s.mu.Unlock()
+
+	if len(metricsData) == 0 {
+		return nil
+	}
+	return SaveMetrics(now, metricsData)
+}
+
+func (b *statsdBucket) flush(interval time.Duration) map[string]float64 {
+	metrics := map[string]float64{}
+	for name, count := range b.counters {
+		metrics[name+".count"] = count
+		metrics[name+".rate"] = count / interval.Seconds()
+	}
+	for name, value := range b.gauges {
+		if b.gaugeIdle[name] >= halib.StatsdExpireIntervals {
+			delete(b.gauges, name)
+			delete(b.gaugeIdle, name)
+			continue
+		}
+		metrics[name] = value
+		b.gaugeIdle[name]++
+	}
+	for name, values := range b.sets {
+		metrics[name] = float64(len(values))
+	}
+	for name, values := range b.timers {
+		prefix := name
+		if b.counterNames[name] {
+			prefix = name + ".timer" // not to overwrite <name>.count of counter
+		}
+		sort.Float64s(values)
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		metrics[prefix+".count"] = b.timerCounts[name]
+		metrics[prefix+".min"] = values[0]
+		metrics[prefix+".max"] = values[len(values)-1]
+		metrics[prefix+".mean"] = sum / float64(len(values))
+		metrics[prefix+".median"] = percentile(values, 50)
+		metrics[prefix+".p95"] = percentile(values, 95)
+		metrics[prefix+".sum"] = sum
+	}
+
+	b.counters = map[string]float64{}
+	b.timers = map[string][]float64{}
+	b.timerCounts = map[string]float64{}
+	b.sets = map[string]map[string]bool{}
+	b.idle++
+	return metrics
+}
+
+// percentile returns nearest rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// parseStatsdLine parses `<name>:<value>|<type>[|@<sample rate>][|#<tag>:<value>,...]`
+func parseStatsdLine(line string) (statsdSample, error) {
+	sample := statsdSample{rate: 1}
+	i := strings.LastIndex(strings.SplitN(line, "|", 2)[0], ":")
+	if i <= 0 {
+		return sample, errors.New("no value")
+	}
+	sample.name = statsdNameReplacer.Replace(line[:i])
+
+	items := strings.Split(line[i+1:], "|")
+	if len(items) < 2 || items[0] == "" {
+		return sample, errors.New("no type")
+	}
+	sample.value = items[0]
+	sample.metricType = items[1]
+	for _, item := range items[2:] {
+		switch {
+		case strings.HasPrefix(item, "@"):
+			rate, err := strconv.ParseFloat(item[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return sample, fmt.Errorf("invalid sample rate: %s", item)
+			}
+			sample.rate = rate
+		case strings.HasPrefix(item, "#"):
+			for _, tag := range strings.Split(item[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) == 1 {
+					kv = append(kv, "true")
+				}
+				if kv[0] == "hostname" {
+					continue // reserved
+				}
+				if sample.tags == nil {
+					sample.tags = map[string]string{}
+				}
+				sample.tags[kv[0]] = kv[1]
+			}
+		}
+	}
+	return sample, nil
+}
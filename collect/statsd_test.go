@@ -0,0 +1,173 @@
+package collect
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStatsdLine1(t *testing.T) {
+	sample, err := parseStatsdLine("app.requests:2|c|@0.5|#env:prod,canary")
+	assert.Nil(t, err)
+	assert.Equal(t, statsdSample{name: "app.requests", value: "2", metricType: "c", rate: 0.5,
+		tags: map[string]string{"env": "prod", "canary": "true"}}, sample)
+
+	sample, err = parseStatsdLine("app/queue size:-3|g")
+	assert.Nil(t, err)
+	assert.Equal(t, statsdSample{name: "app-queue_size", value: "-3", metricType: "g", rate: 1}, sample)
+
+	for _, line := range []string{"app.requests", "app.requests:1", ":1|c", "app.requests:1|c|@2"} {
+		_, err = parseStatsdLine(line)
+		assert.NotNil(t, err, line)
+	}
+}
+
+func TestStatsdServer1(t *testing.T) {
+	GetCollectedMetricsWithFilter(MetricFilter{}) // cleanup
+	defer GetCollectedMetricsWithFilter(MetricFilter{})
+
+	s := NewStatsdServer("statsd01", 10*time.Second)
+	invalid := s.Handle([]byte("app.requests:1|c\napp.requests:2|c|@0.5\n" +
+		"app.queue:10|g\napp.queue:-3|g\n" +
+		"app.latency:300|ms\napp.latency:100|ms\napp.latency:200|h\n" +
+		"app.users:alice|s\napp.users:bob|s\napp.users:alice|s\n" +
+		"app.requests:1|c|#env:prod\n" +
+		"_e{5,4}:title|text\nbroken\napp.x:1|z\n"))
+	assert.Equal(t, 2, invalid)
+
+	now := time.Unix(1505180700, 0)
+	assert.Nil(t, s.Flush(now))
+
+	result, err := GetCollectedMetricsWithFilter(MetricFilter{HostName: "statsd01"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(result.MetricData))
+	for _, metrics := range result.MetricData {
+		assert.Equal(t, now.Unix(), metrics.Timestamp)
+		if len(metrics.Tags) > 0 {
+			assert.Equal(t, map[string]string{"env": "prod"}, metrics.Tags)
+			assert.Equal(t, map[string]float64{"app.requests.count": 1, "app.requests.rate": 0.1}, metrics.Metrics)
+			continue
+		}
+		assert.Equal(t, map[string]float64{
+			"app.requests.count": 5, "app.requests.rate": 0.5,
+			"app.queue":         7,
+			"app.latency.count": 3, "app.latency.min": 100, "app.latency.max": 300, "app.latency.mean": 200,
+			"app.latency.median": 200, "app.latency.p95": 300, "app.latency.sum": 600,
+			"app.users": 2,
+		}, metrics.Metrics)
+	}
+
+	// counters, timers and sets are reset. gauges are kept
+	assert.Nil(t, s.Flush(now.Add(10*time.Second)))
+	result, err = GetCollectedMetricsWithFilter(MetricFilter{HostName: "statsd01"})
+	assert.Nil(t, err)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "statsd01", Timestamp: now.Unix() + 10, Metrics: map[string]float64{"app.queue": 7}},
+	}, result.MetricData)
+}
+
+func TestStatsdServer2(t *testing.T) {
+	GetCollectedMetricsWithFilter(MetricFilter{}) // cleanup
+	defer GetCollectedMetricsWithFilter(MetricFilter{})
+
+	// timer count is adjusted by sample rate, and does not overwrite counter of same name
+	s := NewStatsdServer("statsd03", 10*time.Second)
+	assert.Equal(t, 0, s.Handle([]byte("app.requests:3|c\napp.requests:100|ms|@0.5\napp.requests:200|ms|@0.5\n"+
+		"app.latency:100|ms|@0.1\n")))
+	now := time.Unix(1505180700, 0)
+	assert.Nil(t, s.Flush(now))
+
+	result, err := GetCollectedMetricsWithFilter(MetricFilter{HostName: "statsd03"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(result.MetricData))
+	assert.Equal(t, map[string]float64{
+		"app.requests.count": 3, "app.requests.rate": 0.3,
+		"app.requests.timer.count": 4, "app.requests.timer.min": 100, "app.requests.timer.max": 200,
+		"app.requests.timer.mean": 150, "app.requests.timer.median": 100, "app.requests.timer.p95": 200,
+		"app.requests.timer.sum": 300,
+		"app.latency.count":      10, "app.latency.min": 100, "app.latency.max": 100, "app.latency.mean": 100,
+		"app.latency.median": 100, "app.latency.p95": 100, "app.latency.sum": 100,
+	}, result.MetricData[0].Metrics)
+
+	// timer name is kept in next interval without counter
+	assert.Equal(t, 0, s.Handle([]byte("app.requests:100|ms\n")))
+	assert.Nil(t, s.Flush(now.Add(10*time.Second)))
+	result, err = GetCollectedMetricsWithFilter(MetricFilter{HostName: "statsd03"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(result.MetricData))
+	assert.Equal(t, float64(1), result.MetricData[0].Metrics["app.requests.timer.count"])
+	assert.NotContains(t, result.MetricData[0].Metrics, "app.requests.count")
+}
+
+func TestStatsdServer3(t *testing.T) {
+	GetCollectedMetricsWithFilter(MetricFilter{}) // cleanup
+	defer GetCollectedMetricsWithFilter(MetricFilter{})
+
+	// gauges and tags without samples are expired
+	s := NewStatsdServer("statsd04", 10*time.Second)
+	now := time.Unix(1505180700, 0)
+	assert.Equal(t, 0, s.Handle([]byte("app.old:1|g|#id:1\napp.old:1|g\napp.live:1|g\n")))
+	for i := 0; i < halib.StatsdExpireIntervals; i++ {
+		assert.Nil(t, s.Flush(now.Add(time.Duration(i)*10*time.Second)))
+		assert.Equal(t, 0, s.Handle([]byte("app.live:2|g\n")))
+	}
+	s.mu.Lock()
+	assert.Equal(t, 2, len(s.buckets))
+	s.mu.Unlock()
+	GetCollectedMetricsWithFilter(MetricFilter{}) // cleanup
+
+	assert.Nil(t, s.Flush(now.Add(halib.StatsdExpireIntervals*10*time.Second)))
+	result, err := GetCollectedMetricsWithFilter(MetricFilter{HostName: "statsd04"})
+	assert.Nil(t, err)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "statsd04", Timestamp: now.Unix() + halib.StatsdExpireIntervals*10, Metrics: map[string]float64{"app.live": 2}},
+	}, result.MetricData)
+	s.mu.Lock()
+	assert.Equal(t, 1, len(s.buckets))
+	assert.Equal(t, map[string]float64{"app.live": 2}, s.buckets[""].gauges)
+	s.mu.Unlock()
+}
+
+func TestStatsdServerServe1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "happo-agent-statsd")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewStatsdServer("statsd02", 0)
+	assert.Equal(t, halib.DefaultMetricIntervalSeconds*time.Second, s.FlushInterval)
+
+	socket := filepath.Join(dir, "statsd.sock")
+	assert.Nil(t, ioutil.WriteFile(socket, []byte{}, 0644)) // stale
+	for n, listen := range [][]string{{"udp", "127.0.0.1:0"}, {"unixgram", socket}} {
+		conn, err := s.Listen(listen[0], listen[1])
+		assert.Nil(t, err, listen[0])
+		go s.Serve(conn)
+
+		client, err := net.Dial(listen[0], conn.LocalAddr().String())
+		assert.Nil(t, err)
+		_, err = client.Write([]byte("app.packets:1|c"))
+		assert.Nil(t, err)
+		client.Close()
+
+		for i := 0; i < 100; i++ {
+			s.mu.Lock()
+			received := s.buckets[""] != nil && s.buckets[""].counters["app.packets"] > float64(n)
+			s.mu.Unlock()
+			if received {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		conn.Close()
+	}
+	s.mu.Lock()
+	assert.Equal(t, float64(2), s.buckets[""].counters["app.packets"])
+	s.mu.Unlock()
+}
@@ -22,7 +22,7 @@ func CmdAdd(c *cli.Context) error {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
-	resp, err := util.RequestToManageAPI(c.String("endpoint"), "/manage/add", data)
+	resp, err := util.RequestToManageAPI(c.String("endpoint"), "/manage/add", data, util.BindHTTPClientConfig(c))
 	if err != nil && resp == nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
@@ -28,12 +28,17 @@ import (
 
 // --- Struct
 type daemonListener struct {
-	Timeout        int //second
-	MaxConnections int
-	Port           string
-	Handler        http.Handler
-	PublicKey      string
-	PrivateKey     string
+	Timeout               int //second
+	MaxConnections        int
+	Port                  string
+	Handler               http.Handler
+	Certificates          *util.CertificateLoader
+	MinVersion            uint16
+	MaxVersion            uint16
+	CipherSuites          []uint16
+	CurvePreferences      []tls.CurveID
+	ClientCA              string
+	AllowedClientSubjects []string
 }
 
 // --- functions
@@ -72,6 +77,18 @@ func CmdDaemon(c *cli.Context) {
 	}
 
 	log.Out = fp
+	if !c.Bool("disable-collect-metrics") {
+		collect.ActiveMetricConfig = collect.NewMetricConfigLoader(c.String("metric-config"))
+	}
+	certificateFiles := []string{c.String("public-key"), c.String("private-key")}
+	if c.String("secondary-public-key") != "" {
+		certificateFiles = append(certificateFiles, c.String("secondary-public-key"), c.String("secondary-private-key"))
+	}
+	model.ListenerCertificates = util.NewCertificateLoader(certificateFiles...)
+	if err = model.ListenerCertificates.Reload(); err != nil {
+		log.Fatal(err)
+	}
+	go model.ListenerCertificates.Watch(nil, halib.DefaultCertificateWatchSeconds*time.Second)
 	sigHup := make(chan os.Signal, 1)
 	signal.Notify(sigHup, syscall.SIGHUP)
 	go func() {
@@ -79,6 +96,10 @@ func CmdDaemon(c *cli.Context) {
 			select {
 			case <-sigHup:
 				fp.Reopen()
+				if collect.ActiveMetricConfig != nil {
+					collect.ActiveMetricConfig.Reload()
+				}
+				model.ListenerCertificates.Reload()
 			}
 		}
 	}()
@@ -122,8 +143,27 @@ func CmdDaemon(c *cli.Context) {
 	defer db.Close()
 	db.MetricsMaxLifetimeSeconds = c.Int64("metrics-max-lifetime-seconds")
 	db.MachineStateMaxLifetimeSeconds = c.Int64("machine-state-max-lifetime-seconds")
+	db.MetricRollupsMaxLifetimeSeconds = c.Int64("metric-rollups-max-lifetime-seconds")
 
-	model.SetProxyTimeout(c.Int64("proxy-timeout-seconds"))
+	proxyClientConfig := util.HTTPClientConfig{
+		Fingerprints:        c.StringSlice("proxy-fingerprint"),
+		SkipHostnameVerify:  true,
+		InsecureSkipVerify:  c.Bool("proxy-insecure-skip-verify"),
+		Timeout:             time.Duration(c.Int64("proxy-timeout-seconds")) * time.Second,
+		IdleConnTimeout:     time.Duration(c.Int("proxy-idle-conn-timeout-seconds")) * time.Second,
+		MaxIdleConnsPerHost: c.Int("proxy-max-idle-conns-per-host"),
+	}
+	if c.String("client-ca") != "" {
+		// present own certificate to next happo-agent, and verify it by same CA
+		proxyClientConfig.CAFile = c.String("client-ca")
+		proxyClientConfig.CertFile = c.String("public-key")
+		proxyClientConfig.KeyFile = c.String("private-key")
+	}
+	proxyClient, err := util.NewHTTPClient(proxyClientConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	model.SetProxyHTTPClient(proxyClient)
 
 	model.AppVersion = c.App.Version
 	m.Get("/", func() string {
@@ -132,18 +172,52 @@ func CmdDaemon(c *cli.Context) {
 
 	util.CommandTimeout = time.Duration(c.Int("command-timeout"))
 	model.MetricConfigFile = c.String("metric-config")
+	collect.MetricConfigBackups = c.Int("metric-config-backups")
 
 	model.ErrorLogIntervalSeconds = c.Int64("error-log-interval-seconds")
 	model.NagiosPluginPaths = c.String("nagios-plugin-paths")
+	if c.String("inventory-config") != "" {
+		model.InventoryCollectors, err = model.LoadInventoryCollectors(c.String("inventory-config"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	model.EnableFreeFormInventory = c.Bool("enable-free-form-inventory")
+	if err = util.ValidateExecMode(c.String("exec-mode")); err != nil {
+		log.Fatal(err)
+	}
+	util.ExecMode = c.String("exec-mode")
+	if c.String("monitor-policy") != "" {
+		model.MonitorPolicyRules, err = model.LoadMonitorPolicy(c.String("monitor-policy"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	collect.SensuPluginPaths = c.String("sensu-plugin-paths")
+	model.PrometheusExposeCollectedMetrics = c.Bool("prometheus-expose-collected-metrics")
 
-	m.Post("/proxy", binding.Json(halib.ProxyRequest{}), model.Proxy)
-	m.Post("/inventory", binding.Json(halib.InventoryRequest{}), model.Inventory)
-	m.Post("/monitor", binding.Json(halib.MonitorRequest{}), model.Monitor)
-	m.Post("/metric", binding.Json(halib.MetricRequest{}), model.Metric)
-	m.Post("/metric/append", binding.Json(halib.MetricAppendRequest{}), model.MetricAppend)
-	m.Post("/metric/config/update", binding.Json(halib.MetricConfigUpdateRequest{}), model.MetricConfigUpdate)
+	apiKeyStore, err := util.LoadAPIKeyStore(c.String("api-key-file"), c.StringSlice("api-keys"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !apiKeyStore.Enabled() {
+		log.Warn("no api key defined. apikey check is disabled")
+	}
+	apiKeyHolder := (*halib.APIKeyHolder)(nil)
+
+	m.Post("/proxy", binding.Json(halib.ProxyRequest{}, apiKeyHolder), util.APIKeyAuth(apiKeyStore, ""), model.Proxy)
+	m.Post("/inventory", binding.Json(halib.InventoryRequest{}, apiKeyHolder), util.APIKeyAuth(apiKeyStore, halib.APIKeyScopeInventory), model.Inventory)
+	m.Post("/monitor", binding.Json(halib.MonitorRequest{}, apiKeyHolder), util.APIKeyAuth(apiKeyStore, halib.APIKeyScopeMonitor), model.Monitor)
+	m.Post("/metric", binding.Json(halib.MetricRequest{}, apiKeyHolder), util.APIKeyAuth(apiKeyStore, halib.APIKeyScopeMetric), model.Metric)
+	m.Post("/metric/ack", binding.Json(halib.MetricAckRequest{}, apiKeyHolder), util.APIKeyAuth(apiKeyStore, halib.APIKeyScopeMetric), model.MetricAck)
+	m.Post("/metric/append", binding.Json(halib.MetricAppendRequest{}, apiKeyHolder), util.APIKeyAuth(apiKeyStore, halib.APIKeyScopeMetric), model.MetricAppend)
+	m.Post("/metric/config/update", binding.Json(halib.MetricConfigUpdateRequest{}, apiKeyHolder), util.APIKeyAuth(apiKeyStore, halib.APIKeyScopeConfig), model.MetricConfigUpdate)
+	m.Post("/metric/config/rollback", binding.Json(halib.MetricConfigRollbackRequest{}, apiKeyHolder), util.APIKeyAuth(apiKeyStore, halib.APIKeyScopeConfig), model.MetricConfigRollback)
+	// POST is for /proxy
+	m.Get("/metric/config", binding.Json(halib.MetricConfigRequest{}, apiKeyHolder), util.APIKeyAuth(apiKeyStore, halib.APIKeyScopeConfig), model.MetricConfigGet)
+	m.Post("/metric/config", binding.Json(halib.MetricConfigRequest{}, apiKeyHolder), util.APIKeyAuth(apiKeyStore, halib.APIKeyScopeConfig), model.MetricConfigGet)
 	m.Get("/metric/status", model.MetricDataBufferStatus)
+	m.Get("/metrics", model.PrometheusMetrics)
 	m.Get("/status", model.Status)
 	m.Get("/status/memory", model.MemoryStatus)
 	if enableRequestStatusMiddlware {
@@ -163,9 +237,23 @@ func CmdDaemon(c *cli.Context) {
 	if lis.Timeout < c.Int("command-timeout") {
 		lis.Timeout = c.Int("command-timeout")
 	}
+	model.StreamWriteTimeout = time.Duration(lis.Timeout) * time.Second
 	lis.MaxConnections = c.Int("max-connections")
-	lis.PublicKey = c.String("public-key")
-	lis.PrivateKey = c.String("private-key")
+	lis.Certificates = model.ListenerCertificates
+	if lis.MinVersion, err = util.ParseTLSVersion(c.String("tls-min-version")); err != nil {
+		log.Fatal(err)
+	}
+	if lis.MaxVersion, err = util.ParseTLSVersion(c.String("tls-max-version")); err != nil {
+		log.Fatal(err)
+	}
+	if lis.CipherSuites, err = util.ParseCipherSuites(c.String("tls-cipher-suites")); err != nil {
+		log.Fatal(err)
+	}
+	if lis.CurvePreferences, err = util.ParseCurvePreferences(c.String("tls-curve-preferences")); err != nil {
+		log.Fatal(err)
+	}
+	lis.ClientCA = c.String("client-ca")
+	lis.AllowedClientSubjects = c.StringSlice("allowed-client-subjects")
 	go func() {
 		err := lis.listenAndServe()
 		if err != nil {
@@ -173,51 +261,124 @@ func CmdDaemon(c *cli.Context) {
 		}
 	}()
 
-	disableCollectMetrics := c.Bool("disable-collect-metrics")
-	util.HappoAgentLogger().Debug("disable-collect-metrics: ", disableCollectMetrics)
+	if c.String("push-endpoint") != "" {
+		shipper, err := collect.NewMetricShipper(c.String("push-endpoint"), c.String("push-api-key"), buildPushHTTPClientConfig(c))
+		if err != nil {
+			log.Fatal(err)
+		}
+		shipper.BatchSize = c.Int("push-batch-size")
+		shipper.Interval = time.Duration(c.Int("push-interval-seconds")) * time.Second
+		shipper.Timeout = time.Duration(c.Int("push-timeout-seconds")) * time.Second
+		shipper.MaxBackoff = time.Duration(c.Int("push-max-backoff-seconds")) * time.Second
+		go shipper.Run(nil)
+	}
 
-	// Metric collect timer
-	timeMetrics := time.NewTicker(time.Minute).C
-	for {
-		select {
-		case <-timeMetrics:
-			if !disableCollectMetrics {
-				err := collect.Metrics(c.String("metric-config"))
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
+	collect.MetricRollupAfterSeconds = c.Int64("metric-rollup-after-seconds")
+	collect.MetricRollupSeconds = c.Int64("metric-rollup-seconds")
+	if collect.MetricRollupAfterSeconds > 0 {
+		if collect.MetricRollupSeconds <= 0 {
+			log.Fatal("metric-rollup-seconds must be positive")
 		}
+		if collect.MetricRollupAfterSeconds >= db.MetricsMaxLifetimeSeconds {
+			log.Warn("metric-rollup-after-seconds is longer than metrics-max-lifetime-seconds. metrics are retired before rollup")
+		}
+		go collect.RunMetricRollup(nil, time.Duration(collect.MetricRollupSeconds)*time.Second)
 	}
-}
 
-// HTTPS Listener
-func (l *daemonListener) listenAndServe() error {
-	var err error
+	if c.String("graphite-address") != "" {
+		collect.GraphiteOutput, err = collect.NewGraphiteForwarder(c.String("graphite-address"), c.String("graphite-prefix-template"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go collect.GraphiteOutput.Run(nil)
+	}
 
-	cert := make([]tls.Certificate, 1)
-	cert[0], err = tls.LoadX509KeyPair(l.PublicKey, l.PrivateKey)
+	if c.String("statsd-address") != "" || c.String("statsd-socket") != "" {
+		hostname := c.String("statsd-hostname")
+		if hostname == "" {
+			hostname, err = os.Hostname()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		statsd := collect.NewStatsdServer(hostname, time.Duration(c.Int("statsd-flush-interval-seconds"))*time.Second)
+		for network, address := range map[string]string{"udp": c.String("statsd-address"), "unixgram": c.String("statsd-socket")} {
+			if address == "" {
+				continue
+			}
+			conn, err := statsd.Listen(network, address)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go statsd.Serve(conn)
+		}
+		go statsd.Run(nil)
+	}
+
+	model.MetricGraphiteFormat, err = collect.NewGraphiteFormat(c.String("graphite-prefix-template"))
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
+	model.MetricInfluxFormat.MeasurementDepth = c.Int("influx-measurement-depth")
 
+	disableCollectMetrics := c.Bool("disable-collect-metrics")
+	util.HappoAgentLogger().Debug("disable-collect-metrics: ", disableCollectMetrics)
+
+	if disableCollectMetrics {
+		select {}
+	}
+	// on error, metric collection starts when config is fixed
+	collect.ActiveMetricConfig.Reload()
+	go collect.ActiveMetricConfig.Watch(nil, halib.DefaultMetricConfigWatchSeconds*time.Second)
+	scheduler := collect.NewMetricScheduler(collect.ActiveMetricConfig, c.Int("metric-workers"))
+	scheduler.Run(nil)
+}
+
+// buildPushHTTPClientConfig returns client config for push endpoint. unlike /proxy, endpoint hostname is verified
+func buildPushHTTPClientConfig(c *cli.Context) util.HTTPClientConfig {
+	clientConfig := util.HTTPClientConfig{
+		CAFile:             c.String("push-ca-file"),
+		Fingerprints:       c.StringSlice("push-fingerprint"),
+		InsecureSkipVerify: c.Bool("push-insecure-skip-verify"),
+		UseProxyEnv:        true,
+	}
+	if c.String("client-ca") != "" {
+		// same as /proxy, present own certificate
+		clientConfig.CertFile = c.String("public-key")
+		clientConfig.KeyFile = c.String("private-key")
+	}
+	return clientConfig
+}
+
+// HTTPS Listener
+func (l *daemonListener) listenAndServe() error {
+	// keypairs are served by GetCertificate, to be reloaded without restart
 	tlsConfig := &tls.Config{
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			// tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-		},
+		GetCertificate:           l.Certificates.GetCertificate,
+		CipherSuites:             l.CipherSuites,
+		CurvePreferences:         l.CurvePreferences,
 		PreferServerCipherSuites: true,
-		MinVersion:               tls.VersionTLS12,
+		MinVersion:               l.MinVersion,
+		MaxVersion:               l.MaxVersion,
 		NextProtos:               []string{"http/1.1"},
-		Certificates:             cert,
+	}
+
+	if l.ClientCA != "" {
+		clientCAs, err := util.LoadCertPool(l.ClientCA)
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.VerifyPeerCertificate = util.VerifyPeerCertificate(nil, l.AllowedClientSubjects)
 	}
 
 	listener, err := net.Listen("tcp", l.Port)
 	if err != nil {
 		return err
 	}
-	limitListener := netutil.LimitListener(listener, l.MaxConnections)
+	// streaming responses (/metric, /proxy) extend write deadline by util.ExtendWriteDeadline
+	limitListener := netutil.LimitListener(&util.WriteDeadlineListener{Listener: listener}, l.MaxConnections)
 	tlsListener := tls.NewListener(limitListener, tlsConfig)
 
 	httpConfig := &http.Server{
@@ -7,6 +7,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/heartbeatsjp/happo-agent/collect"
@@ -19,7 +21,6 @@ func CmdAppendMetric(c *cli.Context) error {
 	var err error
 
 	hostname := c.String("hostname")
-	bastionEndoint := c.String("bastion-endpoint")
 	datafileArg := c.String("datafile")
 	dryRun := c.Bool("dry-run")
 
@@ -34,45 +35,194 @@ func CmdAppendMetric(c *cli.Context) error {
 		}
 	}
 
-	var metricsDataSlice []halib.MetricsData
 	read, err := ioutil.ReadAll(f)
 	if err != nil {
 		return err
 	}
-	metricData, timestamp, err := collect.ParseMetricData(string(read))
+	metricsDataSlice, err := collect.ParseMetricInput(c.String("format"), read, hostname, time.Now())
 	if err != nil {
 		return err
 	}
 
-	var m halib.MetricsData
-	m.HostName = hostname
-	m.Timestamp = timestamp
-	m.Metrics = metricData
-	metricsDataSlice = append(metricsDataSlice, m)
-
+	spool := metricSpoolFromContext(c)
 	if dryRun {
+		if spool != nil {
+			err = printMetricSpool(spool)
+			if err != nil {
+				return err
+			}
+		}
 		fmt.Println(metricsDataSlice)
 		return nil
 	}
 
-	var metricAppendRequest halib.MetricAppendRequest
+	send, err := metricAppendSender(c)
+	if err != nil {
+		return err
+	}
+	if spool == nil {
+		err = send(metricsDataSlice)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Success.")
+		return nil
+	}
+
+	// replay spooled metrics first, to keep order. when replay failed, current metrics are spooled without attempt.
+	// while other process is replaying, current metrics are sent without waiting for it
+	entry := &metricSpoolEntry{SpooledAt: time.Now().Unix(), MetricData: metricsDataSlice}
+	err = replayMetricSpool(spool, send)
+	if err == nil || err == errMetricSpoolLocked {
+		err = send(metricsDataSlice)
+		if err == nil {
+			fmt.Println("Success.")
+			return nil
+		}
+		entry.Attempts = 1
+		entry.LastError = err.Error()
+		if isPermanentSendError(err) {
+			buryErr := spool.Bury(entry)
+			if buryErr != nil {
+				return fmt.Errorf("%s (and failed to spool: %s)", err.Error(), buryErr.Error())
+			}
+			return fmt.Errorf("%s (moved to %s)", err.Error(), filepath.Join(spool.Dir, metricSpoolDeadDir, entry.name))
+		}
+	}
+	putErr := spool.Put(entry)
+	if putErr != nil {
+		return fmt.Errorf("%s (and failed to spool: %s)", err.Error(), putErr.Error())
+	}
+	fmt.Printf("Spooled. (%s)\n", err.Error())
+	return nil
+}
 
-	metricAppendRequest.APIKey = c.String("api-key")
-	metricAppendRequest.MetricData = metricsDataSlice
+//CmdFlushMetric is action of subcommand flush_metric
+func CmdFlushMetric(c *cli.Context) error {
+	spool := metricSpoolFromContext(c)
+	if spool == nil {
+		return errors.New("--spool-dir is required")
+	}
+	if c.Bool("dry-run") {
+		return printMetricSpool(spool)
+	}
 
-	data, err := json.Marshal(metricAppendRequest)
+	send, err := metricAppendSender(c)
 	if err != nil {
 		return err
 	}
+	err = replayMetricSpool(spool, send)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Success.")
+	return nil
+}
 
-	resp, err := util.RequestToMetricAppendAPI(bastionEndoint, data)
-	if err != nil && resp == nil {
+var errMetricSpoolLocked = errors.New("spool is locked by other process")
+
+// metricAppendStatusError is error response of /metric/append
+type metricAppendStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *metricAppendStatusError) Error() string {
+	return e.Status
+}
+
+// isPermanentSendError returns whether metrics are rejected, and retry does not help (4xx except 408 and 429)
+func isPermanentSendError(err error) bool {
+	statusErr, ok := err.(*metricAppendStatusError)
+	if !ok {
+		return false
+	}
+	if statusErr.StatusCode == http.StatusRequestTimeout || statusErr.StatusCode == http.StatusTooManyRequests {
+		return false
+	}
+	return statusErr.StatusCode >= 400 && statusErr.StatusCode < 500
+}
+
+// metricSpoolFromContext returns metricSpool of --spool-dir. nil when spool is disabled
+func metricSpoolFromContext(c *cli.Context) *metricSpool {
+	if c.String("spool-dir") == "" {
+		return nil
+	}
+	return &metricSpool{
+		Dir:         c.String("spool-dir"),
+		MaxAttempts: c.Int("spool-max-attempts"),
+		MaxAge:      time.Duration(c.Int("spool-max-age-seconds")) * time.Second,
+	}
+}
+
+// metricAppendSender returns function which posts metrics to /metric/append of bastion
+func metricAppendSender(c *cli.Context) (func([]halib.MetricsData) error, error) {
+	// bastion is called by ip address
+	clientConfig := util.BindHTTPClientConfig(c)
+	clientConfig.SkipHostnameVerify = true
+	client, err := util.NewHTTPClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	bastionEndoint := c.String("bastion-endpoint")
+	apiKey := c.String("api-key")
+
+	return func(metricsDataSlice []halib.MetricsData) error {
+		var metricAppendRequest halib.MetricAppendRequest
+
+		metricAppendRequest.APIKey = apiKey
+		metricAppendRequest.MetricData = metricsDataSlice
+
+		data, err := json.Marshal(metricAppendRequest)
+		if err != nil {
+			return err
+		}
+
+		resp, err := util.RequestToMetricAppendAPI(client, bastionEndoint, data)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return &metricAppendStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		return nil
+	}, nil
+}
+
+// replayMetricSpool replays spooled metrics under lock
+func replayMetricSpool(spool *metricSpool, send func([]halib.MetricsData) error) error {
+	locked, unlock, err := spool.Lock()
+	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return errors.New(resp.Status)
+	if !locked {
+		return errMetricSpoolLocked
 	}
-	fmt.Println("Success.")
+	defer unlock()
 
+	sent, expired, dead, err := spool.Replay(time.Now(), send)
+	if sent > 0 || expired > 0 || dead > 0 {
+		fmt.Printf("Replayed %d spooled metrics (expired: %d, rejected: %d).\n", sent, expired, dead)
+	}
+	return err
+}
+
+// printMetricSpool prints spooled metrics to be replayed (dry run)
+func printMetricSpool(spool *metricSpool) error {
+	entries, err := spool.Entries()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		action := "replay"
+		if spool.Expired(entry, now) {
+			action = "expire"
+		}
+		fmt.Printf("%s %s (spooled_at: %s, attempts: %d, last_error: %s)\n", action, entry.name,
+			time.Unix(entry.SpooledAt, 0).Format(time.RFC3339), entry.Attempts, entry.LastError)
+		fmt.Println(entry.MetricData)
+	}
 	return nil
 }
@@ -0,0 +1,173 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// --- Struct
+
+// metricSpool is directory of metrics which append_metric failed to send. spooled metrics are replayed in order of spooled time
+type metricSpool struct {
+	Dir         string
+	MaxAttempts int
+	MaxAge      time.Duration
+}
+
+// metricSpoolEntry is spool file `<unixnano>-<pid>.json`
+type metricSpoolEntry struct {
+	SpooledAt  int64               `json:"spooled_at"`
+	Attempts   int                 `json:"attempts"`
+	LastError  string              `json:"last_error,omitempty"`
+	MetricData []halib.MetricsData `json:"metric_data"`
+
+	name string
+}
+
+// metricSpoolDeadDir is subdirectory of entries rejected permanently by bastion. they are kept for investigation, but not replayed
+const metricSpoolDeadDir = "dead"
+
+// --- Method
+
+// Put saves entry atomically (temporary file and rename)
+func (s *metricSpool) Put(entry *metricSpoolEntry) error {
+	if entry.name == "" {
+		entry.name = fmt.Sprintf("%019d-%d.json", time.Now().UnixNano(), os.Getpid())
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.Dir, entry.name))
+}
+
+// Entries returns spooled entries in order of spooled time. broken files are skipped
+func (s *metricSpool) Entries() ([]*metricSpoolEntry, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := []string{}
+	for _, file := range files {
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), ".") && strings.HasSuffix(file.Name(), ".json") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	entries := []*metricSpoolEntry{}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(s.Dir, name))
+		if err != nil {
+			return nil, err
+		}
+		entry := &metricSpoolEntry{name: name}
+		err = json.Unmarshal(data, entry)
+		if err != nil {
+			util.HappoAgentLogger().Warnf("broken spool file %s: %s", name, err.Error())
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Expired returns whether entry is older than MaxAge, or reached MaxAttempts
+func (s *metricSpool) Expired(entry *metricSpoolEntry, now time.Time) bool {
+	if s.MaxAttempts > 0 && entry.Attempts >= s.MaxAttempts {
+		return true
+	}
+	return s.MaxAge > 0 && now.Sub(time.Unix(entry.SpooledAt, 0)) > s.MaxAge
+}
+
+// Bury moves entry to dead-letter directory. entry which is not spooled yet is just saved there
+func (s *metricSpool) Bury(entry *metricSpoolEntry) error {
+	dead := &metricSpool{Dir: filepath.Join(s.Dir, metricSpoolDeadDir)}
+	err := os.MkdirAll(dead.Dir, 0700)
+	if err != nil {
+		return err
+	}
+	err = dead.Put(entry)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(s.Dir, entry.name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Replay sends spooled entries in order, and removes sent or expired entries. permanently rejected entries are moved to dead-letter directory.
+// stops at other failure to keep order, and returns the error after counting the attempt
+func (s *metricSpool) Replay(now time.Time, send func([]halib.MetricsData) error) (int, int, int, error) {
+	log := util.HappoAgentLogger()
+	entries, err := s.Entries()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	sent, expired, dead := 0, 0, 0
+	for _, entry := range entries {
+		if s.Expired(entry, now) {
+			log.Warnf("spooled metrics %s expired (attempts: %d, last error: %s)", entry.name, entry.Attempts, entry.LastError)
+			os.Remove(filepath.Join(s.Dir, entry.name))
+			expired++
+			continue
+		}
+		err = send(entry.MetricData)
+		if err != nil {
+			entry.Attempts++
+			entry.LastError = err.Error()
+			if isPermanentSendError(err) {
+				log.Warnf("spooled metrics %s rejected, moved to %s (attempts: %d, last error: %s)", entry.name, metricSpoolDeadDir, entry.Attempts, entry.LastError)
+				if buryErr := s.Bury(entry); buryErr != nil {
+					log.Errorf("failed to move spool file %s: %s", entry.name, buryErr.Error())
+					return sent, expired, dead, err
+				}
+				dead++
+				continue
+			}
+			if putErr := s.Put(entry); putErr != nil {
+				log.Errorf("failed to update spool file %s: %s", entry.name, putErr.Error())
+			}
+			return sent, expired, dead, err
+		}
+		os.Remove(filepath.Join(s.Dir, entry.name))
+		sent++
+	}
+	return sent, expired, dead, nil
+}
+
+// Lock takes lock of spool directory, to prevent concurrent replay. returns false when other process holds it
+func (s *metricSpool) Lock() (bool, func(), error) {
+	err := os.MkdirAll(s.Dir, 0700)
+	if err != nil {
+		return false, nil, err
+	}
+	return lockMetricSpool(filepath.Join(s.Dir, ".lock"))
+}
@@ -0,0 +1,28 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockMetricSpool takes flock of path. lock is released by unlock, or by kernel when process exits,
+// so lock of killed process does not remain. lock file itself is not removed
+func lockMetricSpool(path string) (bool, func(), error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return false, nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return false, nil, nil
+		}
+		return false, nil, err
+	}
+	// pid of holder, for investigation
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	return true, func() { f.Close() }, nil
+}
@@ -0,0 +1,41 @@
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockMetricSpool1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".lock")
+	old := time.Now().Add(-time.Hour)
+
+	// lock file left by killed process does not block
+	assert.Nil(t, ioutil.WriteFile(path, []byte("99999\n"), 0600))
+	assert.Nil(t, os.Chtimes(path, old, old))
+	locked, unlock, err := lockMetricSpool(path)
+	assert.Nil(t, err)
+	assert.True(t, locked)
+
+	// lock held by long replay is not taken, however old lock file is
+	assert.Nil(t, os.Chtimes(path, old, old))
+	locked, _, err = lockMetricSpool(path)
+	assert.Nil(t, err)
+	assert.False(t, locked)
+
+	// lock file is kept, and lock is taken again after unlock
+	unlock()
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+	locked, unlock, err = lockMetricSpool(path)
+	assert.Nil(t, err)
+	assert.True(t, locked)
+	unlock()
+}
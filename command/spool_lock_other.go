@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// lockMetricSpool creates path exclusively. lock of killed process remains until path is removed by hand
+func lockMetricSpool(path string) (bool, func(), error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil, nil
+		}
+		return false, nil, err
+	}
+	pid := fmt.Sprintf("%d\n", os.Getpid())
+	fmt.Fprint(f, pid)
+	f.Close()
+	return true, func() {
+		// do not remove lock of other process
+		if b, err := ioutil.ReadFile(path); err == nil && strings.TrimSpace(string(b)) == strings.TrimSpace(pid) {
+			os.Remove(path)
+		}
+	}, nil
+}
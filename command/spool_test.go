@@ -0,0 +1,155 @@
+package command
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricSpool1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	spool := &metricSpool{Dir: dir, MaxAttempts: 3, MaxAge: time.Hour}
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, spool.Put(&metricSpoolEntry{
+			SpooledAt:  now.Unix(),
+			MetricData: []halib.MetricsData{{HostName: "web01", Timestamp: int64(i), Metrics: map[string]float64{"a": float64(i)}}},
+		}))
+	}
+	entries, err := spool.Entries()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+
+	// stops at first failure, and counts attempt
+	sent := []int64{}
+	failAt := int64(1)
+	send := func(metricsData []halib.MetricsData) error {
+		if metricsData[0].Timestamp == failAt {
+			return errors.New("503 Service Unavailable")
+		}
+		sent = append(sent, metricsData[0].Timestamp)
+		return nil
+	}
+	n, expired, dead, err := spool.Replay(now, send)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 0, expired)
+	assert.Equal(t, 0, dead)
+	assert.Equal(t, []int64{0}, sent)
+	entries, _ = spool.Entries()
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, 1, entries[0].Attempts)
+	assert.Equal(t, "503 Service Unavailable", entries[0].LastError)
+
+	// replayed in order
+	failAt = -1
+	n, expired, dead, err = spool.Replay(now, send)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 0, expired)
+	assert.Equal(t, 0, dead)
+	assert.Equal(t, []int64{0, 1, 2}, sent)
+	entries, _ = spool.Entries()
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestMetricSpool2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	spool := &metricSpool{Dir: dir, MaxAttempts: 3, MaxAge: time.Hour}
+	assert.Nil(t, spool.Put(&metricSpoolEntry{SpooledAt: now.Add(-2 * time.Hour).Unix()}))
+	assert.Nil(t, spool.Put(&metricSpoolEntry{SpooledAt: now.Unix(), Attempts: 3}))
+	assert.Nil(t, spool.Put(&metricSpoolEntry{SpooledAt: now.Unix(), Attempts: 2}))
+	ioutil.WriteFile(filepath.Join(dir, "0-0.json"), []byte("broken"), 0600)
+
+	n, expired, dead, err := spool.Replay(now, func([]halib.MetricsData) error { return nil })
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, expired)
+	assert.Equal(t, 0, dead)
+
+	// lock
+	locked, unlock, err := spool.Lock()
+	assert.Nil(t, err)
+	assert.True(t, locked)
+	locked, _, err = spool.Lock()
+	assert.Nil(t, err)
+	assert.False(t, locked)
+	unlock()
+	locked, unlock, err = spool.Lock()
+	assert.Nil(t, err)
+	assert.True(t, locked)
+	unlock()
+}
+
+func TestMetricSpool3(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	spool := &metricSpool{Dir: dir, MaxAttempts: 3, MaxAge: time.Hour}
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, spool.Put(&metricSpoolEntry{
+			SpooledAt:  now.Unix(),
+			MetricData: []halib.MetricsData{{HostName: "web01", Timestamp: int64(i), Metrics: map[string]float64{"a": float64(i)}}},
+		}))
+	}
+
+	// permanently rejected entry is moved to dead-letter directory, and does not block later entries
+	sent := []int64{}
+	send := func(metricsData []halib.MetricsData) error {
+		switch metricsData[0].Timestamp {
+		case 1:
+			return &metricAppendStatusError{StatusCode: 400, Status: "400 Bad Request"}
+		case 3:
+			return &metricAppendStatusError{StatusCode: 429, Status: "429 Too Many Requests"}
+		}
+		sent = append(sent, metricsData[0].Timestamp)
+		return nil
+	}
+	n, expired, dead, err := spool.Replay(now, send)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 0, expired)
+	assert.Equal(t, 1, dead)
+	assert.Equal(t, []int64{0, 2}, sent)
+	entries, _ := spool.Entries()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, int64(3), entries[0].MetricData[0].Timestamp)
+	assert.Equal(t, 1, entries[0].Attempts)
+
+	deadSpool := &metricSpool{Dir: filepath.Join(dir, metricSpoolDeadDir)}
+	entries, _ = deadSpool.Entries()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, int64(1), entries[0].MetricData[0].Timestamp)
+	assert.Equal(t, "400 Bad Request", entries[0].LastError)
+
+	// entry which is not spooled yet
+	assert.Nil(t, spool.Bury(&metricSpoolEntry{SpooledAt: now.Unix(), Attempts: 1, LastError: "403 Forbidden"}))
+	entries, _ = deadSpool.Entries()
+	assert.Equal(t, 2, len(entries))
+	entries, _ = spool.Entries()
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestIsPermanentSendError1(t *testing.T) {
+	assert.True(t, isPermanentSendError(&metricAppendStatusError{StatusCode: 400, Status: "400 Bad Request"}))
+	assert.True(t, isPermanentSendError(&metricAppendStatusError{StatusCode: 403, Status: "403 Forbidden"}))
+	assert.False(t, isPermanentSendError(&metricAppendStatusError{StatusCode: 408, Status: "408 Request Timeout"}))
+	assert.False(t, isPermanentSendError(&metricAppendStatusError{StatusCode: 429, Status: "429 Too Many Requests"}))
+	assert.False(t, isPermanentSendError(&metricAppendStatusError{StatusCode: 503, Status: "503 Service Unavailable"}))
+	assert.False(t, isPermanentSendError(errors.New("connection refused")))
+}
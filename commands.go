@@ -48,6 +48,42 @@ var daemonFlags = []cli.Flag{
 		Usage:  "TLS private key file path",
 		EnvVar: "HAPPO_AGENT_PRIVATE_KEY",
 	},
+	cli.StringFlag{
+		Name:   "secondary-public-key",
+		Value:  "",
+		Usage:  "Secondary TLS public key file path. (e.g. ECDSA certificate with RSA public-key. served to client which supports it)",
+		EnvVar: "HAPPO_AGENT_SECONDARY_PUBLIC_KEY",
+	},
+	cli.StringFlag{
+		Name:   "secondary-private-key",
+		Value:  "",
+		Usage:  "Secondary TLS private key file path.",
+		EnvVar: "HAPPO_AGENT_SECONDARY_PRIVATE_KEY",
+	},
+	cli.StringFlag{
+		Name:   "tls-min-version",
+		Value:  halib.DefaultTLSMinVersion,
+		Usage:  "Min TLS version of listener (1.0, 1.1, 1.2 or 1.3)",
+		EnvVar: "HAPPO_AGENT_TLS_MIN_VERSION",
+	},
+	cli.StringFlag{
+		Name:   "tls-max-version",
+		Value:  "",
+		Usage:  "Max TLS version of listener (1.0, 1.1, 1.2 or 1.3. when empty, latest supported version)",
+		EnvVar: "HAPPO_AGENT_TLS_MAX_VERSION",
+	},
+	cli.StringFlag{
+		Name:   "tls-cipher-suites",
+		Value:  halib.DefaultTLSCipherSuites,
+		Usage:  "Cipher suites of TLS 1.2 and older, with comma (TLS 1.3 cipher suites are not configurable)",
+		EnvVar: "HAPPO_AGENT_TLS_CIPHER_SUITES",
+	},
+	cli.StringFlag{
+		Name:   "tls-curve-preferences",
+		Value:  "",
+		Usage:  "Elliptic curves of ECDHE in preference order, with comma (X25519, P256, P384 or P521. when empty, default of Go)",
+		EnvVar: "HAPPO_AGENT_TLS_CURVE_PREFERENCES",
+	},
 	cli.StringFlag{
 		Name:   "metric-config, M",
 		Value:  halib.DefaultMetricsConfigPath,
@@ -90,6 +126,24 @@ var daemonFlags = []cli.Flag{
 		Usage:  "Metrics Max Lifetime Seconds.",
 		EnvVar: "HAPPO_AGENT_METRICS_MAX_LIFETIME_SECONDS",
 	},
+	cli.Int64Flag{
+		Name:   "metric-rollups-max-lifetime-seconds",
+		Value:  db.MetricRollupsMaxLifetimeSeconds,
+		Usage:  "Rolled up Metrics Max Lifetime Seconds.",
+		EnvVar: "HAPPO_AGENT_METRIC_ROLLUPS_MAX_LIFETIME_SECONDS",
+	},
+	cli.Int64Flag{
+		Name:   "metric-rollup-after-seconds",
+		Value:  0,
+		Usage:  "Roll up metrics older than this seconds to min/max/avg/last of --metric-rollup-seconds period. 0 means disabled",
+		EnvVar: "HAPPO_AGENT_METRIC_ROLLUP_AFTER_SECONDS",
+	},
+	cli.Int64Flag{
+		Name:   "metric-rollup-seconds",
+		Value:  halib.DefaultMetricRollupSeconds,
+		Usage:  "Period of rolled up metrics (e.g. 300 or 3600)",
+		EnvVar: "HAPPO_AGENT_METRIC_ROLLUP_SECONDS",
+	},
 	cli.Int64Flag{
 		Name:   "machine-state-max-lifetime-seconds",
 		Value:  db.MachineStateMaxLifetimeSeconds,
@@ -102,6 +156,29 @@ var daemonFlags = []cli.Flag{
 		Usage:  "/proxy timeout Seconds.",
 		EnvVar: "HAPPO_AGENT_PROXY_TIMEOUT_SECONDS",
 	},
+	cli.StringSliceFlag{
+		Name:   "proxy-fingerprint",
+		Value:  &cli.StringSlice{},
+		Usage:  "SHA-256 fingerprint of next happo-agent certificate accepted by /proxy (You can multiple define. when empty, certificate chain is verified by client-ca or system CA)",
+		EnvVar: "HAPPO_AGENT_PROXY_FINGERPRINT",
+	},
+	cli.BoolFlag{
+		Name:   "proxy-insecure-skip-verify",
+		Usage:  "Do not verify next happo-agent certificate of /proxy",
+		EnvVar: "HAPPO_AGENT_PROXY_INSECURE_SKIP_VERIFY",
+	},
+	cli.IntFlag{
+		Name:   "proxy-max-idle-conns-per-host",
+		Value:  halib.DefaultProxyMaxIdleConnsPerHost,
+		Usage:  "Max keep-alive connections to each next happo-agent of /proxy",
+		EnvVar: "HAPPO_AGENT_PROXY_MAX_IDLE_CONNS_PER_HOST",
+	},
+	cli.IntFlag{
+		Name:   "proxy-idle-conn-timeout-seconds",
+		Value:  halib.DefaultHTTPClientIdleConnTimeoutSeconds,
+		Usage:  "Keep-alive timeout seconds of idle connection of /proxy",
+		EnvVar: "HAPPO_AGENT_PROXY_IDLE_CONN_TIMEOUT_SECONDS",
+	},
 	cli.Int64Flag{
 		Name:   "error-log-interval-seconds",
 		Value:  halib.DefaultErrorLogIntervalSeconds,
@@ -130,6 +207,165 @@ var daemonFlags = []cli.Flag{
 		Usage:  "disable collect metrics ( if true, metrics.yaml has no meaning )",
 		EnvVar: "HAPPO_AGENT_DISABLE_COLLECT_METRICS",
 	},
+	cli.IntFlag{
+		Name:   "metric-config-backups",
+		Value:  halib.DefaultMetricConfigBackups,
+		Usage:  "Number of previous versions of metric config kept by /metric/config/update",
+		EnvVar: "HAPPO_AGENT_METRIC_CONFIG_BACKUPS",
+	},
+	cli.IntFlag{
+		Name:   "metric-workers",
+		Value:  halib.DefaultMetricWorkers,
+		Usage:  "Number of metric plugins executed in parallel",
+		EnvVar: "HAPPO_AGENT_METRIC_WORKERS",
+	},
+	cli.StringFlag{
+		Name:   "api-key-file",
+		Value:  "",
+		Usage:  "API key definition yaml file path",
+		EnvVar: "HAPPO_AGENT_API_KEY_FILE",
+	},
+	cli.StringSliceFlag{
+		Name:   "api-keys",
+		Value:  &cli.StringSlice{},
+		Usage:  "API key definition `<key>:<scope>[+<scope>...][:<expires_at(RFC3339)>]` (You can multiple define.)",
+		EnvVar: "HAPPO_AGENT_API_KEYS",
+	},
+	cli.StringFlag{
+		Name:   "client-ca",
+		Value:  "",
+		Usage:  "CA bundle file path. when set, require client certificate signed by it, and verify next happo-agent of /proxy by it",
+		EnvVar: "HAPPO_AGENT_CLIENT_CA",
+	},
+	cli.StringSliceFlag{
+		Name:   "allowed-client-subjects",
+		Value:  &cli.StringSlice{},
+		Usage:  "Allowed client certificate CommonName or SANs (You can multiple define. when empty, allow all certificates signed by client-ca)",
+		EnvVar: "HAPPO_AGENT_ALLOWED_CLIENT_SUBJECTS",
+	},
+	cli.StringFlag{
+		Name:   "monitor-policy",
+		Value:  "",
+		Usage:  "Permitted monitor plugins definition yaml file path (when empty, any plugin is permitted)",
+		EnvVar: "HAPPO_AGENT_MONITOR_POLICY",
+	},
+	cli.StringFlag{
+		Name:   "inventory-config",
+		Value:  "",
+		Usage:  "Inventory collectors definition yaml file path",
+		EnvVar: "HAPPO_AGENT_INVENTORY_CONFIG",
+	},
+	cli.BoolFlag{
+		Name:   "enable-free-form-inventory",
+		Usage:  "permit arbitrary command execution via /inventory (command, command_option)",
+		EnvVar: "HAPPO_AGENT_ENABLE_FREE_FORM_INVENTORY",
+	},
+	cli.StringFlag{
+		Name:   "exec-mode",
+		Value:  halib.ExecModeShell,
+		Usage:  "Default plugin execution mode. shell (/bin/sh -c) or direct (argv, without shell)",
+		EnvVar: "HAPPO_AGENT_EXEC_MODE",
+	},
+	cli.BoolFlag{
+		Name:   "prometheus-expose-collected-metrics",
+		Usage:  "expose latest value of collected metrics on /metrics (buffered metrics are not drained)",
+		EnvVar: "HAPPO_AGENT_PROMETHEUS_EXPOSE_COLLECTED_METRICS",
+	},
+	cli.StringFlag{
+		Name:   "push-endpoint",
+		Value:  "",
+		Usage:  "Push buffered metrics to this URL (e.g. https://bastion:6777/metric/append). when empty, push mode is disabled",
+		EnvVar: "HAPPO_AGENT_PUSH_ENDPOINT",
+	},
+	cli.StringFlag{
+		Name:   "push-api-key",
+		Value:  "",
+		Usage:  "API key of push endpoint",
+		EnvVar: "HAPPO_AGENT_PUSH_API_KEY",
+	},
+	cli.IntFlag{
+		Name:   "push-batch-size",
+		Value:  halib.DefaultMetricFetchLimit,
+		Usage:  "Max number of buffered collections per push request",
+		EnvVar: "HAPPO_AGENT_PUSH_BATCH_SIZE",
+	},
+	cli.IntFlag{
+		Name:   "push-interval-seconds",
+		Value:  halib.DefaultPushIntervalSeconds,
+		Usage:  "Push interval seconds",
+		EnvVar: "HAPPO_AGENT_PUSH_INTERVAL_SECONDS",
+	},
+	cli.IntFlag{
+		Name:   "push-timeout-seconds",
+		Value:  halib.DefaultPushTimeoutSeconds,
+		Usage:  "Push request timeout seconds",
+		EnvVar: "HAPPO_AGENT_PUSH_TIMEOUT_SECONDS",
+	},
+	cli.IntFlag{
+		Name:   "push-max-backoff-seconds",
+		Value:  halib.DefaultPushMaxBackoffSeconds,
+		Usage:  "Max retry interval seconds of push",
+		EnvVar: "HAPPO_AGENT_PUSH_MAX_BACKOFF_SECONDS",
+	},
+	cli.StringFlag{
+		Name:   "push-ca-file",
+		Value:  "",
+		Usage:  "CA bundle to verify push endpoint certificate (when empty, system CA is used)",
+		EnvVar: "HAPPO_AGENT_PUSH_CA_FILE",
+	},
+	cli.StringSliceFlag{
+		Name:   "push-fingerprint",
+		Value:  &cli.StringSlice{},
+		Usage:  "SHA-256 fingerprint of push endpoint certificate (You can multiple define. when set, push-ca-file and system CA are not used)",
+		EnvVar: "HAPPO_AGENT_PUSH_FINGERPRINT",
+	},
+	cli.BoolFlag{
+		Name:   "push-insecure-skip-verify",
+		Usage:  "Do not verify push endpoint certificate",
+		EnvVar: "HAPPO_AGENT_PUSH_INSECURE_SKIP_VERIFY",
+	},
+	cli.StringFlag{
+		Name:   "statsd-address",
+		Value:  "",
+		Usage:  "Listen StatsD (DogStatsD) metrics on UDP host:port (e.g. 127.0.0.1:8125). when empty, disabled",
+		EnvVar: "HAPPO_AGENT_STATSD_ADDRESS",
+	},
+	cli.StringFlag{
+		Name:   "statsd-socket",
+		Value:  "",
+		Usage:  "Listen StatsD (DogStatsD) metrics on unix datagram socket path. when empty, disabled",
+		EnvVar: "HAPPO_AGENT_STATSD_SOCKET",
+	},
+	cli.IntFlag{
+		Name:   "statsd-flush-interval-seconds",
+		Value:  halib.DefaultMetricIntervalSeconds,
+		Usage:  "Interval to save aggregated StatsD metrics",
+		EnvVar: "HAPPO_AGENT_STATSD_FLUSH_INTERVAL_SECONDS",
+	},
+	cli.StringFlag{
+		Name:   "statsd-hostname",
+		Value:  "",
+		Usage:  "Hostname of StatsD metrics. when empty, hostname of this host",
+		EnvVar: "HAPPO_AGENT_STATSD_HOSTNAME",
+	},
+	cli.StringFlag{
+		Name:   "graphite-address",
+		Value:  "",
+		Usage:  "Forward collected metrics to graphite(carbon) plaintext protocol host:port. when empty, disabled",
+		EnvVar: "HAPPO_AGENT_GRAPHITE_ADDRESS",
+	},
+	cli.StringFlag{
+		Name:   "graphite-prefix-template",
+		Value:  halib.DefaultGraphitePrefixTemplate,
+		Usage:  "Graphite metric path prefix (text/template. {{.HostName}}, escape, reverse are available)",
+		EnvVar: "HAPPO_AGENT_GRAPHITE_PREFIX_TEMPLATE",
+	},
+	cli.IntFlag{
+		Name:   "influx-measurement-depth",
+		Value:  0,
+		Usage:  "Number of metric name components used as InfluxDB measurement (0: all but last component)",
+		EnvVar: "HAPPO_AGENT_INFLUX_MEASUREMENT_DEPTH",
+	},
 }
 
 // Commands is list of subcommand
@@ -178,6 +414,29 @@ var Commands = []cli.Command{
 				Usage:  "API Endpoint address",
 				EnvVar: "HAPPO_AGENT_ENDPOINT",
 			},
+			cli.StringFlag{
+				Name:   "ca-file",
+				Value:  "",
+				Usage:  "CA bundle file path to verify API endpoint certificate (when empty, system CA is used)",
+				EnvVar: "HAPPO_AGENT_CA_FILE",
+			},
+			cli.StringSliceFlag{
+				Name:   "fingerprint",
+				Value:  &cli.StringSlice{},
+				Usage:  "SHA-256 fingerprint of API endpoint certificate to accept (You can multiple define. when set, ca-file is not used)",
+				EnvVar: "HAPPO_AGENT_FINGERPRINT",
+			},
+			cli.BoolFlag{
+				Name:   "insecure-skip-verify",
+				Usage:  "Do not verify API endpoint certificate",
+				EnvVar: "HAPPO_AGENT_INSECURE_SKIP_VERIFY",
+			},
+			cli.IntFlag{
+				Name:   "timeout-seconds",
+				Value:  halib.DefaultHTTPClientTimeoutSeconds,
+				Usage:  "Request timeout seconds",
+				EnvVar: "HAPPO_AGENT_TIMEOUT_SECONDS",
+			},
 		},
 	},
 	{
@@ -207,6 +466,29 @@ var Commands = []cli.Command{
 				Usage:  "API Endpoint address",
 				EnvVar: "HAPPO_AGENT_ENDPOINT",
 			},
+			cli.StringFlag{
+				Name:   "ca-file",
+				Value:  "",
+				Usage:  "CA bundle file path to verify API endpoint certificate (when empty, system CA is used)",
+				EnvVar: "HAPPO_AGENT_CA_FILE",
+			},
+			cli.StringSliceFlag{
+				Name:   "fingerprint",
+				Value:  &cli.StringSlice{},
+				Usage:  "SHA-256 fingerprint of API endpoint certificate to accept (You can multiple define. when set, ca-file is not used)",
+				EnvVar: "HAPPO_AGENT_FINGERPRINT",
+			},
+			cli.BoolFlag{
+				Name:   "insecure-skip-verify",
+				Usage:  "Do not verify API endpoint certificate",
+				EnvVar: "HAPPO_AGENT_INSECURE_SKIP_VERIFY",
+			},
+			cli.IntFlag{
+				Name:   "timeout-seconds",
+				Value:  halib.DefaultHTTPClientTimeoutSeconds,
+				Usage:  "Request timeout seconds",
+				EnvVar: "HAPPO_AGENT_TIMEOUT_SECONDS",
+			},
 		},
 	},
 	{
@@ -236,6 +518,29 @@ var Commands = []cli.Command{
 				Usage:  "API Endpoint address",
 				EnvVar: "HAPPO_AGENT_ENDPOINT",
 			},
+			cli.StringFlag{
+				Name:   "ca-file",
+				Value:  "",
+				Usage:  "CA bundle file path to verify API endpoint certificate (when empty, system CA is used)",
+				EnvVar: "HAPPO_AGENT_CA_FILE",
+			},
+			cli.StringSliceFlag{
+				Name:   "fingerprint",
+				Value:  &cli.StringSlice{},
+				Usage:  "SHA-256 fingerprint of API endpoint certificate to accept (You can multiple define. when set, ca-file is not used)",
+				EnvVar: "HAPPO_AGENT_FINGERPRINT",
+			},
+			cli.BoolFlag{
+				Name:   "insecure-skip-verify",
+				Usage:  "Do not verify API endpoint certificate",
+				EnvVar: "HAPPO_AGENT_INSECURE_SKIP_VERIFY",
+			},
+			cli.IntFlag{
+				Name:   "timeout-seconds",
+				Value:  halib.DefaultHTTPClientTimeoutSeconds,
+				Usage:  "Request timeout seconds",
+				EnvVar: "HAPPO_AGENT_TIMEOUT_SECONDS",
+			},
 		},
 	},
 	{
@@ -257,9 +562,15 @@ var Commands = []cli.Command{
 			cli.StringFlag{
 				Name:   "datafile",
 				Value:  "-",
-				Usage:  "sensu format datafile(default: - (stdin))",
+				Usage:  "metrics datafile(default: - (stdin))",
 				EnvVar: "HAPPO_AGENT_DATAFILE",
 			},
+			cli.StringFlag{
+				Name:   "format, f",
+				Value:  halib.MetricFormatSensu,
+				Usage:  "format of datafile (sensu, graphite, influx, json or prometheus)",
+				EnvVar: "HAPPO_AGENT_APPEND_METRIC_FORMAT",
+			},
 			cli.StringFlag{
 				Name:   "api-key, a",
 				Value:  "",
@@ -271,6 +582,136 @@ var Commands = []cli.Command{
 				Usage:  "dry run(NOT post to bastion)",
 				EnvVar: "HAPPO_AGENT_DRY_RUN",
 			},
+			cli.StringFlag{
+				Name:   "spool-dir",
+				Value:  "",
+				Usage:  "Spool directory of metrics failed to send. replayed by next append_metric or flush_metric (default: disabled)",
+				EnvVar: "HAPPO_AGENT_SPOOL_DIR",
+			},
+			cli.IntFlag{
+				Name:   "spool-max-attempts",
+				Value:  halib.DefaultSpoolMaxAttempts,
+				Usage:  "Spooled metrics are dropped after this number of failed attempts",
+				EnvVar: "HAPPO_AGENT_SPOOL_MAX_ATTEMPTS",
+			},
+			cli.IntFlag{
+				Name:   "spool-max-age-seconds",
+				Value:  halib.DefaultSpoolMaxAgeSeconds,
+				Usage:  "Spooled metrics older than this are dropped",
+				EnvVar: "HAPPO_AGENT_SPOOL_MAX_AGE_SECONDS",
+			},
+			cli.StringFlag{
+				Name:   "ca-file",
+				Value:  "",
+				Usage:  "CA bundle file path to verify bastion certificate (when empty, system CA is used)",
+				EnvVar: "HAPPO_AGENT_CA_FILE",
+			},
+			cli.StringFlag{
+				Name:   "cert-file",
+				Value:  "",
+				Usage:  "Client certificate file path",
+				EnvVar: "HAPPO_AGENT_CERT_FILE",
+			},
+			cli.StringFlag{
+				Name:   "key-file",
+				Value:  "",
+				Usage:  "Client certificate private key file path",
+				EnvVar: "HAPPO_AGENT_KEY_FILE",
+			},
+			cli.StringSliceFlag{
+				Name:   "fingerprint",
+				Value:  &cli.StringSlice{},
+				Usage:  "SHA-256 fingerprint of bastion certificate to accept (You can multiple define. when set, ca-file is not used)",
+				EnvVar: "HAPPO_AGENT_FINGERPRINT",
+			},
+			cli.BoolFlag{
+				Name:   "insecure-skip-verify",
+				Usage:  "Do not verify bastion certificate",
+				EnvVar: "HAPPO_AGENT_INSECURE_SKIP_VERIFY",
+			},
+			cli.IntFlag{
+				Name:   "timeout-seconds",
+				Value:  halib.DefaultHTTPClientTimeoutSeconds,
+				Usage:  "Request timeout seconds",
+				EnvVar: "HAPPO_AGENT_TIMEOUT_SECONDS",
+			},
+		},
+	},
+	{
+		Name:   "flush_metric",
+		Usage:  "Send metrics spooled by append_metric.",
+		Action: command.CmdFlushMetric,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "bastion-endpoint, b",
+				Value:  "https://127.0.0.1:6777",
+				Usage:  "Bastion (Nearby happo-agent) endpoint address",
+				EnvVar: "HAPPO_AGENT_BASTION_ENDPOINT",
+			},
+			cli.StringFlag{
+				Name:   "api-key, a",
+				Value:  "",
+				Usage:  "API Key",
+				EnvVar: "HAPPO_AGENT_API_KEY",
+			},
+			cli.BoolFlag{
+				Name:   "dry-run, n",
+				Usage:  "dry run(show spooled metrics, NOT post to bastion)",
+				EnvVar: "HAPPO_AGENT_DRY_RUN",
+			},
+			cli.StringFlag{
+				Name:   "spool-dir",
+				Value:  "",
+				Usage:  "Spool directory of append_metric",
+				EnvVar: "HAPPO_AGENT_SPOOL_DIR",
+			},
+			cli.IntFlag{
+				Name:   "spool-max-attempts",
+				Value:  halib.DefaultSpoolMaxAttempts,
+				Usage:  "Spooled metrics are dropped after this number of failed attempts",
+				EnvVar: "HAPPO_AGENT_SPOOL_MAX_ATTEMPTS",
+			},
+			cli.IntFlag{
+				Name:   "spool-max-age-seconds",
+				Value:  halib.DefaultSpoolMaxAgeSeconds,
+				Usage:  "Spooled metrics older than this are dropped",
+				EnvVar: "HAPPO_AGENT_SPOOL_MAX_AGE_SECONDS",
+			},
+			cli.StringFlag{
+				Name:   "ca-file",
+				Value:  "",
+				Usage:  "CA bundle file path to verify bastion certificate (when empty, system CA is used)",
+				EnvVar: "HAPPO_AGENT_CA_FILE",
+			},
+			cli.StringFlag{
+				Name:   "cert-file",
+				Value:  "",
+				Usage:  "Client certificate file path",
+				EnvVar: "HAPPO_AGENT_CERT_FILE",
+			},
+			cli.StringFlag{
+				Name:   "key-file",
+				Value:  "",
+				Usage:  "Client certificate private key file path",
+				EnvVar: "HAPPO_AGENT_KEY_FILE",
+			},
+			cli.StringSliceFlag{
+				Name:   "fingerprint",
+				Value:  &cli.StringSlice{},
+				Usage:  "SHA-256 fingerprint of bastion certificate to accept (You can multiple define. when set, ca-file is not used)",
+				EnvVar: "HAPPO_AGENT_FINGERPRINT",
+			},
+			cli.BoolFlag{
+				Name:   "insecure-skip-verify",
+				Usage:  "Do not verify bastion certificate",
+				EnvVar: "HAPPO_AGENT_INSECURE_SKIP_VERIFY",
+			},
+			cli.IntFlag{
+				Name:   "timeout-seconds",
+				Value:  halib.DefaultHTTPClientTimeoutSeconds,
+				Usage:  "Request timeout seconds",
+				EnvVar: "HAPPO_AGENT_TIMEOUT_SECONDS",
+			},
 		},
 	},
 }
@@ -10,13 +10,16 @@ var (
 	DB *leveldb.DB
 	// MetricsMaxLifetimeSeconds is as variable name
 	MetricsMaxLifetimeSeconds int64
+	// MetricRollupsMaxLifetimeSeconds is as variable name
+	MetricRollupsMaxLifetimeSeconds int64
 	// MachineStateMaxLifetimeSeconds is as variable name
 	MachineStateMaxLifetimeSeconds int64
 )
 
 func init() {
-	MetricsMaxLifetimeSeconds = 7 * 86400      //default is 7 days
-	MachineStateMaxLifetimeSeconds = 3 * 86400 //default is 3 days
+	MetricsMaxLifetimeSeconds = 7 * 86400        //default is 7 days
+	MetricRollupsMaxLifetimeSeconds = 30 * 86400 //default is 30 days
+	MachineStateMaxLifetimeSeconds = 3 * 86400   //default is 3 days
 }
 
 // Open open leveldb file
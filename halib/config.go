@@ -4,13 +4,41 @@ package halib
 
 // MetricConfig is struct of metric collection config yaml file
 type MetricConfig struct {
-	Metrics []struct {
-		Hostname string `yaml:"hostname" json:"Hostname"`
-		Plugins  []struct {
-			PluginName   string `yaml:"plugin_name" json:"Plugin_Name"`
-			PluginOption string `yaml:"plugin_option" json:"Plugin_Option"`
-		} `yaml:"plugins" json:"Plugins"`
-	} `yaml:"metrics" json:"Metrics"`
+	Metrics []MetricHostConfig `yaml:"metrics" json:"Metrics"`
+}
+
+// MetricHostConfig is metric collection config of each host
+type MetricHostConfig struct {
+	Hostname string               `yaml:"hostname" json:"Hostname"`
+	Plugins  []MetricPluginConfig `yaml:"plugins" json:"Plugins"`
+}
+
+// MetricPluginConfig is metric collection config of each plugin
+type MetricPluginConfig struct {
+	PluginName   string `yaml:"plugin_name" json:"Plugin_Name"`
+	PluginOption string `yaml:"plugin_option" json:"Plugin_Option"`
+	ExecMode     string `yaml:"exec_mode,omitempty" json:"Exec_Mode,omitempty"`
+	Interval     int    `yaml:"interval,omitempty" json:"Interval,omitempty"` // seconds. when 0, DefaultMetricIntervalSeconds
+	Timeout      int    `yaml:"timeout,omitempty" json:"Timeout,omitempty"`   // seconds. when 0, --command-timeout
+
+	Include []string             `yaml:"include,omitempty" json:"Include,omitempty"` // glob or /regexp/ of metric name. when empty, all metrics
+	Exclude []string             `yaml:"exclude,omitempty" json:"Exclude,omitempty"` // glob or /regexp/ of metric name
+	Rename  []MetricRenameConfig `yaml:"rename,omitempty" json:"Rename,omitempty"`   // first matched rule is applied
+	Prefix  string               `yaml:"prefix,omitempty" json:"Prefix,omitempty"`   // text/template with {{.HostName}}, {{.PluginName}}, escape and reverse
+	Tags    map[string]string    `yaml:"tags,omitempty" json:"Tags,omitempty"`
+	Types   []MetricTypeConfig   `yaml:"types,omitempty" json:"Types,omitempty"` // first matched rule is applied. when no rule matched, gauge
+}
+
+// MetricTypeConfig declares type (gauge or counter) of metrics. Pattern is glob or /regexp/ of metric name
+type MetricTypeConfig struct {
+	Pattern string `yaml:"pattern" json:"Pattern"`
+	Type    string `yaml:"type" json:"Type"`
+}
+
+// MetricRenameConfig is rename rule of metric name. Replace can refer submatch of Pattern (regexp) as $1
+type MetricRenameConfig struct {
+	Pattern string `yaml:"pattern" json:"Pattern"`
+	Replace string `yaml:"replace" json:"Replace"`
 }
 
 // CrawlConfigAgent is struct of actual crawl operation
@@ -22,3 +50,40 @@ type CrawlConfigAgent struct {
 	Proxies   []string `yaml:"proxies" json:"proxies"`
 	Disabled  bool     `yaml:"disabled,omitempty" json:"disabled,omitempty"`
 }
+
+// APIKeyConfig is struct of api key file yaml
+type APIKeyConfig struct {
+	APIKeys []struct {
+		Key       string   `yaml:"key"`
+		Scopes    []string `yaml:"scopes"`
+		ExpiresAt string   `yaml:"expires_at"`
+	} `yaml:"api_keys"`
+}
+
+// MonitorPolicyConfig is struct of monitor plugin policy yaml file
+type MonitorPolicyConfig struct {
+	Plugins []struct {
+		PluginName     string   `yaml:"plugin_name"`
+		OptionPatterns []string `yaml:"option_patterns"`
+		OptionTemplate string   `yaml:"option_template"`
+		ExecMode       string   `yaml:"exec_mode"`
+	} `yaml:"plugins"`
+}
+
+// InventoryConfig is struct of inventory collector definition yaml file
+type InventoryConfig struct {
+	Collectors []struct {
+		Name           string `yaml:"name"`
+		Command        string `yaml:"command"`
+		CommandOption  string `yaml:"command_option"`
+		MaxOutputBytes int    `yaml:"max_output_bytes"`
+		ExecMode       string `yaml:"exec_mode"`
+		Parameters     []struct {
+			Name    string   `yaml:"name"`
+			Type    string   `yaml:"type"`
+			Pattern string   `yaml:"pattern"`
+			Values  []string `yaml:"values"`
+			Default *string  `yaml:"default"`
+		} `yaml:"parameters"`
+	} `yaml:"collectors"`
+}
@@ -24,6 +24,12 @@ const CommandKillAfterSeconds = 3
 // DefaultCommandTimeout command execution timeout(monitor, metric)
 const DefaultCommandTimeout = 10
 
+// ExecModeShell is exec mode which execute command via `/bin/sh -c`
+const ExecModeShell = "shell"
+
+// ExecModeDirect is exec mode which execute command directly (option is split with shell word rules)
+const ExecModeDirect = "direct"
+
 // DefaultErrorLogIntervalSeconds when monitor error(not MonitorOK), and ErrorLogIntervalSeconds past from previous error, save sate snapshot. when >0, disable error log collection
 const DefaultErrorLogIntervalSeconds = -1
 
@@ -33,6 +39,18 @@ const DefaultTLSPrivateKey = "./happo-agent.key"
 // DefaultTLSPublicKey default TLS public key file path
 const DefaultTLSPublicKey = "./happo-agent.pub"
 
+// DefaultTLSMinVersion is default min TLS version of listener
+const DefaultTLSMinVersion = "1.2"
+
+// DefaultTLSCipherSuites is default cipher suites (TLS 1.2 and older) of listener
+const DefaultTLSCipherSuites = "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"
+
+// DefaultCertificateWatchSeconds is interval to check modification of listener certificates
+const DefaultCertificateWatchSeconds = 60
+
+// DefaultInventoryMaxOutputBytes is default max output size of inventory collector
+const DefaultInventoryMaxOutputBytes = 1024 * 1024
+
 // for monitor
 
 // MonitorOK is exit code OK (see also nagios plugin specification)
@@ -57,3 +75,150 @@ const DefaultSensuPluginPaths = "/usr/local/hb-agent/bin,/usr/local/bin"
 
 // DefaultMetricsConfigPath is default metric collection config path
 const DefaultMetricsConfigPath = "./metrics.yaml"
+
+// DefaultMetricLeaseSeconds is default lease period of /metric with lease. unacked metrics become visible again after that
+const DefaultMetricLeaseSeconds = 300
+
+// DefaultMetricFetchLimit is default max number of collections returned by /metric. scheduler saves a collection every DefaultMetricIntervalSeconds (60 times = 1hour)
+const DefaultMetricFetchLimit = 60
+
+// DefaultPushIntervalSeconds is default interval of push mode metric shipping
+const DefaultPushIntervalSeconds = 60
+
+// DefaultPushTimeoutSeconds is default request timeout of push mode metric shipping
+const DefaultPushTimeoutSeconds = 30
+
+// DefaultPushInitialBackoffSeconds is first retry interval of push mode metric shipping
+const DefaultPushInitialBackoffSeconds = 5
+
+// DefaultPushMaxBackoffSeconds is max retry interval of push mode metric shipping
+const DefaultPushMaxBackoffSeconds = 600
+
+// DefaultHTTPClientTimeoutSeconds is default request timeout of subcommands (append_metric, add, ...)
+const DefaultHTTPClientTimeoutSeconds = 30
+
+// DefaultHTTPClientDialTimeoutSeconds is connect timeout (and TCP keep-alive period) of outbound http client
+const DefaultHTTPClientDialTimeoutSeconds = 30
+
+// DefaultHTTPClientTLSHandshakeTimeoutSeconds is TLS handshake timeout of outbound http client
+const DefaultHTTPClientTLSHandshakeTimeoutSeconds = 10
+
+// DefaultHTTPClientIdleConnTimeoutSeconds is keep-alive timeout of idle connection of outbound http client
+const DefaultHTTPClientIdleConnTimeoutSeconds = 90
+
+// DefaultProxyMaxIdleConnsPerHost is default max keep-alive connections to each next happo-agent of /proxy
+const DefaultProxyMaxIdleConnsPerHost = 16
+
+// DefaultSpoolMaxAttempts is default max send attempts of metrics spooled by append_metric
+const DefaultSpoolMaxAttempts = 100
+
+// DefaultSpoolMaxAgeSeconds is default lifetime of metrics spooled by append_metric (1day)
+const DefaultSpoolMaxAgeSeconds = 86400
+
+// DefaultGraphitePrefixTemplate is default metric path prefix of graphite output
+const DefaultGraphitePrefixTemplate = "happo.{{escape .HostName}}"
+
+// DefaultGraphiteTimeoutSeconds is default connect/write timeout of graphite output
+const DefaultGraphiteTimeoutSeconds = 10
+
+// DefaultMetricIntervalSeconds is default interval of each metric plugin
+const DefaultMetricIntervalSeconds = 60
+
+// DefaultMetricConfigWatchSeconds is interval to check modification of metrics.yaml
+const DefaultMetricConfigWatchSeconds = 5
+
+// DefaultMetricConfigBackups is default number of previous versions of metrics.yaml
+const DefaultMetricConfigBackups = 5
+
+// DefaultMetricRollupSeconds is default period of rolled up metrics
+const DefaultMetricRollupSeconds = 300
+
+// DefaultMetricWorkers is default number of metric plugins executed in parallel
+const DefaultMetricWorkers = 4
+
+// MetricPluginOutcome* are results of metric plugin execution
+const (
+	MetricPluginOutcomeOK       = "ok"
+	MetricPluginOutcomeNotFound = "not_found"
+	MetricPluginOutcomeTimeout  = "timeout"
+	MetricPluginOutcomeFailed   = "failed" // exit status is not 0
+	MetricPluginOutcomeError    = "error"
+)
+
+// MetricType* are types of metric in `types` of metrics.yaml
+const (
+	MetricTypeGauge   = "gauge"
+	MetricTypeCounter = "counter" // monotonically increasing. converted to per second rate
+)
+
+// MetricCounterStaleIntervals is max age of previous counter sample, in plugin intervals. older sample is not used for rate
+const MetricCounterStaleIntervals = 3
+
+// MetricCounterWrapMaxRateRatio is max ratio of rate over wraparound to previous rate. larger decrease is regarded as counter reset
+const MetricCounterWrapMaxRateRatio = 4
+
+// MetricPluginStderrMaxBytes is max length of stderr kept in metric plugin status
+const MetricPluginStderrMaxBytes = 1024
+
+// StatsdMaxPacketBytes is max size of StatsD packet
+const StatsdMaxPacketBytes = 65535
+
+// StatsdExpireIntervals is number of flush intervals without samples, after which gauges and tags are forgotten
+const StatsdExpireIntervals = 5
+
+// NativeMetricPluginName is reserved plugin name of metrics.yaml. runs in-process collectors instead of sensu plugin
+const NativeMetricPluginName = "happo-agent-native"
+
+// MetricSelfCheckPluginName is reserved plugin name of /monitor. checks consecutive failures of metric plugins
+const MetricSelfCheckPluginName = "happo-agent-metric-plugins"
+
+// DefaultMetricSelfCheckWarningFailures is default consecutive failures of metric plugin to be warning
+const DefaultMetricSelfCheckWarningFailures = 3
+
+// DefaultMetricSelfCheckCriticalFailures is default consecutive failures of metric plugin to be critical
+const DefaultMetricSelfCheckCriticalFailures = 5
+
+// MetricStreamFlushLines is number of lines to flush in /metric streaming
+const MetricStreamFlushLines = 100
+
+// ContentTypeNDJSON is content type of newline delimited JSON
+const ContentTypeNDJSON = "application/x-ndjson"
+
+// ContentTypeInfluxLineProtocol is content type of InfluxDB line protocol
+const ContentTypeInfluxLineProtocol = "text/x-influxdb-line-protocol"
+
+// ContentTypeGraphite is content type of graphite plaintext protocol
+const ContentTypeGraphite = "text/x-graphite"
+
+// MetricFormat* are output formats of /metric, and input formats of /metric/append (except ndjson, which is json)
+const (
+	MetricFormatJSON       = "json"
+	MetricFormatNDJSON     = "ndjson"
+	MetricFormatInflux     = "influx"
+	MetricFormatGraphite   = "graphite"
+	MetricFormatSensu      = "sensu"      // input only
+	MetricFormatPrometheus = "prometheus" // input only
+)
+
+// HeaderMetricLeaseID is header of lease id in /metric streaming
+const HeaderMetricLeaseID = "X-Happo-Lease-Id"
+
+// HeaderMetricHasMore is trailer of has_more in /metric streaming
+const HeaderMetricHasMore = "X-Happo-Has-More"
+
+// HeaderMetricNextCursor is trailer of next_cursor in /metric streaming
+const HeaderMetricNextCursor = "X-Happo-Next-Cursor"
+
+// for api key
+
+// APIKeyScopeMonitor is api key scope for /monitor
+const APIKeyScopeMonitor = "monitor"
+
+// APIKeyScopeMetric is api key scope for /metric, /metric/ack, /metric/append
+const APIKeyScopeMetric = "metric"
+
+// APIKeyScopeInventory is api key scope for /inventory
+const APIKeyScopeInventory = "inventory"
+
+// APIKeyScopeConfig is api key scope for /metric/config/update
+const APIKeyScopeConfig = "config"
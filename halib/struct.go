@@ -7,6 +7,19 @@ type MetricsData struct {
 	HostName  string             `json:"hostname"`
 	Timestamp int64              `json:"timestamp"`
 	Metrics   map[string]float64 `json:"metrics"`
+	Tags      map[string]string  `json:"tags,omitempty"`
+	// Aggregated is set when metrics are rolled up. then Timestamp is start of period and Metrics are average
+	Aggregated *MetricsAggregate `json:"aggregated,omitempty"`
+}
+
+// MetricsAggregate is summary of rolled up metrics
+type MetricsAggregate struct {
+	Seconds       int64              `json:"seconds"` // length of period
+	Count         map[string]int64   `json:"count"`
+	Min           map[string]float64 `json:"min"`
+	Max           map[string]float64 `json:"max"`
+	Last          map[string]float64 `json:"last"`
+	LastTimestamp int64              `json:"last_timestamp"`
 }
 
 // InventoryData is actual inventory
@@ -22,13 +35,24 @@ type InventoryData struct {
 
 // --- Request Parameter
 
+// APIKeyHolder is implemented by request parameters which carry apikey
+type APIKeyHolder interface {
+	GetAPIKey() string
+}
+
 // ProxyRequest is /proxy API
 type ProxyRequest struct {
+	APIKey        string   `json:"apikey,omitempty"`
 	ProxyHostPort []string `json:"proxy_hostport"`
 	RequestType   string   `json:"request_type"`
 	RequestJSON   []byte   `json:"request_json"`
 }
 
+// GetAPIKey implements APIKeyHolder
+func (r ProxyRequest) GetAPIKey() string {
+	return r.APIKey
+}
+
 // MonitorRequest is /monitor API
 type MonitorRequest struct {
 	APIKey       string `json:"apikey"`
@@ -36,15 +60,55 @@ type MonitorRequest struct {
 	PluginOption string `json:"plugin_option"`
 }
 
+// GetAPIKey implements APIKeyHolder
+func (r MonitorRequest) GetAPIKey() string {
+	return r.APIKey
+}
+
 // MetricRequest is /metric API
 type MetricRequest struct {
-	APIKey string `json:"apikey"`
+	APIKey       string `json:"apikey"`
+	Lease        bool   `json:"lease"`         // when true, metrics are not deleted until /metric/ack
+	LeaseSeconds int    `json:"lease_seconds"` // when <= 0, DefaultMetricLeaseSeconds
+	From         int64  `json:"from"`          // unix time
+	To           int64  `json:"to"`            // unix time
+	Hostname     string `json:"hostname"`      // glob
+	MetricPrefix string `json:"metric_prefix"`
+	Limit        int    `json:"limit"` // when <= 0, DefaultMetricFetchLimit
+	Cursor       string `json:"cursor"`
+	Stream       bool   `json:"stream"` // when true, returns NDJSON (one MetricsData per line)
+	Format       string `json:"format"` // json, ndjson, influx or graphite. when empty, decided by Accept header
+}
+
+// GetAPIKey implements APIKeyHolder
+func (r MetricRequest) GetAPIKey() string {
+	return r.APIKey
+}
+
+// MetricAckRequest is /metric/ack API
+type MetricAckRequest struct {
+	APIKey  string `json:"apikey"`
+	LeaseID string `json:"lease_id" binding:"required"`
+}
+
+// GetAPIKey implements APIKeyHolder
+func (r MetricAckRequest) GetAPIKey() string {
+	return r.APIKey
 }
 
 // MetricAppendRequest is /metric/append API
 type MetricAppendRequest struct {
 	APIKey     string        `json:"apikey"`
 	MetricData []MetricsData `json:"metric_data"`
+	// Data is raw metrics in Format (default sensu). parsed and appended to MetricData. HostName is default hostname of Data
+	Format   string `json:"format,omitempty"`
+	Data     string `json:"data,omitempty"`
+	HostName string `json:"hostname,omitempty"`
+}
+
+// GetAPIKey implements APIKeyHolder
+func (r MetricAppendRequest) GetAPIKey() string {
+	return r.APIKey
 }
 
 // MetricConfigUpdateRequest is /metric/config/update API
@@ -53,11 +117,44 @@ type MetricConfigUpdateRequest struct {
 	Config MetricConfig `json:"config"`
 }
 
+// GetAPIKey implements APIKeyHolder
+func (r MetricConfigUpdateRequest) GetAPIKey() string {
+	return r.APIKey
+}
+
+// MetricConfigRequest is /metric/config API
+type MetricConfigRequest struct {
+	APIKey string `json:"apikey"`
+}
+
+// GetAPIKey implements APIKeyHolder
+func (r MetricConfigRequest) GetAPIKey() string {
+	return r.APIKey
+}
+
+// MetricConfigRollbackRequest is /metric/config/rollback API
+type MetricConfigRollbackRequest struct {
+	APIKey  string `json:"apikey"`
+	Version string `json:"version"` // when empty, newest backup
+}
+
+// GetAPIKey implements APIKeyHolder
+func (r MetricConfigRollbackRequest) GetAPIKey() string {
+	return r.APIKey
+}
+
 // InventoryRequest is /inventory API
 type InventoryRequest struct {
-	APIKey        string `json:"apikey"`
-	Command       string `json:"command"`
-	CommandOption string `json:"command_option"`
+	APIKey        string            `json:"apikey"`
+	Name          string            `json:"name"`
+	Parameters    map[string]string `json:"parameters"`
+	Command       string            `json:"command"`
+	CommandOption string            `json:"command_option"`
+}
+
+// GetAPIKey implements APIKeyHolder
+func (r InventoryRequest) GetAPIKey() string {
+	return r.APIKey
 }
 
 // ManageRequest is Manage API
@@ -66,8 +163,19 @@ type ManageRequest struct {
 	Hostdata CrawlConfigAgent `json:"hostdata"`
 }
 
+// GetAPIKey implements APIKeyHolder
+func (r ManageRequest) GetAPIKey() string {
+	return r.APIKey
+}
+
 // --- Response Parameter
 
+// ErrorResponse is common error response
+type ErrorResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
 // MonitorResponse is /monitor API
 type MonitorResponse struct {
 	ReturnValue int    `json:"return_value"`
@@ -78,6 +186,16 @@ type MonitorResponse struct {
 type MetricResponse struct {
 	MetricData []MetricsData `json:"metric_data"`
 	Message    string        `json:"message"`
+	LeaseID    string        `json:"lease_id,omitempty"`
+	HasMore    bool          `json:"has_more"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// MetricAckResponse is /metric/ack API
+type MetricAckResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Deleted int    `json:"deleted"`
 }
 
 // MetricAppendResponse is /metric/append API
@@ -86,16 +204,27 @@ type MetricAppendResponse struct {
 	Message string `json:"message"`
 }
 
-// MetricConfigUpdateResponse is /metric/config/update API
+// MetricConfigUpdateResponse is /metric/config/update and /metric/config/rollback API
 type MetricConfigUpdateResponse struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
+	Status  string   `json:"status"`
+	Message string   `json:"message"`
+	Diff    []string `json:"diff,omitempty"`
+	Version string   `json:"version,omitempty"` // restored version (rollback only)
+}
+
+// MetricConfigResponse is /metric/config API
+type MetricConfigResponse struct {
+	Status   string       `json:"status"`
+	Message  string       `json:"message"`
+	Config   MetricConfig `json:"config"`
+	Versions []string     `json:"versions"` // backup versions, newest first
 }
 
 // InventoryResponse is /inventory API
 type InventoryResponse struct {
 	ReturnCode  int    `json:"return_code"`
 	ReturnValue string `json:"return_value"`
+	Truncated   bool   `json:"truncated,omitempty"`
 }
 
 // ManageResponse is Manage API
@@ -106,12 +235,51 @@ type ManageResponse struct {
 
 // StatusResponse is /status API
 type StatusResponse struct {
-	AppVersion         string            `json:"app_version"`
-	UptimeSeconds      int64             `json:"uptime_seconds"`
-	NumGoroutine       int               `json:"num_goroutine"`
-	MetricBufferStatus map[string]int64  `json:"metric_buffer_status"`
-	Callers            []string          `json:"callers"`
-	LevelDBProperties  map[string]string `json:"leveldb_properties"`
+	AppVersion         string               `json:"app_version"`
+	UptimeSeconds      int64                `json:"uptime_seconds"`
+	NumGoroutine       int                  `json:"num_goroutine"`
+	MetricBufferStatus map[string]int64     `json:"metric_buffer_status"`
+	Callers            []string             `json:"callers"`
+	LevelDBProperties  map[string]string    `json:"leveldb_properties"`
+	MetricPlugins      []MetricPluginStatus `json:"metric_plugins"`
+	MetricConfig       *MetricConfigStatus  `json:"metric_config,omitempty"`
+	Certificates       []CertificateStatus  `json:"certificates,omitempty"`
+}
+
+// CertificateStatus is load status of listener certificate
+type CertificateStatus struct {
+	Path        string `json:"path"`
+	Subject     string `json:"subject"`
+	KeyType     string `json:"key_type"`             // RSA or ECDSA
+	NotAfter    int64  `json:"not_after"`            // unix time of expiry
+	LoadedAt    int64  `json:"loaded_at"`            // unix time of last successful load
+	LastError   string `json:"last_error,omitempty"` // why last reload failed. cleared by successful reload
+	LastErrorAt int64  `json:"last_error_at,omitempty"`
+}
+
+// MetricConfigStatus is load status of metrics.yaml
+type MetricConfigStatus struct {
+	Path        string `json:"path"`
+	LoadedAt    int64  `json:"loaded_at"` // unix time of last successful load. 0 means not loaded
+	Plugins     int    `json:"plugins"`
+	LastError   string `json:"last_error,omitempty"` // why last reload failed. cleared by successful reload
+	LastErrorAt int64  `json:"last_error_at,omitempty"`
+}
+
+// MetricPluginStatus is last execution result of metric plugin
+type MetricPluginStatus struct {
+	Hostname        string  `json:"hostname"`
+	PluginName      string  `json:"plugin_name"`
+	PluginOption    string  `json:"plugin_option"`
+	IntervalSeconds int     `json:"interval_seconds"`
+	LastRunAt       int64   `json:"last_run_at"` // unix time. 0 means not executed yet
+	DurationSeconds float64 `json:"duration_seconds"`
+	Outcome         string  `json:"outcome"`
+	Message         string  `json:"message,omitempty"`
+	Stderr          string  `json:"stderr,omitempty"`
+	NextRunAt       int64   `json:"next_run_at"` // unix time
+
+	ConsecutiveFailures int `json:"consecutive_failures"`
 }
 
 // RequestStatusResponse is /status/request API
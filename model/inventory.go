@@ -1,28 +1,212 @@
 package model
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/codegangsta/martini-contrib/render"
 	"github.com/go-martini/martini"
 	"github.com/heartbeatsjp/happo-agent/halib"
 	"github.com/heartbeatsjp/happo-agent/util"
+
+	"gopkg.in/yaml.v2"
 )
 
 // --- Constant Values
 
+var inventoryParameterPlaceholderPattern = regexp.MustCompile(`\$([A-Za-z0-9_]+)\$`)
+
+// --- Struct
+
+// InventoryCollector is named inventory command definition
+type InventoryCollector struct {
+	Name           string
+	Command        string
+	CommandOption  string
+	MaxOutputBytes int
+	ExecMode       string
+	Parameters     []InventoryCollectorParameter
+}
+
+// InventoryCollectorParameter is typed parameter of InventoryCollector
+type InventoryCollectorParameter struct {
+	Name    string
+	Type    string // string, int, enum
+	Pattern *regexp.Regexp
+	Values  []string
+	Default *string
+}
+
+// --- Package Variables
+
+var (
+	// InventoryCollectors is named inventory collectors. key is name
+	InventoryCollectors = map[string]InventoryCollector{}
+	// EnableFreeFormInventory permits execution of arbitrary command via /inventory
+	EnableFreeFormInventory = false
+)
+
 // --- Method
 
+// LoadInventoryCollectors loads inventory collector definitions from yaml file
+func LoadInventoryCollectors(configFile string) (map[string]InventoryCollector, error) {
+	var config halib.InventoryConfig
+
+	buf, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(buf, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	collectors := map[string]InventoryCollector{}
+	for _, c := range config.Collectors {
+		if c.Name == "" || c.Command == "" {
+			return nil, fmt.Errorf("name and command are required: %q", c.Name)
+		}
+		if _, ok := collectors[c.Name]; ok {
+			return nil, fmt.Errorf("duplicated collector name: %s", c.Name)
+		}
+		if err := util.ValidateExecMode(c.ExecMode); err != nil {
+			return nil, fmt.Errorf("%s: %s", c.Name, err.Error())
+		}
+		collector := InventoryCollector{
+			Name:           c.Name,
+			Command:        c.Command,
+			CommandOption:  c.CommandOption,
+			MaxOutputBytes: c.MaxOutputBytes,
+			ExecMode:       c.ExecMode,
+		}
+		if collector.MaxOutputBytes <= 0 {
+			collector.MaxOutputBytes = halib.DefaultInventoryMaxOutputBytes
+		}
+		for _, p := range c.Parameters {
+			parameter := InventoryCollectorParameter{
+				Name:    p.Name,
+				Type:    p.Type,
+				Values:  p.Values,
+				Default: p.Default,
+			}
+			switch parameter.Type {
+			case "":
+				parameter.Type = "string"
+				fallthrough
+			case "string":
+				parameter.Pattern = templateArgumentPattern
+				if p.Pattern != "" {
+					parameter.Pattern, err = regexp.Compile(fmt.Sprintf("^(?:%s)$", p.Pattern))
+					if err != nil {
+						return nil, fmt.Errorf("%s.%s: %s", c.Name, p.Name, err.Error())
+					}
+				}
+			case "int":
+			case "enum":
+				if len(p.Values) == 0 {
+					return nil, fmt.Errorf("%s.%s: enum requires values", c.Name, p.Name)
+				}
+			default:
+				return nil, fmt.Errorf("%s.%s: unknown type %s", c.Name, p.Name, p.Type)
+			}
+			collector.Parameters = append(collector.Parameters, parameter)
+		}
+		collectors[c.Name] = collector
+	}
+
+	return collectors, nil
+}
+
+// BuildCommandOption validates parameters and returns command option which $name$ is replaced by parameter
+func (c InventoryCollector) BuildCommandOption(parameters map[string]string) (string, error) {
+	values := map[string]string{}
+	for _, p := range c.Parameters {
+		value, ok := parameters[p.Name]
+		if !ok {
+			if p.Default == nil {
+				return "", fmt.Errorf("parameter %s is required", p.Name)
+			}
+			value = *p.Default
+		} else if err := p.validate(value); err != nil {
+			return "", err
+		}
+		values[p.Name] = value
+	}
+	for name := range parameters {
+		if _, ok := values[name]; !ok {
+			return "", fmt.Errorf("unknown parameter: %s", name)
+		}
+	}
+
+	return inventoryParameterPlaceholderPattern.ReplaceAllStringFunc(c.CommandOption, func(placeholder string) string {
+		name := strings.Trim(placeholder, "$")
+		if value, ok := values[name]; ok {
+			return value
+		}
+		return placeholder
+	}), nil
+}
+
+func (p InventoryCollectorParameter) validate(value string) error {
+	switch p.Type {
+	case "int":
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("parameter %s must be int", p.Name)
+		}
+	case "enum":
+		for _, v := range p.Values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("parameter %s must be one of %s", p.Name, strings.Join(p.Values, ","))
+	default:
+		if !p.Pattern.MatchString(value) {
+			return fmt.Errorf("parameter %s is not permitted: %s", p.Name, value)
+		}
+	}
+	return nil
+}
+
 // Inventory execute command and collect inventory
 func Inventory(inventoryRequest halib.InventoryRequest, r render.Render, params martini.Params) {
 	log := util.HappoAgentLogger()
 	var inventoryResponse halib.InventoryResponse
 
+	command := inventoryRequest.Command
+	commandOption := inventoryRequest.CommandOption
+	maxOutputBytes := -1
+	execMode := ""
+	if inventoryRequest.Name != "" {
+		collector, ok := InventoryCollectors[inventoryRequest.Name]
+		if !ok {
+			r.JSON(http.StatusNotFound, halib.ErrorResponse{Status: "error", Message: fmt.Sprintf("inventory collector not found: %s", inventoryRequest.Name)})
+			return
+		}
+		var err error
+		commandOption, err = collector.BuildCommandOption(inventoryRequest.Parameters)
+		if err != nil {
+			r.JSON(http.StatusBadRequest, halib.ErrorResponse{Status: "error", Message: err.Error()})
+			return
+		}
+		command = collector.Command
+		maxOutputBytes = collector.MaxOutputBytes
+		execMode = collector.ExecMode
+	} else if !EnableFreeFormInventory {
+		log.WithField("Command", inventoryRequest.Command).Warn("free-form inventory is disabled")
+		r.JSON(http.StatusForbidden, halib.ErrorResponse{Status: "error", Message: "free-form inventory is disabled. specify name"})
+		return
+	}
+
 	if !util.Production {
-		log.Printf("Inventory Command: %s %s\n", inventoryRequest.Command, inventoryRequest.CommandOption)
+		log.Printf("Inventory Command: %s %s\n", command, commandOption)
 	}
 
-	exitstatus, out, err := util.ExecCommandCombinedOutput(inventoryRequest.Command, inventoryRequest.CommandOption)
+	exitstatus, out, truncated, err := util.ExecCommandCombinedOutputWithLimit(execMode, command, commandOption, maxOutputBytes)
 	if err != nil {
 		r.JSON(http.StatusExpectationFailed, inventoryResponse)
 		return
@@ -31,11 +215,13 @@ func Inventory(inventoryRequest halib.InventoryRequest, r render.Render, params
 	if exitstatus != 0 {
 		inventoryResponse.ReturnCode = exitstatus
 		inventoryResponse.ReturnValue = out
+		inventoryResponse.Truncated = truncated
 		r.JSON(http.StatusBadRequest, inventoryResponse)
 		return
 	}
 	inventoryResponse.ReturnCode = exitstatus
 	inventoryResponse.ReturnValue = out
+	inventoryResponse.Truncated = truncated
 
 	r.JSON(http.StatusOK, inventoryResponse)
 }
@@ -1 +1,114 @@
 package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/martini-contrib/binding"
+	"github.com/stretchr/testify/assert"
+)
+
+const testInventoryConfig = `collectors:
+- name: echo
+  command: echo
+  command_option: "$word$ $count$ $mode$"
+  parameters:
+  - name: word
+  - name: count
+    type: int
+    default: "1"
+  - name: mode
+    type: enum
+    values: [short, long]
+    default: short
+- name: large
+  command: seq
+  command_option: "1 10000"
+  max_output_bytes: 10
+`
+
+func loadTestInventoryCollectors(t *testing.T) map[string]InventoryCollector {
+	f, err := ioutil.TempFile("", "inventory")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(testInventoryConfig)
+	f.Close()
+
+	collectors, err := LoadInventoryCollectors(f.Name())
+	assert.Nil(t, err)
+	return collectors
+}
+
+func postInventory(body string) *httptest.ResponseRecorder {
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/inventory", binding.Json(halib.InventoryRequest{}), Inventory)
+
+	req, _ := http.NewRequest("POST", "/inventory", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+	return res
+}
+
+func TestBuildCommandOption1(t *testing.T) {
+	collectors := loadTestInventoryCollectors(t)
+	echo := collectors["echo"]
+
+	option, err := echo.BuildCommandOption(map[string]string{"word": "hello"})
+	assert.Nil(t, err)
+	assert.Equal(t, "hello 1 short", option)
+
+	option, err = echo.BuildCommandOption(map[string]string{"word": "hello", "count": "3", "mode": "long"})
+	assert.Nil(t, err)
+	assert.Equal(t, "hello 3 long", option)
+
+	_, err = echo.BuildCommandOption(map[string]string{})
+	assert.NotNil(t, err)
+	_, err = echo.BuildCommandOption(map[string]string{"word": "hello;id"})
+	assert.NotNil(t, err)
+	_, err = echo.BuildCommandOption(map[string]string{"word": "hello", "count": "x"})
+	assert.NotNil(t, err)
+	_, err = echo.BuildCommandOption(map[string]string{"word": "hello", "mode": "middle"})
+	assert.NotNil(t, err)
+	_, err = echo.BuildCommandOption(map[string]string{"word": "hello", "unknown": "1"})
+	assert.NotNil(t, err)
+}
+
+func TestInventory1(t *testing.T) {
+	InventoryCollectors = loadTestInventoryCollectors(t)
+	defer func() { InventoryCollectors = map[string]InventoryCollector{} }()
+
+	res := postInventory(`{"apikey": "", "name": "echo", "parameters": {"word": "hello"}}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"return_code":0,"return_value":"hello 1 short\n"}`, res.Body.String())
+
+	res = postInventory(`{"apikey": "", "name": "large"}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"return_code":0,"return_value":"1\n2\n3\n4\n5\n","truncated":true}`, res.Body.String())
+
+	res = postInventory(`{"apikey": "", "name": "notfound"}`)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	res = postInventory(`{"apikey": "", "name": "echo", "parameters": {"word": "$(id)"}}`)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func TestInventory2(t *testing.T) {
+	res := postInventory(`{"apikey": "", "command": "uname", "command_option": "-a"}`)
+	assert.Equal(t, http.StatusForbidden, res.Code)
+
+	EnableFreeFormInventory = true
+	defer func() { EnableFreeFormInventory = false }()
+
+	res = postInventory(`{"apikey": "", "command": "echo", "command_option": "free"}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, `{"return_code":0,"return_value":"free\n"}`, res.Body.String())
+}
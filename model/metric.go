@@ -1,7 +1,13 @@
 package model
 
 import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codegangsta/martini-contrib/render"
@@ -15,20 +21,236 @@ import (
 // MetricConfigFile is filepath of metric config file
 var MetricConfigFile string
 
+// MetricGraphiteFormat is formatter of /metric graphite format
+var MetricGraphiteFormat, _ = collect.NewGraphiteFormat(halib.DefaultGraphitePrefixTemplate)
+
+// MetricInfluxFormat is formatter of /metric influx format
+var MetricInfluxFormat = &collect.InfluxFormat{}
+
+// StreamWriteTimeout is write timeout of each progress of streaming response (/metric stream and /proxy). whole response is not limited
+var StreamWriteTimeout = halib.DefaultServerHTTPTimeout * time.Second
+
 // Metric returns collected metrics
-func Metric(metricRequest halib.MetricRequest, r render.Render) {
+func Metric(metricRequest halib.MetricRequest, r render.Render, res http.ResponseWriter, req *http.Request) {
 	var metricResponse halib.MetricResponse
 
-	metricResponse.MetricData = collect.GetCollectedMetricsWithLimit(60) // FIXME to prefer value. now 60 times = 1hour
+	filter := collect.MetricFilter{
+		From:         metricRequest.From,
+		To:           metricRequest.To,
+		HostName:     metricRequest.Hostname,
+		MetricPrefix: metricRequest.MetricPrefix,
+		Cursor:       metricRequest.Cursor,
+		Limit:        metricRequest.Limit,
+	}
+	if err := filter.Validate(); err != nil {
+		metricResponse.Message = err.Error()
+		r.JSON(http.StatusBadRequest, metricResponse)
+		return
+	}
+
+	format, err := negotiateMetricFormat(metricRequest, req)
+	if err != nil {
+		metricResponse.Message = err.Error()
+		r.JSON(http.StatusBadRequest, metricResponse)
+		return
+	}
+
+	// streaming is not limited by default
+	if format != halib.MetricFormatJSON {
+		streamMetric(metricRequest, filter, format, res, req)
+		return
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = halib.DefaultMetricFetchLimit
+	}
+
+	var result collect.CollectedMetrics
+	if metricRequest.Lease {
+		leaseSeconds := metricRequest.LeaseSeconds
+		if leaseSeconds <= 0 {
+			leaseSeconds = halib.DefaultMetricLeaseSeconds
+		}
+		result, metricResponse.LeaseID, err = collect.LeaseCollectedMetrics(filter, time.Duration(leaseSeconds)*time.Second)
+	} else {
+		result, err = collect.GetCollectedMetricsWithFilter(filter)
+	}
+	if err != nil {
+		metricResponse.Message = err.Error()
+		r.JSON(http.StatusInternalServerError, metricResponse)
+		return
+	}
+	metricResponse.MetricData = result.MetricData
+	metricResponse.HasMore = result.HasMore
+	metricResponse.NextCursor = result.NextCursor
 
 	r.JSON(http.StatusOK, metricResponse)
 }
 
+// negotiateMetricFormat decides output format by format field, stream field and Accept header in this order
+func negotiateMetricFormat(metricRequest halib.MetricRequest, req *http.Request) (string, error) {
+	switch metricRequest.Format {
+	case halib.MetricFormatJSON, halib.MetricFormatNDJSON, halib.MetricFormatInflux, halib.MetricFormatGraphite:
+		return metricRequest.Format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown format: %s", metricRequest.Format)
+	}
+	if metricRequest.Stream {
+		return halib.MetricFormatNDJSON, nil
+	}
+
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, halib.ContentTypeNDJSON):
+		return halib.MetricFormatNDJSON, nil
+	case strings.Contains(accept, halib.ContentTypeInfluxLineProtocol):
+		return halib.MetricFormatInflux, nil
+	case strings.Contains(accept, halib.ContentTypeGraphite):
+		return halib.MetricFormatGraphite, nil
+	}
+	return halib.MetricFormatJSON, nil
+}
+
+// streamMetric writes collected metrics as NDJSON or text lines while iterating buffer, so that memory use does not depend on buffer size.
+// lease id is returned by header, has_more and next_cursor are returned by trailer (only when completed).
+// write deadline of server is extended on each flush, so that large buffer is not cut off
+func streamMetric(metricRequest halib.MetricRequest, filter collect.MetricFilter, format string, res http.ResponseWriter, req *http.Request) {
+	log := util.HappoAgentLogger()
+
+	leaseID := ""
+	if metricRequest.Lease {
+		var err error
+		leaseID, err = collect.NewMetricLeaseID()
+		if err != nil {
+			r := halib.MetricResponse{Message: err.Error()}
+			body, _ := json.Marshal(r)
+			res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write(body)
+			return
+		}
+		res.Header().Set(halib.HeaderMetricLeaseID, leaseID)
+	}
+	var formatter collect.MetricFormatter
+	switch format {
+	case halib.MetricFormatInflux:
+		formatter = MetricInfluxFormat
+		res.Header().Set("Content-Type", halib.ContentTypeInfluxLineProtocol+"; charset=utf-8")
+	case halib.MetricFormatGraphite:
+		formatter = MetricGraphiteFormat
+		res.Header().Set("Content-Type", halib.ContentTypeGraphite+"; charset=utf-8")
+	default:
+		res.Header().Set("Content-Type", halib.ContentTypeNDJSON)
+	}
+	res.Header().Set("Trailer", halib.HeaderMetricHasMore+", "+halib.HeaderMetricNextCursor)
+
+	var w io.Writer = res
+	var gz *gzip.Writer
+	if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		res.Header().Set("Content-Encoding", "gzip")
+		gz = gzip.NewWriter(res)
+		w = gz
+	}
+	util.ExtendWriteDeadline(req, StreamWriteTimeout)
+	res.WriteHeader(http.StatusOK)
+
+	flusher, _ := res.(http.Flusher)
+	enc := json.NewEncoder(w)
+	lines := 0
+	result, err := collect.WalkCollectedMetrics(filter, func(metrics halib.MetricsData) error {
+		if formatter == nil {
+			err := enc.Encode(metrics)
+			if err != nil {
+				return err
+			}
+		} else {
+			formatted, err := formatter.Format(metrics)
+			if err != nil {
+				return err
+			}
+			for _, line := range formatted {
+				_, err = io.WriteString(w, line)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		lines++
+		if lines%halib.MetricStreamFlushLines == 0 {
+			if gz != nil {
+				gz.Flush()
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			util.ExtendWriteDeadline(req, StreamWriteTimeout)
+		}
+		return nil
+	})
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		// metrics are kept. client can detect incomplete response by missing trailer
+		log.Errorf("metric stream aborted: %s", err.Error())
+		return
+	}
+
+	if metricRequest.Lease {
+		leaseSeconds := metricRequest.LeaseSeconds
+		if leaseSeconds <= 0 {
+			leaseSeconds = halib.DefaultMetricLeaseSeconds
+		}
+		result.Lease(leaseID, time.Duration(leaseSeconds)*time.Second)
+	} else {
+		err = result.Delete()
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	res.Header().Set(halib.HeaderMetricHasMore, strconv.FormatBool(result.HasMore))
+	res.Header().Set(halib.HeaderMetricNextCursor, result.NextCursor)
+}
+
+// MetricAck deletes metrics returned by /metric with lease
+func MetricAck(request halib.MetricAckRequest, r render.Render) {
+	var response halib.MetricAckResponse
+
+	deleted, err := collect.AckCollectedMetrics(request.LeaseID)
+	if err != nil {
+		response.Status = "error"
+		response.Message = err.Error()
+		if err == collect.ErrMetricLeaseNotFound {
+			r.JSON(http.StatusNotFound, response)
+		} else {
+			r.JSON(http.StatusInternalServerError, response)
+		}
+		return
+	}
+
+	response.Status = "ok"
+	response.Deleted = deleted
+	r.JSON(http.StatusOK, response)
+}
+
 // MetricAppend store metrics to local dbms
 func MetricAppend(request halib.MetricAppendRequest, r render.Render) {
 	var response halib.MetricAppendResponse
 
-	err := collect.SaveMetrics(time.Now(), request.MetricData)
+	now := time.Now()
+	metricData := request.MetricData
+	if request.Data != "" {
+		parsed, err := collect.ParseMetricInput(request.Format, []byte(request.Data), request.HostName, now)
+		if err != nil {
+			response.Status = "error"
+			response.Message = err.Error()
+			r.JSON(http.StatusBadRequest, response)
+			return
+		}
+		metricData = append(metricData, parsed...)
+	}
+
+	err := collect.SaveMetrics(now, metricData)
 	if err != nil {
 		response.Status = "error"
 		response.Message = err.Error()
@@ -40,20 +262,108 @@ func MetricAppend(request halib.MetricAppendRequest, r render.Render) {
 	r.JSON(http.StatusOK, response)
 }
 
-// MetricConfigUpdate save metric collect config
+// MetricConfigUpdate validates and saves metric collect config, and applies it
 func MetricConfigUpdate(metricRequest halib.MetricConfigUpdateRequest, r render.Render) {
 	var metricResponse halib.MetricConfigUpdateResponse
 
-	err := collect.SaveMetricConfig(metricRequest.Config, MetricConfigFile)
+	err := collect.ValidateMetricConfig(metricRequest.Config)
 	if err != nil {
 		metricResponse.Status = "NG"
-	} else {
-		metricResponse.Status = "OK"
+		metricResponse.Message = err.Error()
+		r.JSON(http.StatusBadRequest, metricResponse)
+		return
 	}
 
+	before := liveMetricConfig()
+	err = collect.SaveMetricConfig(metricRequest.Config, MetricConfigFile)
+	if err == nil {
+		err = applyMetricConfig()
+	}
+	if err != nil {
+		metricResponse.Status = "NG"
+		metricResponse.Message = err.Error()
+		r.JSON(http.StatusInternalServerError, metricResponse)
+		return
+	}
+
+	metricResponse.Status = "OK"
+	metricResponse.Diff = collect.DiffMetricConfig(before, metricRequest.Config)
 	r.JSON(http.StatusOK, metricResponse)
 }
 
+// MetricConfigGet returns live metric collect config and backup versions
+func MetricConfigGet(metricRequest halib.MetricConfigRequest, r render.Render) {
+	var metricResponse halib.MetricConfigResponse
+
+	versions, err := collect.ListMetricConfigVersions(MetricConfigFile)
+	if err != nil {
+		metricResponse.Status = "NG"
+		metricResponse.Message = err.Error()
+		r.JSON(http.StatusInternalServerError, metricResponse)
+		return
+	}
+
+	metricResponse.Status = "OK"
+	metricResponse.Config = liveMetricConfig()
+	metricResponse.Versions = versions
+	r.JSON(http.StatusOK, metricResponse)
+}
+
+// MetricConfigRollback restores previous metric collect config, and applies it
+func MetricConfigRollback(metricRequest halib.MetricConfigRollbackRequest, r render.Render) {
+	var metricResponse halib.MetricConfigUpdateResponse
+
+	version := metricRequest.Version
+	if version == "" {
+		versions, err := collect.ListMetricConfigVersions(MetricConfigFile)
+		if err == nil && len(versions) > 0 {
+			version = versions[0]
+		}
+	}
+
+	before := liveMetricConfig()
+	after, err := collect.RollbackMetricConfig(MetricConfigFile, version)
+	if err == nil {
+		err = applyMetricConfig()
+	}
+	if err != nil {
+		metricResponse.Status = "NG"
+		metricResponse.Message = err.Error()
+		if err == collect.ErrMetricConfigVersionNotFound {
+			r.JSON(http.StatusNotFound, metricResponse)
+		} else if _, ok := err.(*collect.MetricConfigError); ok {
+			r.JSON(http.StatusBadRequest, metricResponse)
+		} else {
+			r.JSON(http.StatusInternalServerError, metricResponse)
+		}
+		return
+	}
+
+	metricResponse.Status = "OK"
+	metricResponse.Version = version
+	metricResponse.Diff = collect.DiffMetricConfig(before, after)
+	r.JSON(http.StatusOK, metricResponse)
+}
+
+// liveMetricConfig returns config used by collection. when not loaded, returns config file
+func liveMetricConfig() halib.MetricConfig {
+	if collect.ActiveMetricConfig != nil {
+		if config, generation := collect.ActiveMetricConfig.Get(); generation > 0 {
+			return config
+		}
+	}
+	config, _ := collect.GetMetricConfig(MetricConfigFile)
+	return config
+}
+
+// applyMetricConfig reloads saved config without waiting file watch
+func applyMetricConfig() error {
+	if collect.ActiveMetricConfig == nil {
+		return nil
+	}
+	return collect.ActiveMetricConfig.Reload()
+}
+
 // MetricDataBufferStatus is obsoluted.
 func MetricDataBufferStatus(r render.Render) {
 	util.HappoAgentLogger().Warn("/metric/status is obsoluted. use /status")
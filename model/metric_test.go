@@ -0,0 +1,233 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/collect"
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/martini-contrib/binding"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func setupMetricTestDB(t *testing.T) func() {
+	DB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.Nil(t, err)
+	db.DB = DB
+
+	base := time.Now()
+	for i := 0; i < 3; i++ {
+		err = collect.SaveMetrics(base.Add(time.Duration(i)*time.Second), []halib.MetricsData{
+			{HostName: "localhost", Timestamp: base.Unix() + int64(i), Metrics: map[string]float64{"test.value": float64(i)}},
+		})
+		assert.Nil(t, err)
+	}
+
+	return func() {
+		db.DB.Close()
+		db.DB = nil
+	}
+}
+
+func TestMetricStream1(t *testing.T) {
+	defer setupMetricTestDB(t)()
+
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/metric", binding.Json(halib.MetricRequest{}), Metric)
+
+	req, _ := http.NewRequest("POST", "/metric", bytes.NewReader([]byte(`{"apikey": "", "stream": true}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, halib.ContentTypeNDJSON, res.Header().Get("Content-Type"))
+	assert.Equal(t, "gzip", res.Header().Get("Content-Encoding"))
+	assert.Equal(t, "false", res.Result().Trailer.Get(halib.HeaderMetricHasMore))
+
+	gz, err := gzip.NewReader(res.Body)
+	assert.Nil(t, err)
+	scanner := bufio.NewScanner(gz)
+	lines := 0
+	for scanner.Scan() {
+		var metrics halib.MetricsData
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &metrics))
+		assert.Equal(t, float64(lines), metrics.Metrics["test.value"])
+		lines++
+	}
+	assert.Equal(t, 3, lines)
+
+	// drained
+	assert.Nil(t, collect.GetCollectedMetrics())
+}
+
+func TestMetricStream2(t *testing.T) {
+	defer setupMetricTestDB(t)()
+
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/metric", binding.Json(halib.MetricRequest{}), Metric)
+
+	req, _ := http.NewRequest("POST", "/metric", bytes.NewReader([]byte(`{"apikey": "", "lease": true, "limit": 2}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", halib.ContentTypeNDJSON)
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, 2, bytes.Count(res.Body.Bytes(), []byte("\n")))
+	assert.Equal(t, "true", res.Result().Trailer.Get(halib.HeaderMetricHasMore))
+	assert.NotEqual(t, "", res.Result().Trailer.Get(halib.HeaderMetricNextCursor))
+
+	// leased metrics are kept until ack
+	leaseID := res.Header().Get(halib.HeaderMetricLeaseID)
+	assert.NotEqual(t, "", leaseID)
+	assert.Equal(t, int64(3), collect.GetMetricDataBufferStatus(true)["length"])
+	deleted, err := collect.AckCollectedMetrics(leaseID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, deleted)
+	assert.Equal(t, int64(1), collect.GetMetricDataBufferStatus(true)["length"])
+}
+
+func TestMetricFormat1(t *testing.T) {
+	defer setupMetricTestDB(t)()
+
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/metric", binding.Json(halib.MetricRequest{}), Metric)
+
+	req, _ := http.NewRequest("POST", "/metric", bytes.NewReader([]byte(`{"apikey": "", "format": "influx", "limit": 1}`)))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, halib.ContentTypeInfluxLineProtocol+"; charset=utf-8", res.Header().Get("Content-Type"))
+	assert.Regexp(t, `^test,hostname=localhost value=0 \d+000000000\n$`, res.Body.String())
+
+	req, _ = http.NewRequest("POST", "/metric", bytes.NewReader([]byte(`{"apikey": ""}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", halib.ContentTypeGraphite)
+	res = httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, halib.ContentTypeGraphite+"; charset=utf-8", res.Header().Get("Content-Type"))
+	assert.Regexp(t, `^happo.localhost.test.value 1 \d+\nhappo.localhost.test.value 2 \d+\n$`, res.Body.String())
+
+	// drained
+	assert.Nil(t, collect.GetCollectedMetrics())
+}
+
+func TestMetricFormat2(t *testing.T) {
+	defer setupMetricTestDB(t)()
+
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/metric", binding.Json(halib.MetricRequest{}), Metric)
+
+	req, _ := http.NewRequest("POST", "/metric", bytes.NewReader([]byte(`{"apikey": "", "format": "xml"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Equal(t, int64(3), collect.GetMetricDataBufferStatus(true)["length"])
+}
+
+func TestMetricAppend1(t *testing.T) {
+	defer setupMetricTestDB(t)()
+	collect.GetCollectedMetrics() // cleanup
+
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/metric/append", binding.Json(halib.MetricAppendRequest{}), MetricAppend)
+
+	req, _ := http.NewRequest("POST", "/metric/append", bytes.NewReader([]byte(`{"apikey": "", "format": "graphite", "hostname": "web01", `+
+		`"data": "app.requests 10 1500000000\napp.requests 12 1500000060\n"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, []halib.MetricsData{
+		{HostName: "web01", Timestamp: 1500000000, Metrics: map[string]float64{"app.requests": 10}},
+		{HostName: "web01", Timestamp: 1500000060, Metrics: map[string]float64{"app.requests": 12}},
+	}, collect.GetCollectedMetrics())
+
+	req, _ = http.NewRequest("POST", "/metric/append", bytes.NewReader([]byte(`{"apikey": "", "format": "graphite", "data": "app.requests"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	res = httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Contains(t, res.Body.String(), `"status":"error"`)
+}
+
+func TestMetricConfigUpdate1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metric_config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	prevMetricConfigFile := MetricConfigFile
+	MetricConfigFile = dir + "/metrics.yaml"
+	defer func() { MetricConfigFile = prevMetricConfigFile }()
+	ioutil.WriteFile(MetricConfigFile, []byte("metrics:\n- hostname: localhost\n  plugins:\n  - plugin_name: metrics_test_plugin\n"), 0644)
+
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/metric/config/update", binding.Json(halib.MetricConfigUpdateRequest{}), MetricConfigUpdate)
+	m.Post("/metric/config/rollback", binding.Json(halib.MetricConfigRollbackRequest{}), MetricConfigRollback)
+	m.Get("/metric/config", binding.Json(halib.MetricConfigRequest{}), MetricConfigGet)
+
+	request := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		m.ServeHTTP(res, req)
+		return res
+	}
+
+	// invalid config is not saved
+	res := request("POST", "/metric/config/update", `{"apikey": "", "config": {"Metrics": [{"Hostname": "localhost", "Plugins": [{"Plugin_Name": "metrics_test_plugin", "Exec_Mode": "unknown"}]}]}}`)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Contains(t, res.Body.String(), "unknown exec mode: unknown")
+
+	res = request("POST", "/metric/config/update", `{"apikey": "", "config": {"Metrics": [{"Hostname": "localhost", "Plugins": [{"Plugin_Name": "metrics_test_plugin", "Interval": 30}]}]}}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var updateResponse halib.MetricConfigUpdateResponse
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &updateResponse))
+	assert.Equal(t, "OK", updateResponse.Status)
+	assert.Equal(t, []string{`~ localhost metrics_test_plugin "": interval: (none) -> 30`}, updateResponse.Diff)
+
+	res = request("GET", "/metric/config", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	var configResponse halib.MetricConfigResponse
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &configResponse))
+	assert.Equal(t, 30, configResponse.Config.Metrics[0].Plugins[0].Interval)
+	assert.Equal(t, 1, len(configResponse.Versions))
+
+	res = request("POST", "/metric/config/rollback", `{"apikey": "", "version": "20000101-000000.000000000"}`)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	res = request("POST", "/metric/config/rollback", `{"apikey": ""}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"version":"`+configResponse.Versions[0]+`"`)
+	config, err := collect.GetMetricConfig(MetricConfigFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, config.Metrics[0].Plugins[0].Interval)
+}
@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/codegangsta/martini-contrib/render"
 	"github.com/heartbeatsjp/happo-agent/db"
 	"github.com/heartbeatsjp/happo-agent/halib"
@@ -56,14 +57,39 @@ func init() {
 }
 
 // Monitor execute monitor command and returns result
-func Monitor(monitorRequest halib.MonitorRequest, r render.Render) {
+func Monitor(monitorRequest halib.MonitorRequest, r render.Render, req *http.Request) {
 	log := util.HappoAgentLogger()
 	var monitorResponse halib.MonitorResponse
 
 	if !util.Production {
 		log.Println(fmt.Sprintf("Plugin Name: %s, Option: %s", monitorRequest.PluginName, monitorRequest.PluginOption))
 	}
-	ret, message, err := execPluginCommand(monitorRequest.PluginName, monitorRequest.PluginOption)
+
+	pluginOption := monitorRequest.PluginOption
+	execMode := ""
+	if MonitorPolicyRules != nil {
+		var err error
+		pluginOption, execMode, err = MonitorPolicyRules.Check(monitorRequest.PluginName, monitorRequest.PluginOption)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"RemoteAddr":   req.RemoteAddr,
+				"PluginName":   monitorRequest.PluginName,
+				"PluginOption": monitorRequest.PluginOption,
+			}).Warn("Monitor Policy Denied")
+			monitorResponse.ReturnValue = halib.MonitorUnknown
+			monitorResponse.Message = err.Error()
+			r.JSON(http.StatusForbidden, monitorResponse)
+			return
+		}
+	}
+
+	if monitorRequest.PluginName == halib.MetricSelfCheckPluginName {
+		monitorResponse.ReturnValue, monitorResponse.Message = metricPluginsSelfCheck(pluginOption)
+		r.JSON(http.StatusOK, monitorResponse)
+		return
+	}
+
+	ret, message, err := execPluginCommand(monitorRequest.PluginName, pluginOption, execMode)
 	if err != nil {
 		monitorResponse.ReturnValue = halib.MonitorError
 		monitorResponse.Message = err.Error()
@@ -84,7 +110,7 @@ func Monitor(monitorRequest halib.MonitorRequest, r render.Render) {
 	r.JSON(http.StatusOK, monitorResponse)
 }
 
-func execPluginCommand(pluginName string, pluginOption string) (int, string, error) {
+func execPluginCommand(pluginName string, pluginOption string, execMode string) (int, string, error) {
 	log := util.HappoAgentLogger()
 	var plugin string
 
@@ -99,7 +125,7 @@ func execPluginCommand(pluginName string, pluginOption string) (int, string, err
 		}
 	}
 
-	exitstatus, stdout, stderr, err := util.ExecCommand(plugin, pluginOption)
+	exitstatus, stdout, stderr, err := util.ExecCommandWithMode(execMode, plugin, pluginOption)
 
 	out := stdout
 	if stdout == "" {
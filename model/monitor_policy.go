@@ -0,0 +1,141 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+
+	"gopkg.in/yaml.v2"
+)
+
+// --- Constant Values
+
+// argument of option_template must not contain shell meta characters
+var templateArgumentPattern = regexp.MustCompile(`^[A-Za-z0-9._:%/,=@+-]+$`)
+
+var templatePlaceholderPattern = regexp.MustCompile(`\$ARG([0-9]+)\$`)
+
+// --- Struct
+
+// MonitorPolicy is allow-list of monitor plugins
+type MonitorPolicy struct {
+	plugins map[string]monitorPolicyPlugin
+}
+
+type monitorPolicyPlugin struct {
+	optionPatterns []*regexp.Regexp
+	optionTemplate string
+	execMode       string
+}
+
+// --- Package Variables
+
+// MonitorPolicyRules is allow-list of /monitor. when nil, any plugin is permitted
+var MonitorPolicyRules *MonitorPolicy
+
+// --- Method
+
+// LoadMonitorPolicy loads monitor plugin policy from yaml file
+func LoadMonitorPolicy(policyFile string) (*MonitorPolicy, error) {
+	var config halib.MonitorPolicyConfig
+
+	buf, err := ioutil.ReadFile(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(buf, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &MonitorPolicy{plugins: map[string]monitorPolicyPlugin{}}
+	for _, p := range config.Plugins {
+		if p.PluginName == "" || strings.Contains(p.PluginName, "/") {
+			return nil, fmt.Errorf("invalid plugin_name: %q", p.PluginName)
+		}
+		if _, ok := policy.plugins[p.PluginName]; ok {
+			return nil, fmt.Errorf("duplicated plugin_name: %s", p.PluginName)
+		}
+		if p.OptionTemplate != "" && len(p.OptionPatterns) > 0 {
+			return nil, fmt.Errorf("%s: option_patterns and option_template are exclusive", p.PluginName)
+		}
+
+		if err := util.ValidateExecMode(p.ExecMode); err != nil {
+			return nil, fmt.Errorf("%s: %s", p.PluginName, err.Error())
+		}
+
+		plugin := monitorPolicyPlugin{optionTemplate: p.OptionTemplate, execMode: p.ExecMode}
+		for _, pattern := range p.OptionPatterns {
+			re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", pattern))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", p.PluginName, err.Error())
+			}
+			plugin.optionPatterns = append(plugin.optionPatterns, re)
+		}
+		policy.plugins[p.PluginName] = plugin
+	}
+
+	return policy, nil
+}
+
+// Check returns plugin option and exec mode to execute. when not permitted, returns error
+func (p *MonitorPolicy) Check(pluginName string, pluginOption string) (string, string, error) {
+	plugin, ok := p.plugins[pluginName]
+	if !ok {
+		return "", "", fmt.Errorf("plugin is not permitted: %s", pluginName)
+	}
+
+	if plugin.optionTemplate != "" {
+		option, err := expandOptionTemplate(plugin.optionTemplate, strings.Fields(pluginOption))
+		return option, plugin.execMode, err
+	}
+
+	if len(plugin.optionPatterns) == 0 {
+		if pluginOption != "" {
+			return "", "", fmt.Errorf("plugin option is not permitted: %s", pluginName)
+		}
+		return "", plugin.execMode, nil
+	}
+	for _, re := range plugin.optionPatterns {
+		if re.MatchString(pluginOption) {
+			return pluginOption, plugin.execMode, nil
+		}
+	}
+	return "", "", fmt.Errorf("plugin option is not permitted: %s %s", pluginName, pluginOption)
+}
+
+// expandOptionTemplate replace $ARGn$ in template to args[n-1]. like nrpe command[] definition
+func expandOptionTemplate(template string, args []string) (string, error) {
+	for _, arg := range args {
+		if !templateArgumentPattern.MatchString(arg) {
+			return "", fmt.Errorf("plugin argument is not permitted: %s", arg)
+		}
+	}
+
+	used := 0
+	var err error
+	option := templatePlaceholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		n, _ := strconv.Atoi(templatePlaceholderPattern.FindStringSubmatch(placeholder)[1])
+		if n < 1 || n > len(args) {
+			err = errors.New("too few plugin arguments")
+			return ""
+		}
+		if n > used {
+			used = n
+		}
+		return args[n-1]
+	})
+	if err != nil {
+		return "", err
+	}
+	if used < len(args) {
+		return "", errors.New("too many plugin arguments")
+	}
+	return option, nil
+}
@@ -0,0 +1,161 @@
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/martini-contrib/render"
+	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/martini-contrib/binding"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestMonitorPolicy(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "monitor_policy")
+	assert.Nil(t, err)
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestLoadMonitorPolicy1(t *testing.T) {
+	policyFile := writeTestMonitorPolicy(t, `plugins:
+- plugin_name: check_procs
+  option_patterns:
+  - '-w [0-9]+ -c [0-9]+'
+  - '-C [a-z]+'
+- plugin_name: check_load
+  option_template: '-w $ARG1$ -c $ARG2$'
+- plugin_name: check_ntp
+`)
+	defer os.Remove(policyFile)
+
+	policy, err := LoadMonitorPolicy(policyFile)
+	assert.Nil(t, err)
+
+	option, _, err := policy.Check("check_procs", "-w 100 -c 200")
+	assert.Nil(t, err)
+	assert.Equal(t, "-w 100 -c 200", option)
+	_, _, err = policy.Check("check_procs", "-w 100 -c 200; rm -rf /")
+	assert.NotNil(t, err)
+	_, _, err = policy.Check("check_procs", "-C sshd")
+	assert.Nil(t, err)
+
+	option, _, err = policy.Check("check_load", "5,4,3 10,8,6")
+	assert.Nil(t, err)
+	assert.Equal(t, "-w 5,4,3 -c 10,8,6", option)
+	_, _, err = policy.Check("check_load", "5,4,3")
+	assert.NotNil(t, err)
+	_, _, err = policy.Check("check_load", "5,4,3 10,8,6 1")
+	assert.NotNil(t, err)
+	_, _, err = policy.Check("check_load", "5 `id`")
+	assert.NotNil(t, err)
+
+	option, _, err = policy.Check("check_ntp", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "", option)
+	_, _, err = policy.Check("check_ntp", "-H localhost")
+	assert.NotNil(t, err)
+
+	_, _, err = policy.Check("../../bin/sh", "")
+	assert.NotNil(t, err)
+}
+
+func TestLoadMonitorPolicy2(t *testing.T) {
+	for _, content := range []string{
+		"plugins:\n- plugin_name: ../check_procs\n",
+		"plugins:\n- plugin_name: check_procs\n- plugin_name: check_procs\n",
+		"plugins:\n- plugin_name: check_procs\n  option_patterns: ['(']\n",
+		"plugins:\n- plugin_name: check_procs\n  option_patterns: ['.*']\n  option_template: '$ARG1$'\n",
+	} {
+		policyFile := writeTestMonitorPolicy(t, content)
+		_, err := LoadMonitorPolicy(policyFile)
+		assert.NotNil(t, err, content)
+		os.Remove(policyFile)
+	}
+}
+
+func TestLoadMonitorPolicy3(t *testing.T) {
+	policyFile := writeTestMonitorPolicy(t, `plugins:
+- plugin_name: check_load
+  option_template: '-w $ARG1$ -c $ARG2$'
+  exec_mode: direct
+- plugin_name: check_ntp
+`)
+	defer os.Remove(policyFile)
+
+	policy, err := LoadMonitorPolicy(policyFile)
+	assert.Nil(t, err)
+	_, execMode, err := policy.Check("check_load", "1 2")
+	assert.Nil(t, err)
+	assert.Equal(t, halib.ExecModeDirect, execMode)
+	_, execMode, err = policy.Check("check_ntp", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "", execMode)
+
+	policyFile2 := writeTestMonitorPolicy(t, `plugins:
+- plugin_name: check_load
+  exec_mode: bash
+`)
+	defer os.Remove(policyFile2)
+	_, err = LoadMonitorPolicy(policyFile2)
+	assert.NotNil(t, err)
+}
+
+func TestMonitorPolicy1(t *testing.T) {
+	policyFile := writeTestMonitorPolicy(t, `plugins:
+- plugin_name: monitor_test_plugin
+  option_patterns: ['[0-3]']
+`)
+	defer os.Remove(policyFile)
+	policy, err := LoadMonitorPolicy(policyFile)
+	assert.Nil(t, err)
+	MonitorPolicyRules = policy
+	defer func() { MonitorPolicyRules = nil }()
+
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/monitor", binding.Json(halib.MonitorRequest{}), Monitor)
+
+	reader := bytes.NewReader([]byte(`{
+		"apikey": "",
+		"plugin_name": "monitor_test_plugin",
+		"plugin_option": "0 ; echo injected"
+	}`))
+	req, _ := http.NewRequest("POST", "/monitor", reader)
+	req.Header.Set("Content-Type", "application/json")
+
+	res := httptest.NewRecorder()
+
+	lastRunned = time.Now().Unix() //avoid saveMachineState
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusForbidden, res.Code)
+	assert.Equal(t,
+		`{"return_value":3,"message":"plugin option is not permitted: monitor_test_plugin 0 ; echo injected"}`,
+		res.Body.String(),
+	)
+
+	reader = bytes.NewReader([]byte(`{
+		"apikey": "",
+		"plugin_name": "monitor_test_plugin",
+		"plugin_option": "1"
+	}`))
+	req, _ = http.NewRequest("POST", "/monitor", reader)
+	req.Header.Set("Content-Type", "application/json")
+
+	res = httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t,
+		`{"return_value":1,"message":"Output of monitor_test_plugin. exit status is 1\n"}`,
+		res.Body.String(),
+	)
+}
@@ -0,0 +1,53 @@
+package model
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/heartbeatsjp/happo-agent/collect"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// metricPluginsSelfCheck checks consecutive failures of metric plugins like nagios plugin.
+// option is `-w <failures> -c <failures>`
+func metricPluginsSelfCheck(pluginOption string) (int, string) {
+	args, err := util.SplitShellWords(pluginOption)
+	if err != nil {
+		return halib.MonitorUnknown, fmt.Sprintf("UNKNOWN: %s\n", err.Error())
+	}
+	flags := flag.NewFlagSet(halib.MetricSelfCheckPluginName, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	warning := flags.Int("w", halib.DefaultMetricSelfCheckWarningFailures, "consecutive failures to be warning")
+	critical := flags.Int("c", halib.DefaultMetricSelfCheckCriticalFailures, "consecutive failures to be critical")
+	err = flags.Parse(args)
+	if err != nil {
+		return halib.MonitorUnknown, fmt.Sprintf("UNKNOWN: %s\n", err.Error())
+	}
+
+	ret := halib.MonitorOK
+	var failing []string
+	statuses := collect.GetMetricPluginStatus()
+	for _, status := range statuses {
+		if status.ConsecutiveFailures < *warning {
+			continue
+		}
+		if status.ConsecutiveFailures >= *critical {
+			ret = halib.MonitorError
+		} else if ret == halib.MonitorOK {
+			ret = halib.MonitorWarning
+		}
+		failing = append(failing, fmt.Sprintf("%s %s %s (%d times: %s %s)",
+			status.Hostname, status.PluginName, status.PluginOption, status.ConsecutiveFailures, status.Message, strings.TrimSpace(status.Stderr)))
+	}
+
+	switch ret {
+	case halib.MonitorOK:
+		return ret, fmt.Sprintf("OK: %d metric plugins\n", len(statuses))
+	case halib.MonitorWarning:
+		return ret, fmt.Sprintf("WARNING: %d metric plugins failing: %s\n", len(failing), strings.Join(failing, ", "))
+	}
+	return ret, fmt.Sprintf("CRITICAL: %d metric plugins failing: %s\n", len(failing), strings.Join(failing, ", "))
+}
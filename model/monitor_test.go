@@ -3,14 +3,18 @@ package model
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/codegangsta/martini-contrib/render"
 	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/collect"
 	"github.com/heartbeatsjp/happo-agent/halib"
 	"github.com/martini-contrib/binding"
 	"github.com/stretchr/testify/assert"
@@ -177,3 +181,50 @@ func TestMonitor6(t *testing.T) {
 		res.Body.String(),
 	)
 }
+
+func TestMonitorSelfCheck1(t *testing.T) {
+	defer setupMetricTestDB(t)()
+
+	f, err := ioutil.TempFile("", "metrics.yaml")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("metrics:\n- hostname: localhost\n  plugins:\n  - plugin_name: notfound\n    interval: 1\n")
+	f.Close()
+
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/monitor", binding.Json(halib.MonitorRequest{}), Monitor)
+
+	check := func(option string) string {
+		reader := bytes.NewReader([]byte(fmt.Sprintf(`{"apikey": "", "plugin_name": "%s", "plugin_option": "%s"}`, halib.MetricSelfCheckPluginName, option)))
+		req, _ := http.NewRequest("POST", "/monitor", reader)
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		m.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+		return res.Body.String()
+	}
+
+	config := collect.NewMetricConfigLoader(f.Name())
+	assert.Nil(t, config.Reload())
+	stop := make(chan struct{})
+	defer close(stop)
+	go collect.NewMetricScheduler(config, 1).Run(stop)
+
+	// plugin fails every second
+	seen := map[string]bool{}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		result := check("-w 2 -c 3")
+		seen[result] = true
+		if strings.Contains(result, `"return_value":2`) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.True(t, seen[`{"return_value":0,"message":"OK: 1 metric plugins\n"}`], "%v", seen)
+	assert.True(t, seen[`{"return_value":1,"message":"WARNING: 1 metric plugins failing: localhost notfound  (2 times: Plugin not found: notfound )\n"}`], "%v", seen)
+	assert.Regexp(t, `^\{"return_value":2,"message":"CRITICAL: 1 metric plugins failing: `, check("-w 2 -c 3"))
+
+	assert.Regexp(t, `^\{"return_value":3,`, check("-x"))
+}
@@ -0,0 +1,208 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/collect"
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/util"
+)
+
+// --- Constant Values
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// numeric leveldb properties exported to prometheus
+var prometheusLevelDBProperties = []string{
+	"leveldb.num-files-at-level0",
+	"leveldb.num-files-at-level1",
+	"leveldb.num-files-at-level2",
+	"leveldb.openedtables",
+	"leveldb.alivesnaps",
+	"leveldb.aliveiters",
+	"leveldb.cachedblock",
+}
+
+var prometheusLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var prometheusLabelNameReplacer = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// --- Package Variables
+
+// PrometheusExposeCollectedMetrics exposes latest value of collected metrics on /metrics
+var PrometheusExposeCollectedMetrics = false
+
+// --- Struct
+
+type prometheusLabel struct {
+	Name  string
+	Value string
+}
+
+// --- Method
+
+// PrometheusMetrics implements /metrics endpoint. returns agent metrics in prometheus text format
+func PrometheusMetrics(res http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+
+	writePrometheusHeader(&buf, "happo_agent_info", "happo-agent version", "gauge")
+	writePrometheusSample(&buf, "happo_agent_info", []prometheusLabel{{"version", AppVersion}}, 1, 0)
+	writePrometheusHeader(&buf, "happo_agent_uptime_seconds", "Seconds since happo-agent started", "gauge")
+	writePrometheusSample(&buf, "happo_agent_uptime_seconds", nil, time.Since(startAt).Seconds(), 0)
+	writePrometheusHeader(&buf, "happo_agent_goroutines", "Number of goroutines", "gauge")
+	writePrometheusSample(&buf, "happo_agent_goroutines", nil, float64(runtime.NumGoroutine()), 0)
+
+	writePrometheusRequestMetrics(&buf)
+	writePrometheusExecMetrics(&buf)
+	writePrometheusLevelDBMetrics(&buf)
+
+	if PrometheusExposeCollectedMetrics {
+		writePrometheusHeader(&buf, "happo_agent_collected_metric", "Latest value of collected metric", "gauge")
+		for _, latest := range collect.GetLatestMetrics() {
+			writePrometheusSample(&buf, "happo_agent_collected_metric",
+				prometheusCollectedMetricLabels(latest),
+				latest.Value, latest.Timestamp*1000)
+		}
+	}
+
+	res.Header().Set("Content-Type", prometheusContentType)
+	res.WriteHeader(http.StatusOK)
+	res.Write(buf.Bytes())
+}
+
+func writePrometheusRequestMetrics(w io.Writer) {
+	totals := util.GetMartiniRequestTotals()
+	routes := make([]string, 0, len(totals))
+	for route := range totals {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	writePrometheusHeader(w, "happo_agent_http_requests_total", "Number of HTTP requests (requires --enable-requeststatus-middleware)", "counter")
+	for _, route := range routes {
+		codes := make([]int, 0, len(totals[route]))
+		for code := range totals[route] {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			writePrometheusSample(w, "happo_agent_http_requests_total",
+				[]prometheusLabel{{"route", route}, {"code", strconv.Itoa(code)}},
+				float64(totals[route][code]), 0)
+		}
+	}
+}
+
+func writePrometheusExecMetrics(w io.Writer) {
+	stats := util.GetExecStats()
+	commands := make([]string, 0, len(stats))
+	for command := range stats {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	writePrometheusHeader(w, "happo_agent_plugin_executions_total", "Number of plugin executions", "counter")
+	for _, command := range commands {
+		writePrometheusSample(w, "happo_agent_plugin_executions_total", []prometheusLabel{{"plugin", command}}, float64(stats[command].Count), 0)
+	}
+	writePrometheusHeader(w, "happo_agent_plugin_execution_seconds_total", "Total seconds of plugin executions", "counter")
+	for _, command := range commands {
+		writePrometheusSample(w, "happo_agent_plugin_execution_seconds_total", []prometheusLabel{{"plugin", command}}, stats[command].DurationSeconds, 0)
+	}
+	writePrometheusHeader(w, "happo_agent_plugin_timeouts_total", "Number of plugin execution timeouts", "counter")
+	for _, command := range commands {
+		writePrometheusSample(w, "happo_agent_plugin_timeouts_total", []prometheusLabel{{"plugin", command}}, float64(stats[command].Timeouts), 0)
+	}
+}
+
+func writePrometheusLevelDBMetrics(w io.Writer) {
+	writePrometheusHeader(w, "happo_agent_leveldb_property", "Numeric LevelDB property", "gauge")
+	for _, propertyName := range prometheusLevelDBProperties {
+		propertyValue, err := db.DB.GetProperty(propertyName)
+		if err != nil {
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(propertyValue), 64)
+		if err != nil {
+			continue
+		}
+		writePrometheusSample(w, "happo_agent_leveldb_property", []prometheusLabel{{"property", propertyName}}, value, 0)
+	}
+
+	// depth is exported as size, as counting all buffered metrics is disk IO bound
+	writePrometheusHeader(w, "happo_agent_metric_buffer_size_bytes", "Approximate on-disk size of buffered metric collections", "gauge")
+	writePrometheusSample(w, "happo_agent_metric_buffer_size_bytes", nil, float64(collect.GetMetricDataBufferSize()), 0)
+	bufferStatus := collect.GetMetricDataBufferStatus(false)
+	writePrometheusHeader(w, "happo_agent_metric_buffer_oldest_timestamp_seconds", "Unix time of oldest buffered metric collection", "gauge")
+	writePrometheusSample(w, "happo_agent_metric_buffer_oldest_timestamp_seconds", nil, float64(bufferStatus["oldest_timestamp"]), 0)
+	writePrometheusHeader(w, "happo_agent_metric_buffer_newest_timestamp_seconds", "Unix time of newest buffered metric collection", "gauge")
+	writePrometheusSample(w, "happo_agent_metric_buffer_newest_timestamp_seconds", nil, float64(bufferStatus["newest_timestamp"]), 0)
+}
+
+// prometheusCollectedMetricLabels returns hostname, name and tags of collected metric as labels.
+// tag name is sanitized, and prefixed by `tag_` when it conflicts with hostname, name or reserved labels
+func prometheusCollectedMetricLabels(latest collect.LatestMetric) []prometheusLabel {
+	labels := []prometheusLabel{{"hostname", latest.HostName}, {"name", latest.Name}}
+	keys := make([]string, 0, len(latest.Tags))
+	for key := range latest.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	seen := map[string]bool{}
+	for _, key := range keys {
+		name := prometheusLabelNameReplacer.ReplaceAllString(key, "_")
+		if name == "" || name == "hostname" || name == "name" || strings.HasPrefix(name, "__") || (name[0] >= '0' && name[0] <= '9') {
+			name = "tag_" + name
+		}
+		if seen[name] {
+			continue // duplicated after sanitized
+		}
+		seen[name] = true
+		labels = append(labels, prometheusLabel{name, latest.Tags[key]})
+	}
+	return labels
+}
+
+func writePrometheusHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+// writePrometheusSample writes one sample line. timestamp is milliseconds, 0 means no timestamp
+func writePrometheusSample(w io.Writer, name string, labels []prometheusLabel, value float64, timestamp int64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, len(labels))
+		for i, label := range labels {
+			pairs[i] = fmt.Sprintf(`%s="%s"`, label.Name, prometheusLabelValueReplacer.Replace(label.Value))
+		}
+		fmt.Fprintf(w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(w, " %s", formatPrometheusValue(value))
+	if timestamp != 0 {
+		fmt.Fprintf(w, " %d", timestamp)
+	}
+	io.WriteString(w, "\n")
+}
+
+func formatPrometheusValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/collect"
+	"github.com/heartbeatsjp/happo-agent/db"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	leveldbUtil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestPrometheusMetrics1(t *testing.T) {
+	DB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.Nil(t, err)
+	db.DB = DB
+	defer func() {
+		db.DB.Close()
+		db.DB = nil
+	}()
+
+	util.ExecCommand("echo", "")
+	collect.SaveMetrics(time.Now(), []halib.MetricsData{
+		{HostName: `host"1`, Timestamp: 1505180794, Metrics: map[string]float64{"linux.loadavg.load_avg_one": 0.05}},
+		{HostName: "host2", Timestamp: 1505180794, Tags: map[string]string{"role": "web", "dc-name": "tokyo"}, Metrics: map[string]float64{"app.requests": 1}},
+		{HostName: "host2", Timestamp: 1505180794, Tags: map[string]string{"role": "db", "name": "x"}, Metrics: map[string]float64{"app.requests": 2}},
+	})
+
+	// flush memtable, so that buffer size is counted
+	assert.Nil(t, db.DB.CompactRange(leveldbUtil.Range{}))
+
+	m := martini.Classic()
+	m.Get("/metrics", PrometheusMetrics)
+
+	PrometheusExposeCollectedMetrics = false
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, prometheusContentType, res.Header().Get("Content-Type"))
+	body := res.Body.String()
+	assert.Contains(t, body, "# TYPE happo_agent_plugin_executions_total counter\n")
+	assert.Regexp(t, `(?m)^happo_agent_plugin_executions_total\{plugin="echo"\} [1-9]`, body)
+	assert.Regexp(t, `(?m)^happo_agent_metric_buffer_oldest_timestamp_seconds [1-9]`, body)
+	assert.Regexp(t, `(?m)^happo_agent_metric_buffer_size_bytes [1-9]`, body)
+	assert.NotContains(t, body, "happo_agent_metric_buffer_length")
+	assert.NotContains(t, body, "happo_agent_collected_metric")
+
+	PrometheusExposeCollectedMetrics = true
+	defer func() { PrometheusExposeCollectedMetrics = false }()
+	res = httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+	assert.Contains(t, res.Body.String(),
+		`happo_agent_collected_metric{hostname="host\"1",name="linux.loadavg.load_avg_one"} 0.05 1505180794000`+"\n")
+	// series which differ only in tags are kept separately
+	assert.Contains(t, res.Body.String(),
+		`happo_agent_collected_metric{hostname="host2",name="app.requests",tag_name="x",role="db"} 2 1505180794000`+"\n")
+	assert.Contains(t, res.Body.String(),
+		`happo_agent_collected_metric{hostname="host2",name="app.requests",dc_name="tokyo",role="web"} 1 1505180794000`+"\n")
+	// buffer is not drained
+	assert.Regexp(t, `(?m)^happo_agent_metric_buffer_oldest_timestamp_seconds [1-9]`, res.Body.String())
+}
+
+func TestWritePrometheusSample1(t *testing.T) {
+	var buf bytes.Buffer
+	writePrometheusSample(&buf, "test_metric", nil, 1.5, 0)
+	writePrometheusSample(&buf, "test_metric", []prometheusLabel{{"a", "x\\y\nz"}, {"b", "2"}}, 3, 1000)
+	assert.Equal(t, "test_metric 1.5\ntest_metric{a=\"x\\\\y\\nz\",b=\"2\"} 3 1000\n", buf.String())
+}
@@ -2,41 +2,53 @@ package model
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/codegangsta/martini-contrib/render"
 	"github.com/heartbeatsjp/happo-agent/halib"
 	"github.com/heartbeatsjp/happo-agent/util"
 )
 
 // --- Global Variables
-// See http://golang.org/pkg/net/http/#Client
-var tr = &http.Transport{
-	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-}
-var _httpClient = &http.Client{Transport: tr}
+// _httpClient is client to next happo-agent. certificate chain is verified by system CA without hostname (agents are called by ip address).
+// replaced by SetProxyHTTPClient
+var _httpClient, _ = util.NewHTTPClient(util.HTTPClientConfig{SkipHostnameVerify: true})
+
+// proxyResponseHeaders are headers of next happo-agent passed to client
+var proxyResponseHeaders = []string{"Content-Type", "Content-Encoding", halib.HeaderMetricLeaseID}
+
+// proxyRequestHeaders are headers of client passed to next happo-agent (format negotiation and compression of /metric)
+var proxyRequestHeaders = []string{"Accept", "Accept-Encoding"}
 
-// Proxy do http reqest to next happo-agent
-func Proxy(proxyRequest halib.ProxyRequest, r render.Render) (int, string) {
+// Proxy do http reqest to next happo-agent. response is streamed with headers and trailers, so that /metric streaming works through proxy
+func Proxy(proxyRequest halib.ProxyRequest, res http.ResponseWriter, req *http.Request) {
 	var nextHostport string
 	var requestType string
 	var requestJSON []byte
 	var err error
+	log := util.HappoAgentLogger()
 
 	nextHostport = proxyRequest.ProxyHostPort[0]
+	if proxyRequest.APIKey == "" {
+		// passed by header or query string
+		proxyRequest.APIKey = util.APIKeyFromRequest(req)
+	}
+	// stream of /metric may be longer than timeout
+	streamed := strings.Trim(proxyRequest.RequestType, "/") == "metric"
 
 	if len(proxyRequest.ProxyHostPort) == 1 {
 		// last proxy
 		requestType = proxyRequest.RequestType
-		requestJSON = proxyRequest.RequestJSON
+		requestJSON = passThroughAPIKey(proxyRequest.RequestJSON, proxyRequest.APIKey)
 	} else {
 		// more proxies
 		proxyRequest.ProxyHostPort = proxyRequest.ProxyHostPort[1:]
@@ -52,47 +64,199 @@ func Proxy(proxyRequest halib.ProxyRequest, r render.Render) (int, string) {
 			nextPort = halib.DefaultAgentPort
 		}
 	}
-	respCode, response, err := postToAgent(nextHost, nextPort, requestType, requestJSON)
+	resp, err := requestToAgent(nextHost, nextPort, requestType, requestJSON, req.Header, streamed)
 	if err != nil {
 		var monitorResponse halib.MonitorResponse
 		monitorResponse.ReturnValue = halib.MonitorUnknown
 		monitorResponse.Message = err.Error()
 		errJSONData, _ := json.Marshal(monitorResponse)
-		response = string(errJSONData[:])
+		res.WriteHeader(agentErrorStatus(resp, err))
+		res.Write(errJSONData)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, name := range proxyResponseHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			res.Header().Set(name, value)
+		}
+	}
+	for name := range resp.Trailer {
+		res.Header().Add("Trailer", name)
+	}
+	util.ExtendWriteDeadline(req, StreamWriteTimeout)
+	res.WriteHeader(resp.StatusCode)
+
+	flusher, _ := res.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err = res.Write(buf[:n]); err != nil {
+				log.Errorf("proxy response aborted: %s", err.Error())
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			util.ExtendWriteDeadline(req, StreamWriteTimeout)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			// client can detect incomplete response by missing trailer
+			log.Errorf("proxy response aborted: %s", readErr.Error())
+			return
+		}
 	}
+	for name, values := range resp.Trailer {
+		for _, value := range values {
+			res.Header().Add(name, value)
+		}
+	}
+}
 
-	return respCode, response
+// passThroughAPIKey set apikey to request json when request json has no apikey
+func passThroughAPIKey(requestJSON []byte, apiKey string) []byte {
+	if apiKey == "" {
+		return requestJSON
+	}
+	var request map[string]interface{}
+	err := json.Unmarshal(requestJSON, &request)
+	if err != nil {
+		return requestJSON
+	}
+	if key, ok := request["apikey"].(string); ok && key != "" {
+		return requestJSON
+	}
+	request["apikey"] = apiKey
+	data, err := json.Marshal(request)
+	if err != nil {
+		return requestJSON
+	}
+	return data
 }
 
 func postToAgent(host string, port int, requestType string, jsonData []byte) (int, string, error) {
+	resp, err := requestToAgent(host, port, requestType, jsonData, nil, false)
+	if err != nil {
+		return agentErrorStatus(resp, err), "", err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	if err != nil {
+		return http.StatusInternalServerError, "", err
+	}
+	return resp.StatusCode, string(body[:]), nil
+}
+
+// requestToAgent posts request to next happo-agent, and returns response before reading body. headers in proxyRequestHeaders are passed.
+// when streamed, timeout of client is applied to each read instead of whole request
+func requestToAgent(host string, port int, requestType string, jsonData []byte, header http.Header, streamed bool) (*http.Response, error) {
 	log := util.HappoAgentLogger()
 	uri := fmt.Sprintf("https://%s:%d/%s", host, port, requestType)
 	log.Printf("Proxy to: %s", uri)
 	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Content-Type", "application/json")
+	for _, name := range proxyRequestHeaders {
+		if value := header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	if !streamed || _httpClient.Timeout <= 0 {
+		return _httpClient.Do(req)
+	}
 
-	resp, err := _httpClient.Do(req)
+	client := *_httpClient
+	client.Timeout = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	body := &idleTimeoutBody{timeout: _httpClient.Timeout, cancel: cancel}
+	body.timer = time.AfterFunc(body.timeout, body.expire)
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		if errTimeout, ok := err.(net.Error); ok && errTimeout.Timeout() {
-			return http.StatusGatewayTimeout, "", errTimeout
+		body.Close()
+		if body.expired() {
+			return nil, &agentTimeoutError{fmt.Sprintf("Post %s: timeout exceeded while awaiting headers", uri)}
 		}
-		if resp != nil {
-			if resp.StatusCode == http.StatusInternalServerError || resp.StatusCode == 0 {
-				return http.StatusServiceUnavailable, "", err
-			}
-			return resp.StatusCode, "", err
+		return nil, err
+	}
+	body.ReadCloser = resp.Body
+	resp.Body = body
+	return resp, nil
+}
+
+// agentErrorStatus returns status code of failed request to next happo-agent
+func agentErrorStatus(resp *http.Response, err error) int {
+	if errTimeout, ok := err.(net.Error); ok && errTimeout.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	if resp != nil {
+		if resp.StatusCode == http.StatusInternalServerError || resp.StatusCode == 0 {
+			return http.StatusServiceUnavailable
 		}
-		return http.StatusInternalServerError, "", err
+		return resp.StatusCode
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
-	if err != nil {
-		return http.StatusInternalServerError, "", err
+	return http.StatusInternalServerError
+}
+
+// idleTimeoutBody cancels request when no data is read in timeout
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  func()
+	mu      sync.Mutex
+	fired   bool
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
 	}
-	return resp.StatusCode, string(body[:]), nil
+	if err != nil && err != io.EOF && b.expired() {
+		return n, &agentTimeoutError{"timeout exceeded while reading body"}
+	}
+	return n, err
 }
 
-// SetProxyTimeout set timeout of _httpClient
-func SetProxyTimeout(timeoutSeconds int64) {
-	_httpClient.Timeout = time.Duration(timeoutSeconds) * time.Second
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	if b.ReadCloser == nil {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+func (b *idleTimeoutBody) expire() {
+	b.mu.Lock()
+	b.fired = true
+	b.mu.Unlock()
+	b.cancel()
+}
+
+func (b *idleTimeoutBody) expired() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.fired
+}
+
+// agentTimeoutError is timeout of streamed request (net.Error)
+type agentTimeoutError struct {
+	message string
+}
+
+func (e *agentTimeoutError) Error() string   { return e.message }
+func (e *agentTimeoutError) Timeout() bool   { return true }
+func (e *agentTimeoutError) Temporary() bool { return true }
+
+// SetProxyHTTPClient set client to next happo-agent (util.NewHTTPClient)
+func SetProxyHTTPClient(client *http.Client) {
+	_httpClient = client
 }
@@ -2,7 +2,9 @@ package model
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -14,10 +16,20 @@ import (
 	"github.com/codegangsta/martini-contrib/render"
 	"github.com/go-martini/martini"
 	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/heartbeatsjp/happo-agent/util"
 	"github.com/martini-contrib/binding"
 	"github.com/stretchr/testify/assert"
 )
 
+// pinTestServer makes _httpClient accept self signed certificate of ts
+func pinTestServer(t *testing.T, ts *httptest.Server) func() {
+	client, err := util.NewHTTPClient(util.HTTPClientConfig{Fingerprints: []string{util.CertificateFingerprint(ts.Certificate().Raw)}})
+	assert.Nil(t, err)
+	prevClient := _httpClient
+	_httpClient = client
+	return func() { _httpClient = prevClient }
+}
+
 func TestPostToAgent1(t *testing.T) {
 	const stubResponse = "OK"
 
@@ -27,6 +39,7 @@ func TestPostToAgent1(t *testing.T) {
 				fmt.Fprintln(w, stubResponse)
 			}))
 	defer ts.Close()
+	defer pinTestServer(t, ts)()
 	re, _ := regexp.Compile("([a-z]+)://([A-Za-z0-9.]+):([0-9]+)(.*)")
 	found := re.FindStringSubmatch(ts.URL)
 	host := found[2]
@@ -47,6 +60,7 @@ func TestPostToAgent2(t *testing.T) {
 				fmt.Fprintln(w, "will ignore(return will be blank)")
 			}))
 	defer ts.Close()
+	defer pinTestServer(t, ts)()
 
 	re, _ := regexp.Compile("([a-z]+)://([A-Za-z0-9.]+):([0-9]+)(.*)")
 	found := re.FindStringSubmatch(ts.URL)
@@ -74,6 +88,7 @@ func TestPostToAgent3(t *testing.T) {
 					fmt.Fprintln(w, "will ignore(return will be blank)")
 				}))
 		defer ts.Close()
+		defer pinTestServer(t, ts)()
 
 		re, _ := regexp.Compile("([a-z]+)://([A-Za-z0-9.]+):([0-9]+)(.*)")
 		found := re.FindStringSubmatch(ts.URL)
@@ -95,6 +110,7 @@ func TestPostToAgent4(t *testing.T) {
 				fmt.Fprint(w, "error response")
 			}))
 	defer ts.Close()
+	defer pinTestServer(t, ts)()
 
 	re, _ := regexp.Compile("([a-z]+)://([A-Za-z0-9.]+):([0-9]+)(.*)")
 	found := re.FindStringSubmatch(ts.URL)
@@ -107,6 +123,25 @@ func TestPostToAgent4(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestPostToAgent5(t *testing.T) {
+	// self signed certificate is not accepted by default
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "OK")
+			}))
+	defer ts.Close()
+
+	re, _ := regexp.Compile("([a-z]+)://([A-Za-z0-9.]+):([0-9]+)(.*)")
+	found := re.FindStringSubmatch(ts.URL)
+	host := found[2]
+	port, _ := strconv.Atoi(found[3])
+	statusCode, _, err := postToAgent(host, port, "test", []byte("{}"))
+
+	assert.EqualValues(t, http.StatusInternalServerError, statusCode)
+	assert.Contains(t, err.Error(), "certificate")
+}
+
 func TestProxy1(t *testing.T) {
 	//monitor ok
 
@@ -122,6 +157,7 @@ func TestProxy1(t *testing.T) {
 				fmt.Fprint(w, `{"return_value":0,"message":"ok"}`)
 			}))
 	defer ts.Close()
+	defer pinTestServer(t, ts)()
 
 	re, _ := regexp.Compile("([a-z]+)://([A-Za-z0-9.]+):([0-9]+)(.*)")
 	found := re.FindStringSubmatch(ts.URL)
@@ -166,6 +202,7 @@ func TestProxy2(t *testing.T) {
 				time.Sleep(1 * time.Second)
 			}))
 	defer ts.Close()
+	defer pinTestServer(t, ts)()
 
 	re, _ := regexp.Compile("([a-z]+)://([A-Za-z0-9.]+):([0-9]+)(.*)")
 	found := re.FindStringSubmatch(ts.URL)
@@ -216,6 +253,7 @@ func TestProxy3(t *testing.T) {
 				fmt.Fprint(w, `{"return_value":0,"message":"ok"}`)
 			}))
 	defer ts.Close()
+	defer pinTestServer(t, ts)()
 
 	re, _ := regexp.Compile("([a-z]+)://([A-Za-z0-9.]+):([0-9]+)(.*)")
 	found := re.FindStringSubmatch(ts.URL)
@@ -260,6 +298,7 @@ func TestProxy4(t *testing.T) {
 				time.Sleep(1 * time.Second)
 			}))
 	defer ts.Close()
+	defer pinTestServer(t, ts)()
 
 	re, _ := regexp.Compile("([a-z]+)://([A-Za-z0-9.]+):([0-9]+)(.*)")
 	found := re.FindStringSubmatch(ts.URL)
@@ -293,3 +332,145 @@ func TestProxy4(t *testing.T) {
 		res.Body.String(),
 	)
 }
+
+func TestProxy5(t *testing.T) {
+	//apikey in header is passed through. request_json is base64 of `{}`
+
+	//bastion
+	m := martini.Classic()
+	m.Use(render.Renderer())
+	m.Post("/proxy", binding.Json(halib.ProxyRequest{}), Proxy)
+
+	//edge
+	var path, body string
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				path, body = r.URL.Path, string(b)
+				fmt.Fprint(w, `{"status":"OK"}`)
+			}))
+	defer ts.Close()
+	defer pinTestServer(t, ts)()
+
+	requestJSON := fmt.Sprintf(`{"proxy_hostport": ["%s"], "request_type": "metric/config", "request_json": "e30="}`, ts.Listener.Addr().String())
+	req, _ := http.NewRequest("POST", "/proxy", bytes.NewReader([]byte(requestJSON)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(util.APIKeyHeader, "key1")
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "/metric/config", path)
+	assert.JSONEq(t, `{"apikey": "key1"}`, body)
+}
+
+func TestProxy6(t *testing.T) {
+	//metric stream is passed through with headers and trailers
+
+	//bastion
+	m := martini.Classic()
+	m.Post("/proxy", binding.Json(halib.ProxyRequest{}), Proxy)
+
+	//edge
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/metric", r.URL.Path)
+				assert.Equal(t, halib.ContentTypeNDJSON, r.Header.Get("Accept"))
+				assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+				w.Header().Set("Content-Type", halib.ContentTypeNDJSON)
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Set(halib.HeaderMetricLeaseID, "lease1")
+				w.Header().Set("Trailer", halib.HeaderMetricHasMore)
+				gz := gzip.NewWriter(w)
+				for i := 0; i < 3; i++ {
+					fmt.Fprintf(gz, "{\"timestamp\":%d}\n", i)
+					gz.Flush()
+					w.(http.Flusher).Flush()
+					time.Sleep(50 * time.Millisecond)
+				}
+				gz.Close()
+				w.Header().Set(halib.HeaderMetricHasMore, "true")
+			}))
+	defer ts.Close()
+	defer pinTestServer(t, ts)()
+
+	// timeout is applied to each read
+	timeout := _httpClient.Timeout
+	_httpClient.Timeout = 100 * time.Millisecond
+	defer func() { _httpClient.Timeout = timeout }()
+
+	requestJSON := fmt.Sprintf(`{"proxy_hostport": ["%s"], "request_type": "metric", "request_json": "e30="}`, ts.Listener.Addr().String())
+	req, _ := http.NewRequest("POST", "/proxy", bytes.NewReader([]byte(requestJSON)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", halib.ContentTypeNDJSON)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	result := res.Result()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, halib.ContentTypeNDJSON, result.Header.Get("Content-Type"))
+	assert.Equal(t, "gzip", result.Header.Get("Content-Encoding"))
+	assert.Equal(t, "lease1", result.Header.Get(halib.HeaderMetricLeaseID))
+	assert.Equal(t, "true", result.Trailer.Get(halib.HeaderMetricHasMore))
+	gz, err := gzip.NewReader(result.Body)
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(gz)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"timestamp\":0}\n{\"timestamp\":1}\n{\"timestamp\":2}\n", string(body))
+}
+
+func TestProxy7(t *testing.T) {
+	//stalled metric stream is aborted
+
+	//bastion
+	m := martini.Classic()
+	m.Post("/proxy", binding.Json(halib.ProxyRequest{}), Proxy)
+
+	//edge
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Trailer", halib.HeaderMetricHasMore)
+				fmt.Fprint(w, "{\"timestamp\":0}\n")
+				w.(http.Flusher).Flush()
+				time.Sleep(500 * time.Millisecond)
+				fmt.Fprint(w, "{\"timestamp\":1}\n")
+				w.Header().Set(halib.HeaderMetricHasMore, "false")
+			}))
+	defer ts.Close()
+	defer pinTestServer(t, ts)()
+
+	timeout := _httpClient.Timeout
+	_httpClient.Timeout = 100 * time.Millisecond
+	defer func() { _httpClient.Timeout = timeout }()
+
+	requestJSON := fmt.Sprintf(`{"proxy_hostport": ["%s"], "request_type": "metric", "request_json": "e30="}`, ts.Listener.Addr().String())
+	req, _ := http.NewRequest("POST", "/proxy", bytes.NewReader([]byte(requestJSON)))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+
+	result := res.Result()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	body, _ := ioutil.ReadAll(result.Body)
+	assert.Equal(t, "{\"timestamp\":0}\n", string(body))
+	assert.Equal(t, "", result.Trailer.Get(halib.HeaderMetricHasMore))
+}
+
+func TestPassThroughAPIKey1(t *testing.T) {
+	assert.Equal(t,
+		`{"apikey":"key1","plugin_name":"check_procs"}`,
+		string(passThroughAPIKey([]byte(`{"apikey": "", "plugin_name": "check_procs"}`), "key1")))
+	assert.Equal(t,
+		`{"apikey":"key1","plugin_name":"check_procs"}`,
+		string(passThroughAPIKey([]byte(`{"plugin_name": "check_procs"}`), "key1")))
+	assert.Equal(t,
+		`{"apikey": "key2", "plugin_name": "check_procs"}`,
+		string(passThroughAPIKey([]byte(`{"apikey": "key2", "plugin_name": "check_procs"}`), "key1")))
+	assert.Equal(t,
+		`{"apikey": "", "plugin_name": "check_procs"}`,
+		string(passThroughAPIKey([]byte(`{"apikey": "", "plugin_name": "check_procs"}`), "")))
+}
@@ -16,6 +16,8 @@ import (
 var (
 	// AppVersion equals main.Version
 	AppVersion string
+	// ListenerCertificates are TLS keypairs of listener
+	ListenerCertificates *util.CertificateLoader
 
 	startAt = time.Now()
 )
@@ -68,6 +70,14 @@ func Status(req *http.Request, r render.Render) {
 		MetricBufferStatus: collect.GetMetricDataBufferStatus(false),
 		Callers:            callers,
 		LevelDBProperties:  leveldbProperties,
+		MetricPlugins:      collect.GetMetricPluginStatus(),
+	}
+	if collect.ActiveMetricConfig != nil {
+		metricConfigStatus := collect.ActiveMetricConfig.Status()
+		statusResponse.MetricConfig = &metricConfigStatus
+	}
+	if ListenerCertificates != nil {
+		statusResponse.Certificates = ListenerCertificates.Status()
 	}
 	r.JSON(http.StatusOK, statusResponse)
 }
@@ -0,0 +1,206 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// ErrAPIKeyRequired shows apikey is not specified
+	ErrAPIKeyRequired = errors.New("apikey is required")
+	// ErrAPIKeyInvalid shows apikey is unknown or expired
+	ErrAPIKeyInvalid = errors.New("apikey is invalid")
+	// ErrAPIKeyOutOfScope shows apikey is not permitted for the request
+	ErrAPIKeyOutOfScope = errors.New("apikey is not permitted for this request")
+)
+
+// APIKeyHeader is http header of apikey, for request without json body (e.g. GET /metric/config)
+const APIKeyHeader = "X-Api-Key"
+
+// APIKey is an api key and its permissions
+type APIKey struct {
+	Key       string
+	Scopes    []string
+	ExpiresAt time.Time // zero means never expire
+}
+
+// APIKeyStore holds api keys. when it has no key, apikey is not checked
+type APIKeyStore struct {
+	keys map[string]APIKey
+}
+
+// NewAPIKeyStore returns new APIKeyStore
+func NewAPIKeyStore() *APIKeyStore {
+	return &APIKeyStore{keys: map[string]APIKey{}}
+}
+
+// LoadAPIKeyStore build APIKeyStore from key file and key definitions
+//
+// key definition format is `<key>:<scope>[+<scope>...][:<expires_at(RFC3339)>]`
+func LoadAPIKeyStore(keyFile string, keyDefinitions []string) (*APIKeyStore, error) {
+	store := NewAPIKeyStore()
+
+	if keyFile != "" {
+		buf, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		var config halib.APIKeyConfig
+		err = yaml.Unmarshal(buf, &config)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range config.APIKeys {
+			err = store.Add(k.Key, k.Scopes, k.ExpiresAt)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, definition := range keyDefinitions {
+		if definition == "" {
+			continue
+		}
+		items := strings.SplitN(definition, ":", 3)
+		if len(items) < 2 {
+			return nil, fmt.Errorf("apikey definition format error: %s", definition)
+		}
+		expiresAt := ""
+		if len(items) == 3 {
+			expiresAt = items[2]
+		}
+		err := store.Add(items[0], strings.Split(items[1], "+"), expiresAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// Add add api key to store. expiresAt is RFC3339 format or blank(never expire)
+func (s *APIKeyStore) Add(key string, scopes []string, expiresAt string) error {
+	if key == "" {
+		return errors.New("apikey is blank")
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case halib.APIKeyScopeMonitor, halib.APIKeyScopeMetric, halib.APIKeyScopeInventory, halib.APIKeyScopeConfig:
+		default:
+			return fmt.Errorf("unknown apikey scope: %s", scope)
+		}
+	}
+	apiKey := APIKey{Key: key, Scopes: scopes}
+	if expiresAt != "" {
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return err
+		}
+		apiKey.ExpiresAt = t
+	}
+	s.keys[key] = apiKey
+	return nil
+}
+
+// Enabled returns whether apikey check is enabled
+func (s *APIKeyStore) Enabled() bool {
+	return s != nil && len(s.keys) > 0
+}
+
+// Authorize check key is valid for scope at now
+func (s *APIKeyStore) Authorize(key string, scope string, now time.Time) error {
+	if !s.Enabled() {
+		return nil
+	}
+	if key == "" {
+		return ErrAPIKeyRequired
+	}
+	apiKey, ok := s.keys[key]
+	if !ok {
+		return ErrAPIKeyInvalid
+	}
+	if !apiKey.ExpiresAt.IsZero() && now.After(apiKey.ExpiresAt) {
+		return ErrAPIKeyInvalid
+	}
+	for _, permitted := range apiKey.Scopes {
+		if permitted == scope {
+			return nil
+		}
+	}
+	return ErrAPIKeyOutOfScope
+}
+
+// APIKeyFromRequest returns apikey in X-Api-Key header or `apikey` query string
+func APIKeyFromRequest(req *http.Request) string {
+	if key := req.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+	return req.URL.Query().Get("apikey")
+}
+
+// RequestURIWithoutAPIKey returns request uri to be logged. apikey in query string is masked
+func RequestURIWithoutAPIKey(req *http.Request) string {
+	query := req.URL.Query()
+	if query.Get("apikey") == "" {
+		return req.RequestURI
+	}
+	query.Set("apikey", "xxx")
+	return req.URL.Path + "?" + query.Encode()
+}
+
+// APIKeyScopeForRequestType returns required scope of request type (used by /proxy). every POST API with apikey must be here,
+// unknown request type is not permitted for any key
+func APIKeyScopeForRequestType(requestType string) string {
+	switch strings.Trim(requestType, "/") {
+	case "monitor":
+		return halib.APIKeyScopeMonitor
+	case "metric", "metric/ack", "metric/append":
+		return halib.APIKeyScopeMetric
+	case "inventory":
+		return halib.APIKeyScopeInventory
+	case "metric/config", "metric/config/update", "metric/config/rollback":
+		return halib.APIKeyScopeConfig
+	}
+	return ""
+}
+
+// APIKeyAuth implements apikey check. must be placed after binding.Json(obj, (*halib.APIKeyHolder)(nil)).
+// when json has no apikey, APIKeyFromRequest is used
+func APIKeyAuth(store *APIKeyStore, scope string) martini.Handler {
+	return func(holder halib.APIKeyHolder, res http.ResponseWriter, req *http.Request) {
+		requiredScope := scope
+		if proxyRequest, ok := holder.(halib.ProxyRequest); ok {
+			requiredScope = APIKeyScopeForRequestType(proxyRequest.RequestType)
+		}
+
+		key := holder.GetAPIKey()
+		if key == "" {
+			key = APIKeyFromRequest(req)
+		}
+		err := store.Authorize(key, requiredScope, time.Now())
+		if err == nil {
+			return
+		}
+
+		HappoAgentLogger().WithField("RemoteAddr", req.RemoteAddr).Errorf("API Key Denied: %s %s", RequestURIWithoutAPIKey(req), err.Error())
+		status := http.StatusUnauthorized
+		if err == ErrAPIKeyOutOfScope {
+			status = http.StatusForbidden
+		}
+		body, _ := json.Marshal(halib.ErrorResponse{Status: "error", Message: err.Error()})
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(status)
+		res.Write(body)
+	}
+}
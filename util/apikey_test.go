@@ -0,0 +1,166 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/heartbeatsjp/happo-agent/halib"
+	"github.com/martini-contrib/binding"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAPIKeyStore1(t *testing.T) {
+	f, err := ioutil.TempFile("", "apikey")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`api_keys:
+- key: filekey
+  scopes: [monitor, metric]
+- key: expiredkey
+  scopes: [monitor]
+  expires_at: "2017-01-01T00:00:00Z"
+`)
+	f.Close()
+
+	store, err := LoadAPIKeyStore(f.Name(), []string{"envkey:inventory+config:2030-01-01T00:00:00+09:00", ""})
+	assert.Nil(t, err)
+	assert.True(t, store.Enabled())
+
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, store.Authorize("filekey", halib.APIKeyScopeMonitor, now))
+	assert.Nil(t, store.Authorize("filekey", halib.APIKeyScopeMetric, now))
+	assert.Equal(t, ErrAPIKeyOutOfScope, store.Authorize("filekey", halib.APIKeyScopeConfig, now))
+	assert.Equal(t, ErrAPIKeyInvalid, store.Authorize("expiredkey", halib.APIKeyScopeMonitor, now))
+	assert.Nil(t, store.Authorize("envkey", halib.APIKeyScopeConfig, now))
+	assert.Equal(t, ErrAPIKeyInvalid, store.Authorize("envkey", halib.APIKeyScopeConfig, now.AddDate(20, 0, 0)))
+	assert.Equal(t, ErrAPIKeyInvalid, store.Authorize("wrongkey", halib.APIKeyScopeMonitor, now))
+	assert.Equal(t, ErrAPIKeyRequired, store.Authorize("", halib.APIKeyScopeMonitor, now))
+}
+
+func TestLoadAPIKeyStore2(t *testing.T) {
+	_, err := LoadAPIKeyStore("", []string{"envkey"})
+	assert.NotNil(t, err)
+
+	_, err = LoadAPIKeyStore("", []string{"envkey:unknown"})
+	assert.NotNil(t, err)
+
+	_, err = LoadAPIKeyStore("", []string{"envkey:monitor:tomorrow"})
+	assert.NotNil(t, err)
+
+	store, err := LoadAPIKeyStore("", []string{})
+	assert.Nil(t, err)
+	assert.False(t, store.Enabled())
+	assert.Nil(t, store.Authorize("", halib.APIKeyScopeMonitor, time.Now()))
+}
+
+func TestAPIKeyScopeForRequestType1(t *testing.T) {
+	assert.Equal(t, halib.APIKeyScopeMonitor, APIKeyScopeForRequestType("monitor"))
+	assert.Equal(t, halib.APIKeyScopeMetric, APIKeyScopeForRequestType("metric/append"))
+	assert.Equal(t, halib.APIKeyScopeMetric, APIKeyScopeForRequestType("/metric/ack"))
+	assert.Equal(t, halib.APIKeyScopeInventory, APIKeyScopeForRequestType("/inventory"))
+	assert.Equal(t, halib.APIKeyScopeConfig, APIKeyScopeForRequestType("metric/config/update"))
+	assert.Equal(t, halib.APIKeyScopeConfig, APIKeyScopeForRequestType("metric/config/rollback"))
+	assert.Equal(t, "", APIKeyScopeForRequestType("unknown"))
+
+	// every POST API with apikey
+	for requestType, scope := range map[string]string{
+		"monitor":                halib.APIKeyScopeMonitor,
+		"metric":                 halib.APIKeyScopeMetric,
+		"metric/ack":             halib.APIKeyScopeMetric,
+		"metric/append":          halib.APIKeyScopeMetric,
+		"inventory":              halib.APIKeyScopeInventory,
+		"metric/config":          halib.APIKeyScopeConfig,
+		"metric/config/update":   halib.APIKeyScopeConfig,
+		"metric/config/rollback": halib.APIKeyScopeConfig,
+	} {
+		assert.Equal(t, scope, APIKeyScopeForRequestType(requestType), requestType)
+	}
+}
+
+func TestRequestURIWithoutAPIKey1(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/metric/config?apikey=secret&a=1", nil)
+	req.RequestURI = "/metric/config?apikey=secret&a=1"
+	assert.Equal(t, "/metric/config?a=1&apikey=xxx", RequestURIWithoutAPIKey(req))
+	req, _ = http.NewRequest("GET", "/metric/config?a=1", nil)
+	req.RequestURI = "/metric/config?a=1"
+	assert.Equal(t, "/metric/config?a=1", RequestURIWithoutAPIKey(req))
+}
+
+func TestAPIKeyAuth1(t *testing.T) {
+	store, _ := LoadAPIKeyStore("", []string{"monitorkey:monitor", "metrickey:metric"})
+
+	m := martini.Classic()
+	m.Post("/monitor",
+		binding.Json(halib.MonitorRequest{}, (*halib.APIKeyHolder)(nil)),
+		APIKeyAuth(store, halib.APIKeyScopeMonitor),
+		func() string { return "success" })
+	m.Post("/proxy",
+		binding.Json(halib.ProxyRequest{}, (*halib.APIKeyHolder)(nil)),
+		APIKeyAuth(store, ""),
+		func() string { return "success" })
+
+	cases := []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/monitor", `{"apikey": "monitorkey", "plugin_name": "check"}`, http.StatusOK},
+		{"/monitor", `{"apikey": "", "plugin_name": "check"}`, http.StatusUnauthorized},
+		{"/monitor", `{"apikey": "wrongkey", "plugin_name": "check"}`, http.StatusUnauthorized},
+		{"/monitor", `{"apikey": "metrickey", "plugin_name": "check"}`, http.StatusForbidden},
+		{"/proxy", `{"apikey": "metrickey", "proxy_hostport": ["192.0.2.1"], "request_type": "metric"}`, http.StatusOK},
+		{"/proxy", `{"apikey": "metrickey", "proxy_hostport": ["192.0.2.1"], "request_type": "monitor"}`, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", c.path, bytes.NewReader([]byte(c.body)))
+		req.Header.Set("Content-Type", "application/json")
+		m.ServeHTTP(res, req)
+		assert.Equal(t, c.status, res.Code, c.body)
+		if c.status != http.StatusOK {
+			assert.Contains(t, res.Body.String(), `"status":"error"`)
+		}
+	}
+}
+
+func TestAPIKeyAuth2(t *testing.T) {
+	store, _ := LoadAPIKeyStore("", []string{"configkey:config", "metrickey:metric"})
+
+	m := martini.Classic()
+	m.Get("/metric/config",
+		binding.Json(halib.MetricConfigRequest{}, (*halib.APIKeyHolder)(nil)),
+		APIKeyAuth(store, halib.APIKeyScopeConfig),
+		func() string { return "success" })
+
+	cases := []struct {
+		url    string
+		header string
+		body   string
+		status int
+	}{
+		{"/metric/config", "", `{"apikey": "configkey"}`, http.StatusOK},
+		{"/metric/config", "configkey", "", http.StatusOK},
+		{"/metric/config?apikey=configkey", "", "", http.StatusOK},
+		{"/metric/config", "metrickey", "", http.StatusForbidden},
+		{"/metric/config?apikey=wrongkey", "", "", http.StatusUnauthorized},
+		{"/metric/config", "", "", http.StatusUnauthorized},
+		// json has priority
+		{"/metric/config", "configkey", `{"apikey": "metrickey"}`, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", c.url, bytes.NewReader([]byte(c.body)))
+		if c.header != "" {
+			req.Header.Set(APIKeyHeader, c.header)
+		}
+		m.ServeHTTP(res, req)
+		assert.Equal(t, c.status, res.Code, c.url+" "+c.header+" "+c.body)
+	}
+}
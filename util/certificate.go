@@ -0,0 +1,217 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// --- Struct
+
+// CertificateLoader keeps TLS keypairs of listener, and serves them by GetCertificate.
+// on reload error, last good keypair is kept and error is recorded
+type CertificateLoader struct {
+	pairs []*certificatePair
+	mu    sync.RWMutex
+}
+
+type certificatePair struct {
+	certFile string
+	keyFile  string
+
+	cert      *tls.Certificate
+	modTimes  []time.Time
+	loadedAt  time.Time
+	lastError error
+	errorAt   time.Time
+}
+
+// ecdsaSignatureSchemes are signature schemes of ECDSA certificate
+var ecdsaSignatureSchemes = map[tls.SignatureScheme]bool{
+	tls.ECDSAWithP256AndSHA256: true,
+	tls.ECDSAWithP384AndSHA384: true,
+	tls.ECDSAWithP521AndSHA512: true,
+}
+
+// --- Method
+
+// NewCertificateLoader returns CertificateLoader of keypairs (certificate file, private key file, ...). keypairs are empty until Reload succeeded
+func NewCertificateLoader(files ...string) *CertificateLoader {
+	l := &CertificateLoader{}
+	for i := 0; i+1 < len(files); i += 2 {
+		l.pairs = append(l.pairs, &certificatePair{certFile: files[i], keyFile: files[i+1]})
+	}
+	return l
+}
+
+// Reload reads keypairs. keypair which failed to load keeps last good one
+func (l *CertificateLoader) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	log := HappoAgentLogger()
+	var failures []string
+	for _, pair := range l.pairs {
+		modTimes := pair.stat()
+		cert, err := tls.LoadX509KeyPair(pair.certFile, pair.keyFile)
+		if err == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if err != nil {
+			pair.lastError = err
+			pair.errorAt = time.Now()
+			pair.modTimes = modTimes // not retried until modified again
+			failures = append(failures, fmt.Sprintf("%s: %s", pair.certFile, err.Error()))
+			continue
+		}
+		if pair.cert != nil {
+			log.Infof("certificate reloaded: %s (expires at %s)", pair.certFile, cert.Leaf.NotAfter.Format(time.RFC3339))
+		}
+		pair.cert = &cert
+		pair.modTimes = modTimes
+		pair.loadedAt = time.Now()
+		pair.lastError = nil
+	}
+	if len(failures) > 0 {
+		err := errors.New(strings.Join(failures, ", "))
+		log.Errorf("certificate reload failed: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// Watch reloads keypairs every interval when modified, until stop is closed
+func (l *CertificateLoader) Watch(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if l.changed() {
+			l.Reload()
+		}
+	}
+}
+
+// changed returns true when modification time of files differs from last Reload
+func (l *CertificateLoader) changed() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, pair := range l.pairs {
+		modTimes := pair.stat()
+		for i := range modTimes {
+			if i >= len(pair.modTimes) || !modTimes[i].Equal(pair.modTimes[i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *certificatePair) stat() []time.Time {
+	modTimes := make([]time.Time, 2)
+	for i, file := range []string{p.certFile, p.keyFile} {
+		if fi, err := os.Stat(file); err == nil {
+			modTimes[i] = fi.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// GetCertificate implements tls.Config.GetCertificate. when both of ECDSA and RSA keypairs are loaded,
+// ECDSA one is returned to client which supports it
+func (l *CertificateLoader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var first, ecdsaCert, otherCert *tls.Certificate
+	for _, pair := range l.pairs {
+		if pair.cert == nil {
+			continue
+		}
+		if first == nil {
+			first = pair.cert
+		}
+		if _, ok := pair.cert.PrivateKey.(*ecdsa.PrivateKey); ok {
+			if ecdsaCert == nil {
+				ecdsaCert = pair.cert
+			}
+		} else if otherCert == nil {
+			otherCert = pair.cert
+		}
+	}
+	if first == nil {
+		return nil, errors.New("no certificate loaded")
+	}
+	if ecdsaCert != nil && otherCert != nil {
+		if supportsECDSA(hello) {
+			return ecdsaCert, nil
+		}
+		return otherCert, nil
+	}
+	return first, nil
+}
+
+// supportsECDSA returns whether client accepts ECDSA certificate
+func supportsECDSA(hello *tls.ClientHelloInfo) bool {
+	if len(hello.SignatureSchemes) > 0 {
+		supported := false
+		for _, scheme := range hello.SignatureSchemes {
+			supported = supported || ecdsaSignatureSchemes[scheme]
+		}
+		if !supported {
+			return false
+		}
+	}
+	for _, version := range hello.SupportedVersions {
+		if version == versionTLS13 {
+			// cipher suites of TLS 1.3 do not depend on certificate
+			return true
+		}
+	}
+	for _, suite := range hello.CipherSuites {
+		for name, id := range cipherSuites {
+			if id == suite && strings.Contains(name, "_ECDSA_") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Status returns load status of each certificate
+func (l *CertificateLoader) Status() []halib.CertificateStatus {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	statuses := make([]halib.CertificateStatus, 0, len(l.pairs))
+	for _, pair := range l.pairs {
+		status := halib.CertificateStatus{Path: pair.certFile}
+		if pair.cert != nil {
+			status.Subject = pair.cert.Leaf.Subject.CommonName
+			status.KeyType = "RSA"
+			if _, ok := pair.cert.PrivateKey.(*ecdsa.PrivateKey); ok {
+				status.KeyType = "ECDSA"
+			}
+			status.NotAfter = pair.cert.Leaf.NotAfter.Unix()
+			status.LoadedAt = pair.loadedAt.Unix()
+		}
+		if pair.lastError != nil {
+			status.LastError = pair.lastError.Error()
+			status.LastErrorAt = pair.errorAt.Unix()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,145 @@
+package util
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestKeyPair writes self-signed keypair to <dir>/<name>.pub and <dir>/<name>.key
+func writeTestKeyPair(t *testing.T, dir, name, commonName string, useRSA bool) (string, string) {
+	var certDER []byte
+	var keyBlock *pem.Block
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if useRSA {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.Nil(t, err)
+		certDER, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		assert.Nil(t, err)
+		keyBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	} else {
+		_, key := createTestCertificate(t, commonName, nil, nil)
+		var err error
+		certDER, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		assert.Nil(t, err)
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		assert.Nil(t, err)
+		keyBlock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}
+	}
+
+	certFile := filepath.Join(dir, name+".pub")
+	keyFile := filepath.Join(dir, name+".key")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(keyBlock), 0600))
+	return certFile, keyFile
+}
+
+func TestCertificateLoader1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	rsaCert, rsaKey := writeTestKeyPair(t, dir, "rsa", "rsa01", true)
+	ecdsaCert, ecdsaKey := writeTestKeyPair(t, dir, "ecdsa", "ecdsa01", false)
+
+	loader := NewCertificateLoader(rsaCert, rsaKey, ecdsaCert, ecdsaKey)
+	_, err = loader.GetCertificate(&tls.ClientHelloInfo{})
+	assert.NotNil(t, err)
+	assert.Nil(t, loader.Reload())
+
+	// ECDSA is served to client which supports it
+	cert, err := loader.GetCertificate(&tls.ClientHelloInfo{
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PKCS1WithSHA256},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "ecdsa01", cert.Leaf.Subject.CommonName)
+
+	cert, err = loader.GetCertificate(&tls.ClientHelloInfo{
+		CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PKCS1WithSHA256},
+		SupportedVersions: []uint16{0x0304, tls.VersionTLS12},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "ecdsa01", cert.Leaf.Subject.CommonName)
+
+	// RSA otherwise
+	cert, err = loader.GetCertificate(&tls.ClientHelloInfo{
+		CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PKCS1WithSHA256},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "rsa01", cert.Leaf.Subject.CommonName)
+
+	cert, err = loader.GetCertificate(&tls.ClientHelloInfo{
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes:  []tls.SignatureScheme{tls.PKCS1WithSHA256},
+		SupportedVersions: []uint16{0x0304},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "rsa01", cert.Leaf.Subject.CommonName)
+
+	statuses := loader.Status()
+	assert.Equal(t, 2, len(statuses))
+	assert.Equal(t, rsaCert, statuses[0].Path)
+	assert.Equal(t, "rsa01", statuses[0].Subject)
+	assert.Equal(t, "RSA", statuses[0].KeyType)
+	assert.Equal(t, "ECDSA", statuses[1].KeyType)
+	assert.True(t, statuses[1].NotAfter > time.Now().Unix())
+	assert.Equal(t, "", statuses[1].LastError)
+}
+
+func TestCertificateLoader2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestKeyPair(t, dir, "agent", "agent01", false)
+	loader := NewCertificateLoader(certFile, keyFile)
+	assert.Nil(t, loader.Reload())
+	assert.False(t, loader.changed())
+
+	// renewed
+	writeTestKeyPair(t, dir, "agent", "agent02", false)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	assert.True(t, loader.changed())
+	assert.Nil(t, loader.Reload())
+	assert.False(t, loader.changed())
+	cert, err := loader.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, "agent02", cert.Leaf.Subject.CommonName)
+
+	// broken file keeps last good keypair
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("broken"), 0600))
+	future = future.Add(time.Minute)
+	os.Chtimes(keyFile, future, future)
+	assert.True(t, loader.changed())
+	assert.NotNil(t, loader.Reload())
+	assert.False(t, loader.changed())
+	cert, err = loader.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, "agent02", cert.Leaf.Subject.CommonName)
+	statuses := loader.Status()
+	assert.Equal(t, "agent02", statuses[0].Subject)
+	assert.NotEqual(t, "", statuses[0].LastError)
+	assert.NotEqual(t, int64(0), statuses[0].LastErrorAt)
+}
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"path"
+	"sync"
+	"time"
+)
+
+// ExecStat is cumulative statistics of command execution
+type ExecStat struct {
+	Count           uint64
+	Timeouts        uint64
+	DurationSeconds float64
+}
+
+var execStats = struct {
+	sync.Mutex
+	stats map[string]ExecStat
+}{stats: map[string]ExecStat{}}
+
+// recordExecStat records command execution. command is recorded by base name
+func recordExecStat(command string, duration time.Duration, timedOut bool) {
+	execStats.Lock()
+	defer execStats.Unlock()
+
+	name := path.Base(command)
+	stat := execStats.stats[name]
+	stat.Count++
+	if timedOut {
+		stat.Timeouts++
+	}
+	stat.DurationSeconds += duration.Seconds()
+	execStats.stats[name] = stat
+}
+
+// GetExecStats returns copy of command execution statistics. key is command base name
+func GetExecStats() map[string]ExecStat {
+	execStats.Lock()
+	defer execStats.Unlock()
+
+	stats := make(map[string]ExecStat, len(execStats.stats))
+	for name, stat := range execStats.stats {
+		stats[name] = stat
+	}
+	return stats
+}
@@ -0,0 +1,155 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+)
+
+// HTTPClientConfig is config of outbound http client. zero value verifies peer certificate and hostname by system CA
+type HTTPClientConfig struct {
+	// CAFile is CA bundle to verify peer certificate. when blank, system CA is used
+	CAFile string
+	// Fingerprints are SHA-256 fingerprints of pinned peer certificates (hex, `:` is optional). when set, CA is not used
+	Fingerprints []string
+	// SkipHostnameVerify verifies certificate chain only (for happo-agent, which is called by ip address)
+	SkipHostnameVerify bool
+	// InsecureSkipVerify disables peer certificate verification
+	InsecureSkipVerify bool
+	// CertFile and KeyFile are client certificate
+	CertFile string
+	KeyFile  string
+
+	// Timeout is whole request timeout. 0 means no timeout
+	Timeout time.Duration
+	// IdleConnTimeout is keep-alive timeout of idle connection. 0 means DefaultHTTPClientIdleConnTimeoutSeconds
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost is max idle (keep-alive) connections per host. 0 means http.DefaultMaxIdleConnsPerHost
+	MaxIdleConnsPerHost int
+	DisableKeepAlives   bool
+	// UseProxyEnv uses HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	UseProxyEnv bool
+}
+
+// NewHTTPClient returns http.Client for outbound connection
+func NewHTTPClient(config HTTPClientConfig) (*http.Client, error) {
+	tlsConfig, err := BuildHTTPClientTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	idleConnTimeout := config.IdleConnTimeout
+	if idleConnTimeout == 0 {
+		idleConnTimeout = halib.DefaultHTTPClientIdleConnTimeoutSeconds * time.Second
+	}
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   halib.DefaultHTTPClientDialTimeoutSeconds * time.Second,
+			KeepAlive: halib.DefaultHTTPClientDialTimeoutSeconds * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: halib.DefaultHTTPClientTLSHandshakeTimeoutSeconds * time.Second,
+		IdleConnTimeout:     idleConnTimeout,
+		MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		DisableKeepAlives:   config.DisableKeepAlives,
+	}
+	if config.UseProxyEnv {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	return &http.Client{Transport: transport, Timeout: config.Timeout}, nil
+}
+
+// BuildHTTPClientTLSConfig returns tls.Config of NewHTTPClient
+func BuildHTTPClientTLSConfig(config HTTPClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	switch {
+	case config.InsecureSkipVerify:
+		tlsConfig.InsecureSkipVerify = true
+	case len(config.Fingerprints) > 0:
+		fingerprints, err := parseFingerprints(config.Fingerprints)
+		if err != nil {
+			return nil, err
+		}
+		// verified in VerifyPeerFingerprint instead of default verification
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = VerifyPeerFingerprint(fingerprints)
+	default:
+		var pool *x509.CertPool
+		var err error
+		if config.CAFile != "" {
+			pool, err = LoadCertPool(config.CAFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if config.SkipHostnameVerify {
+			if pool == nil {
+				pool, err = x509.SystemCertPool()
+				if err != nil {
+					// no certificate is accepted
+					pool = x509.NewCertPool()
+				}
+			}
+			// chain is verified in VerifyPeerCertificate instead of default verification which requires hostname
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyPeerCertificate = VerifyPeerCertificate(pool, nil)
+		} else {
+			tlsConfig.RootCAs = pool
+		}
+	}
+
+	if config.CertFile != "" && config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// CertificateFingerprint returns SHA-256 fingerprint of DER encoded certificate (lower case hex, without `:`)
+func CertificateFingerprint(rawCert []byte) string {
+	sum := sha256.Sum256(rawCert)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyPeerFingerprint returns function for tls.Config.VerifyPeerCertificate, which accepts peer certificate in fingerprints
+func VerifyPeerFingerprint(fingerprints [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no peer certificate")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		for _, fingerprint := range fingerprints {
+			if bytes.Equal(sum[:], fingerprint) {
+				return nil
+			}
+		}
+		return fmt.Errorf("peer certificate fingerprint %s is not pinned", CertificateFingerprint(rawCerts[0]))
+	}
+}
+
+func parseFingerprints(fingerprints []string) ([][]byte, error) {
+	parsed := make([][]byte, 0, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		b, err := hex.DecodeString(strings.Replace(strings.TrimSpace(fingerprint), ":", "", -1))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 fingerprint: %q", fingerprint)
+		}
+		parsed = append(parsed, b)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,111 @@
+package util
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildHTTPClientTLSConfig1(t *testing.T) {
+	// verify by system CA, including hostname
+	tlsConfig, err := BuildHTTPClientTLSConfig(HTTPClientConfig{})
+	assert.Nil(t, err)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+	assert.Nil(t, tlsConfig.VerifyPeerCertificate)
+	assert.Empty(t, tlsConfig.Certificates)
+
+	tlsConfig, err = BuildHTTPClientTLSConfig(HTTPClientConfig{InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+	assert.Nil(t, tlsConfig.VerifyPeerCertificate)
+
+	ca, caKey := createTestCertificate(t, "ca", nil, nil)
+	leaf, leafKey := createTestCertificate(t, "agent01", ca, caKey)
+	otherCA, otherCAKey := createTestCertificate(t, "otherca", nil, nil)
+	otherLeaf, _ := createTestCertificate(t, "agent01", otherCA, otherCAKey)
+
+	caFile, _ := ioutil.TempFile("", "ca")
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	caFile.Close()
+
+	certFile, _ := ioutil.TempFile("", "cert")
+	defer os.Remove(certFile.Name())
+	pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	certFile.Close()
+
+	keyFile, _ := ioutil.TempFile("", "key")
+	defer os.Remove(keyFile.Name())
+	keyDer, _ := x509.MarshalECPrivateKey(leafKey)
+	pem.Encode(keyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	keyFile.Close()
+
+	tlsConfig, err = BuildHTTPClientTLSConfig(HTTPClientConfig{CAFile: caFile.Name(), CertFile: certFile.Name(), KeyFile: keyFile.Name()})
+	assert.Nil(t, err)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Equal(t, 1, len(tlsConfig.Certificates))
+
+	// chain only
+	tlsConfig, err = BuildHTTPClientTLSConfig(HTTPClientConfig{CAFile: caFile.Name(), SkipHostnameVerify: true})
+	assert.Nil(t, err)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+	assert.Nil(t, tlsConfig.VerifyPeerCertificate([][]byte{leaf.Raw}, nil))
+	assert.NotNil(t, tlsConfig.VerifyPeerCertificate([][]byte{otherLeaf.Raw}, nil))
+
+	// pinned
+	fingerprint := CertificateFingerprint(leaf.Raw)
+	var colonSeparated []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		colonSeparated = append(colonSeparated, strings.ToUpper(fingerprint[i:i+2]))
+	}
+	for _, pinned := range []string{fingerprint, strings.Join(colonSeparated, ":")} {
+		tlsConfig, err = BuildHTTPClientTLSConfig(HTTPClientConfig{Fingerprints: []string{pinned}})
+		assert.Nil(t, err)
+		assert.True(t, tlsConfig.InsecureSkipVerify)
+		assert.Nil(t, tlsConfig.VerifyPeerCertificate([][]byte{leaf.Raw}, nil))
+		assert.NotNil(t, tlsConfig.VerifyPeerCertificate([][]byte{otherLeaf.Raw}, nil))
+	}
+
+	_, err = BuildHTTPClientTLSConfig(HTTPClientConfig{CAFile: keyFile.Name()})
+	assert.NotNil(t, err)
+	_, err = BuildHTTPClientTLSConfig(HTTPClientConfig{Fingerprints: []string{"00:11"}})
+	assert.NotNil(t, err)
+}
+
+func TestNewHTTPClient1(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+	defer ts.Close()
+
+	// self signed certificate is not accepted by default
+	client, err := NewHTTPClient(HTTPClientConfig{Timeout: 5 * time.Second})
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, client.Timeout)
+	_, err = client.Get(ts.URL)
+	assert.NotNil(t, err)
+
+	client, err = NewHTTPClient(HTTPClientConfig{Fingerprints: []string{CertificateFingerprint(ts.Certificate().Raw)}})
+	assert.Nil(t, err)
+	resp, err := client.Get(ts.URL)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "OK", string(body))
+
+	client, err = NewHTTPClient(HTTPClientConfig{InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	resp, err = client.Get(ts.URL)
+	assert.Nil(t, err)
+	resp.Body.Close()
+}
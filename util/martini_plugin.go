@@ -6,6 +6,7 @@ import (
 	stdlog "log"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -84,7 +85,7 @@ func MartiniCustomLogger() martini.Handler {
 		rw := res.(martini.ResponseWriter)
 		c.Next()
 
-		log.Printf("Aceess: %s \"%s %s\" %d %d %d\n", addr, req.Method, req.RequestURI, rw.Status(), rw.Size(), time.Since(start)/time.Millisecond)
+		log.Printf("Aceess: %s \"%s %s\" %d %d %d\n", addr, req.Method, RequestURIWithoutAPIKey(req), rw.Status(), rw.Size(), time.Since(start)/time.Millisecond)
 	}
 }
 
@@ -95,6 +96,7 @@ type RequestStatusManager struct {
 		URI    string
 		Counts map[int]uint64
 	}
+	totals map[string]map[int]uint64 // cumulative counts by route pattern. not garbage collected, as routes are bounded
 	sync.Mutex
 }
 
@@ -152,6 +154,35 @@ func (m *RequestStatusManager) GarbageCollect(when time.Time, lifetimeMinutes in
 	m.RequestStatus = newRequestStatus
 }
 
+// AppendTotal counts request to cumulative totals. route is route pattern (e.g. `/machine-state/:key`), not raw path
+func (m *RequestStatusManager) AppendTotal(route string, status int) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.totals == nil {
+		m.totals = make(map[string]map[int]uint64)
+	}
+	if _, ok := m.totals[route]; !ok {
+		m.totals[route] = make(map[int]uint64)
+	}
+	m.totals[route][status]++
+}
+
+// GetTotals returns cumulative request counts by route pattern and status code
+func (m *RequestStatusManager) GetTotals() map[string]map[int]uint64 {
+	m.Lock()
+	defer m.Unlock()
+
+	totals := make(map[string]map[int]uint64, len(m.totals))
+	for path, counts := range m.totals {
+		totals[path] = make(map[int]uint64, len(counts))
+		for status, count := range counts {
+			totals[path][status] = count
+		}
+	}
+	return totals
+}
+
 // GetStatus returns halib.RequestStatusResponse
 func (m *RequestStatusManager) GetStatus(fromWhen time.Time) halib.RequestStatusResponse {
 	m.Lock()
@@ -226,9 +257,35 @@ var (
 type RequestStatusLog struct {
 	When   time.Time
 	URI    string
+	Route  string
 	Status int
 }
 
+// requestRouteOther is route of requests matched to no route
+const requestRouteOther = "other"
+
+// requestRoute returns pattern of route which matches path (e.g. `/machine-state/:key`), or requestRouteOther
+func requestRoute(routes []martini.Route, path string) string {
+	segments := strings.Split(path, "/")
+	for _, route := range routes {
+		patternSegments := strings.Split(route.Pattern(), "/")
+		if len(patternSegments) != len(segments) {
+			continue
+		}
+		matched := true
+		for i, patternSegment := range patternSegments {
+			if patternSegment != segments[i] && !(strings.HasPrefix(patternSegment, ":") && segments[i] != "") {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return route.Pattern()
+		}
+	}
+	return requestRouteOther
+}
+
 // MartiniRequestStatus implements recent request status
 func MartiniRequestStatus() martini.Handler {
 	logChan := make(chan RequestStatusLog, 1000) //FIXME proper buffer size
@@ -239,6 +296,7 @@ func MartiniRequestStatus() martini.Handler {
 			select {
 			case log := <-logChan:
 				rsm.Append(log.When, log.URI, log.Status)
+				rsm.AppendTotal(log.Route, log.Status)
 				b, _ := json.Marshal(rsm.GetStatus(time.Now()))
 				HappoAgentLogger().Debug(string(b))
 			}
@@ -255,11 +313,12 @@ func MartiniRequestStatus() martini.Handler {
 		}
 	}()
 
-	return func(res http.ResponseWriter, req *http.Request, c martini.Context) {
+	return func(res http.ResponseWriter, req *http.Request, c martini.Context, routes martini.Routes) {
 		c.Next()
 
 		rw := res.(martini.ResponseWriter)
-		logChan <- RequestStatusLog{When: time.Now(), URI: req.RequestURI, Status: rw.Status()}
+		route := requestRoute(routes.All(), req.URL.Path)
+		logChan <- RequestStatusLog{When: time.Now(), URI: RequestURIWithoutAPIKey(req), Route: route, Status: rw.Status()}
 	}
 }
 
@@ -267,3 +326,8 @@ func MartiniRequestStatus() martini.Handler {
 func GetMartiniRequestStatus(fromWhen time.Time) halib.RequestStatusResponse {
 	return rsm.GetStatus(fromWhen)
 }
+
+// GetMartiniRequestTotals returns cumulative request counts by route pattern and status code
+func GetMartiniRequestTotals() map[string]map[int]uint64 {
+	return rsm.GetTotals()
+}
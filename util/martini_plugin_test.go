@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -217,4 +218,51 @@ func TestRequestStatusManager(t *testing.T) {
 	assert.Equal(t,
 		`{"last1":[{"url":"/","counts":{"200":1}}],"last5":[{"url":"/","counts":{"200":2}}]}`,
 		string(j))
+
+	// totals are counted by route
+	myRSM.AppendTotal("/", 200)
+	myRSM.AppendTotal("/machine-state/:key", 200)
+	myRSM.AppendTotal("/machine-state/:key", 200)
+	myRSM.AppendTotal("other", 404)
+	assert.Equal(t,
+		map[string]map[int]uint64{"/": {200: 1}, "/machine-state/:key": {200: 2}, "other": {404: 1}},
+		myRSM.GetTotals())
+}
+
+func TestRequestRoute1(t *testing.T) {
+	m := martini.Classic()
+	m.Get("/", func() {})
+	m.Get("/machine-state", func() {})
+	m.Get("/machine-state/:key", func() {})
+	routes := m.Router.(martini.Routes).All()
+
+	assert.Equal(t, "/", requestRoute(routes, "/"))
+	assert.Equal(t, "/machine-state", requestRoute(routes, "/machine-state"))
+	assert.Equal(t, "/machine-state/:key", requestRoute(routes, "/machine-state/s-1498112479"))
+	assert.Equal(t, "other", requestRoute(routes, "/machine-state/"))
+	assert.Equal(t, "other", requestRoute(routes, "/admin/login.php"))
+}
+
+func TestMartiniRequestStatus1(t *testing.T) {
+	m := martini.Classic()
+	m.Use(MartiniRequestStatus())
+	m.Get("/metric/config", func() string { return "success" })
+
+	req, _ := http.NewRequest("GET", "/metric/config?apikey=secretkey", nil)
+	req.RequestURI = "/metric/config?apikey=secretkey"
+	res := httptest.NewRecorder()
+	m.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	// apikey in query string is not exposed by /status/request
+	var status []byte
+	for i := 0; i < 100; i++ {
+		status, _ = json.Marshal(GetMartiniRequestStatus(time.Now().Add(-1 * time.Minute)))
+		if strings.Contains(string(status), "/metric/config") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Contains(t, string(status), "/metric/config")
+	assert.NotContains(t, string(status), "secretkey")
 }
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+)
+
+// SplitShellWords splits s into arguments with shell word rules (white space, single quote, double quote and backslash).
+// variable expansion, glob, redirection and so on are not supported. those characters are treated as literal.
+func SplitShellWords(s string) ([]string, error) {
+	var args []string
+	var word bytes.Buffer
+	inWord := false
+	escaped := false
+	var quote rune
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			// in double quote, backslash escapes only $ ` " \ and newline
+			if quote == '"' && r != '$' && r != '`' && r != '"' && r != '\\' && r != '\n' {
+				word.WriteRune('\\')
+			}
+			if r != '\n' {
+				word.WriteRune(r)
+			}
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if escaped {
+		return nil, errors.New("unexpected end of string after backslash")
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitShellWords1(t *testing.T) {
+	var cases = []struct {
+		input    string
+		expected []string
+	}{
+		{"", nil},
+		{"  -w 80  -c 90 ", []string{"-w", "80", "-c", "90"}},
+		{`-a 'b c' "d e"`, []string{"-a", "b c", "d e"}},
+		{`'it''s' a\ b`, []string{"its", "a b"}},
+		{`"a \"b\" \$c \d"`, []string{`a "b" $c \d`}},
+		{`'a \"b'`, []string{`a \"b`}},
+		{`x;y $(id) | z`, []string{"x;y", "$(id)", "|", "z"}},
+		{`''`, []string{""}},
+	}
+	for _, c := range cases {
+		args, err := SplitShellWords(c.input)
+		assert.Nil(t, err, c.input)
+		assert.Equal(t, c.expected, args, c.input)
+	}
+}
+
+func TestSplitShellWords2(t *testing.T) {
+	for _, input := range []string{`'abc`, `"abc`, `abc\`} {
+		_, err := SplitShellWords(input)
+		assert.NotNil(t, err, input)
+	}
+}
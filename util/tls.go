@@ -0,0 +1,167 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// LoadCertPool loads PEM encoded CA bundle file
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// CertificateSubjects returns CommonName and SANs of certificate
+func CertificateSubjects(cert *x509.Certificate) []string {
+	subjects := []string{cert.Subject.CommonName}
+	subjects = append(subjects, cert.DNSNames...)
+	subjects = append(subjects, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		subjects = append(subjects, ip.String())
+	}
+	return subjects
+}
+
+// VerifyPeerCertificate returns function for tls.Config.VerifyPeerCertificate
+//
+// when roots is not nil, verify peer certificate chain by roots (hostname is not verified, because agents are called by ip address).
+// when allowedSubjects is not empty, peer certificate CommonName or SANs must be in allowedSubjects.
+func VerifyPeerCertificate(roots *x509.CertPool, allowedSubjects []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no peer certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, rawCert := range rawCerts {
+			cert, err := x509.ParseCertificate(rawCert)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+
+		if roots != nil {
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(allowedSubjects) == 0 {
+			return nil
+		}
+		for _, subject := range CertificateSubjects(certs[0]) {
+			for _, allowed := range allowedSubjects {
+				if subject != "" && subject == allowed {
+					return nil
+				}
+			}
+		}
+		HappoAgentLogger().WithField("Subjects", CertificateSubjects(certs[0])).Errorf("Certificate Denied")
+		return errors.New("peer certificate is not allowed")
+	}
+}
+
+// versionTLS13 is tls.VersionTLS13, which is not defined in older go
+const versionTLS13 = 0x0304
+
+// tlsVersions are names of TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": versionTLS13,
+}
+
+// cipherSuites are names of configurable cipher suites (TLS 1.0 - 1.2). cipher suites of TLS 1.3 are not configurable
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// curves are names of elliptic curves
+var curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// ParseTLSVersion parses TLS version (1.0, 1.1, 1.2 or 1.3). blank returns 0 (default of crypto/tls)
+func ParseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToUpper(version), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version: %q", version)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites parses comma separated cipher suite names (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). blank returns nil (default of crypto/tls)
+func ParseCipherSuites(names string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := cipherSuites[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseCurvePreferences parses comma separated curve names (X25519, P256, P384 or P521). blank returns nil (default of crypto/tls)
+func ParseCurvePreferences(names string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := curves[strings.Replace(strings.ToUpper(name), "-", "", -1)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve: %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
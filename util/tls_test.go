@@ -0,0 +1,94 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createTestCertificate(t *testing.T, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		DNSNames:              []string{commonName + ".example.com"},
+		IPAddresses:           []net.IP{net.ParseIP("192.0.2.1")},
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return cert, key
+}
+
+func TestVerifyPeerCertificate1(t *testing.T) {
+	ca, caKey := createTestCertificate(t, "ca", nil, nil)
+	leaf, _ := createTestCertificate(t, "agent01", ca, caKey)
+	otherCA, otherCAKey := createTestCertificate(t, "otherca", nil, nil)
+	otherLeaf, _ := createTestCertificate(t, "agent01", otherCA, otherCAKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	assert.Nil(t, VerifyPeerCertificate(roots, nil)([][]byte{leaf.Raw}, nil))
+	assert.NotNil(t, VerifyPeerCertificate(roots, nil)([][]byte{otherLeaf.Raw}, nil))
+	assert.NotNil(t, VerifyPeerCertificate(roots, nil)([][]byte{}, nil))
+
+	assert.Nil(t, VerifyPeerCertificate(nil, []string{"agent01"})([][]byte{leaf.Raw}, nil))
+	assert.Nil(t, VerifyPeerCertificate(nil, []string{"agent01.example.com"})([][]byte{leaf.Raw}, nil))
+	assert.Nil(t, VerifyPeerCertificate(nil, []string{"192.0.2.1"})([][]byte{leaf.Raw}, nil))
+	assert.NotNil(t, VerifyPeerCertificate(nil, []string{"agent02"})([][]byte{leaf.Raw}, nil))
+}
+
+func TestParseTLSVersion1(t *testing.T) {
+	version, err := ParseTLSVersion("1.2")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), version)
+	version, err = ParseTLSVersion("TLS1.3")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0x0304), version)
+	version, err = ParseTLSVersion("")
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0), version)
+	_, err = ParseTLSVersion("1.4")
+	assert.NotNil(t, err)
+}
+
+func TestParseCipherSuites1(t *testing.T) {
+	suites, err := ParseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, suites)
+	suites, err = ParseCipherSuites("")
+	assert.Nil(t, err)
+	assert.Nil(t, suites)
+	_, err = ParseCipherSuites("TLS_RSA_WITH_RC4_128_MD5")
+	assert.NotNil(t, err)
+}
+
+func TestParseCurvePreferences1(t *testing.T) {
+	curves, err := ParseCurvePreferences("X25519,P-256")
+	assert.Nil(t, err)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, curves)
+	_, err = ParseCurvePreferences("P192")
+	assert.NotNil(t, err)
+}
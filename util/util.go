@@ -3,7 +3,6 @@ package util
 import (
 	"bufio"
 	"bytes"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/http"
@@ -27,6 +26,9 @@ var CommandTimeout time.Duration = -1
 // Production is flag. when production use, set true
 var Production bool
 
+// ExecMode is default command execution mode (halib.ExecModeShell or halib.ExecModeDirect)
+var ExecMode = halib.ExecModeShell
+
 // TimeoutError is error struct show error is timeout
 type TimeoutError struct {
 	Message string
@@ -41,31 +43,78 @@ func init() {
 	Production = strings.ToLower(os.Getenv("MARTINI_ENV")) == "production"
 }
 
+// ValidateExecMode returns error when mode is unknown. blank means default ExecMode
+func ValidateExecMode(mode string) error {
+	switch mode {
+	case "", halib.ExecModeShell, halib.ExecModeDirect:
+		return nil
+	}
+	return fmt.Errorf("unknown exec mode: %s", mode)
+}
+
+// buildCommand returns exec.Cmd. in shell mode, run via `/bin/sh -c`. in direct mode, split option by shell word rules and run without shell
+func buildCommand(mode string, command string, option string) (*exec.Cmd, error) {
+	if mode == "" {
+		mode = ExecMode
+	}
+	switch mode {
+	case halib.ExecModeShell:
+		return exec.Command("/bin/sh", "-c", fmt.Sprintf("%s %s", command, option)), nil
+	case halib.ExecModeDirect:
+		args, err := SplitShellWords(option)
+		if err != nil {
+			return nil, err
+		}
+		return exec.Command(command, args...), nil
+	}
+	return nil, fmt.Errorf("unknown exec mode: %s", mode)
+}
+
 // ExecCommand execute command with specified timeout behavior
 func ExecCommand(command string, option string) (int, string, string, error) {
-	var timeBegin time.Time
+	return ExecCommandWithMode("", command, option)
+}
+
+// ExecCommandWithMode execute command with specified timeout behavior and exec mode. when mode is blank, use ExecMode
+func ExecCommandWithMode(mode string, command string, option string) (int, string, string, error) {
+	return ExecCommandWithTimeout(mode, 0, command, option)
+}
+
+// ExecCommandWithTimeout execute command with exec mode and timeout. when timeout <= 0, use CommandTimeout
+func ExecCommandWithTimeout(mode string, commandTimeout time.Duration, command string, option string) (int, string, string, error) {
+	timeBegin := time.Now()
 	var cswBegin int
 	if HappoAgentLoggerEnableInfo() {
-		timeBegin = time.Now()
 		cswBegin = getContextSwitch()
 	}
 
-	commandTimeout := CommandTimeout
-	if commandTimeout == -1 {
-		commandTimeout = halib.DefaultCommandTimeout
+	if commandTimeout <= 0 {
+		commandTimeout = CommandTimeout * time.Second
+		if CommandTimeout == -1 {
+			commandTimeout = halib.DefaultCommandTimeout * time.Second
+		}
 	}
 
 	commandWithOptions := fmt.Sprintf("%s %s", command, option)
+	cmd, err := buildCommand(mode, command, option)
+	if err != nil {
+		return -1, "", "", err
+	}
 	tio := &timeout.Timeout{
-		Cmd:       exec.Command("/bin/sh", "-c", commandWithOptions),
-		Duration:  commandTimeout * time.Second,
+		Cmd:       cmd,
+		Duration:  commandTimeout,
 		KillAfter: halib.CommandKillAfterSeconds * time.Second,
 	}
 	exitStatus, stdout, stderr, err := tio.Run()
 
+	if startErr, ok := err.(*timeout.Error); ok {
+		// command could not start (direct mode only). behave like shell: 127(not found) or 126(not executable)
+		return startErr.ExitCode, stdout, startErr.Err.Error() + "\n", nil
+	}
 	if err == nil && exitStatus.IsTimedOut() {
 		err = &TimeoutError{"Exec timeout: " + commandWithOptions}
 	}
+	recordExecStat(command, time.Since(timeBegin), exitStatus.IsTimedOut())
 
 	if HappoAgentLoggerEnableInfo() {
 		now := time.Now()
@@ -100,6 +149,12 @@ func getContextSwitch() int {
 
 // ExecCommandCombinedOutput execute command with specified timeout behavior
 func ExecCommandCombinedOutput(command string, option string) (int, string, error) {
+	exitCode, out, _, err := ExecCommandCombinedOutputWithLimit("", command, option, -1)
+	return exitCode, out, err
+}
+
+// ExecCommandCombinedOutputWithLimit execute command with specified timeout behavior and exec mode. output over limit bytes is discarded(returns truncated=true)
+func ExecCommandCombinedOutputWithLimit(mode string, command string, option string, limit int) (int, string, bool, error) {
 
 	commandTimeout := CommandTimeout
 	if commandTimeout == -1 {
@@ -107,23 +162,32 @@ func ExecCommandCombinedOutput(command string, option string) (int, string, erro
 	}
 
 	commandWithOptions := fmt.Sprintf("%s %s", command, option)
+	cmd, err := buildCommand(mode, command, option)
+	if err != nil {
+		return -1, "", false, err
+	}
 	tio := &timeout.Timeout{
-		Cmd:       exec.Command("/bin/sh", "-c", commandWithOptions),
+		Cmd:       cmd,
 		Duration:  commandTimeout * time.Second,
 		KillAfter: halib.CommandKillAfterSeconds * time.Second,
 	}
-	out := &bytes.Buffer{}
+	out := &LimitedBuffer{Limit: limit}
 	tio.Cmd.Stdout = out
 	tio.Cmd.Stderr = out
 
+	timeBegin := time.Now()
 	ch, err := tio.RunCommand()
+	if startErr, ok := err.(*timeout.Error); ok {
+		return startErr.ExitCode, startErr.Err.Error() + "\n", false, nil
+	}
 	exitStatus := <-ch
 
 	if err == nil && exitStatus.IsTimedOut() {
 		err = &TimeoutError{"Exec timeout: " + commandWithOptions}
 	}
+	recordExecStat(command, time.Since(timeBegin), exitStatus.IsTimedOut())
 
-	return exitStatus.GetChildExitCode(), out.String(), err
+	return exitStatus.GetChildExitCode(), out.String(), out.Truncated, err
 
 }
 
@@ -148,8 +212,20 @@ func BindManageParameter(c *cli.Context) (halib.ManageRequest, error) {
 	return manageRequest, nil
 }
 
-// RequestToManageAPI send request to ManageAPI
-func RequestToManageAPI(endpoint string, path string, postdata []byte) (*http.Response, error) {
+// BindHTTPClientConfig build and return HTTPClientConfig from flags of subcommand (ca-file, fingerprint, insecure-skip-verify, cert-file, key-file and timeout-seconds)
+func BindHTTPClientConfig(c *cli.Context) HTTPClientConfig {
+	return HTTPClientConfig{
+		CAFile:             c.String("ca-file"),
+		Fingerprints:       c.StringSlice("fingerprint"),
+		InsecureSkipVerify: c.Bool("insecure-skip-verify"),
+		CertFile:           c.String("cert-file"),
+		KeyFile:            c.String("key-file"),
+		Timeout:            time.Duration(c.Int("timeout-seconds")) * time.Second,
+	}
+}
+
+// RequestToManageAPI send request to ManageAPI. redirect is not followed
+func RequestToManageAPI(endpoint string, path string, postdata []byte, clientConfig HTTPClientConfig) (*http.Response, error) {
 	uri := fmt.Sprintf("%s%s", endpoint, path)
 	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(postdata))
 	if err != nil {
@@ -157,29 +233,32 @@ func RequestToManageAPI(endpoint string, path string, postdata []byte) (*http.Re
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	return http.DefaultTransport.RoundTrip(req)
+	clientConfig.UseProxyEnv = true
+	client, err := NewHTTPClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client.Do(req)
 }
 
-// RequestToMetricAppendAPI send request to MetricAppendPI
-func RequestToMetricAppendAPI(endpoint string, postdata []byte) (*http.Response, error) {
-	client, req, err := buildMetricAppendAPIRequest(endpoint, postdata)
+// RequestToMetricAppendAPI send request to MetricAppendPI by client (NewHTTPClient)
+func RequestToMetricAppendAPI(client *http.Client, endpoint string, postdata []byte) (*http.Response, error) {
+	req, err := buildMetricAppendAPIRequest(endpoint, postdata)
 	if err != nil {
 		return nil, err
 	}
 	return client.Do(req)
 }
 
-func buildMetricAppendAPIRequest(endpoint string, postdata []byte) (*http.Client, *http.Request, error) {
+func buildMetricAppendAPIRequest(endpoint string, postdata []byte) (*http.Request, error) {
 	uri := fmt.Sprintf("%s/metric/append", endpoint)
 	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(postdata))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-
-	//FIXME other parameters should be proper values
-	client := &http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}}
-	return client, req, err
+	return req, nil
 }
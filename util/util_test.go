@@ -2,8 +2,8 @@ package util
 
 import (
 	"fmt"
-	"net/http"
 	"testing"
+	"time"
 
 	"github.com/heartbeatsjp/happo-agent/halib"
 
@@ -91,6 +91,36 @@ func TestExecCommandCombinedOutput3(t *testing.T) {
 	assert.True(t, ok)
 }
 
+func TestExecCommandWithMode1(t *testing.T) {
+	exitCode, stdout, _, err := ExecCommandWithMode(halib.ExecModeDirect, "echo", `'a  b' "c d" ; rm -rf /tmp/dummy $HOME`)
+	assert.EqualValues(t, 0, exitCode)
+	assert.Equal(t, "a  b c d ; rm -rf /tmp/dummy $HOME\n", stdout)
+	assert.Nil(t, err)
+}
+
+func TestExecCommandWithMode2(t *testing.T) {
+	exitCode, stdout, stderr, err := ExecCommandWithMode(halib.ExecModeDirect, "/nonexistent/command", "")
+	assert.EqualValues(t, 127, exitCode)
+	assert.Equal(t, "", stdout)
+	assert.NotEqual(t, "", stderr)
+	assert.Nil(t, err)
+}
+
+func TestExecCommandWithMode3(t *testing.T) {
+	exitCode, _, _, err := ExecCommandWithMode(halib.ExecModeDirect, "sleep", fmt.Sprintf("%d", halib.DefaultCommandTimeout+1))
+	assert.EqualValues(t, -1, exitCode)
+	_, ok := err.(*TimeoutError)
+	assert.True(t, ok)
+}
+
+func TestExecCommandWithMode4(t *testing.T) {
+	_, _, _, err := ExecCommandWithMode(halib.ExecModeDirect, "echo", "'unterminated")
+	assert.NotNil(t, err)
+
+	_, _, _, err = ExecCommandWithMode("unknown", "echo", "")
+	assert.NotNil(t, err)
+}
+
 func TestExecCommand4(t *testing.T) {
 	command := "bash"
 	option := "-c 'echo -n 1.STDOUT. ; echo -n 2.STDERR. >&2 ; echo -n 3.STDOUT. ; echo -n 4.STDERR. >&2 ; exit 0'"
@@ -105,7 +135,7 @@ func TestExecCommand4(t *testing.T) {
 }
 
 func TestBuildMetricAppendAPIRequest1(t *testing.T) {
-	client, req, err := buildMetricAppendAPIRequest("https://127.0.0.2:6777", []byte(
+	req, err := buildMetricAppendAPIRequest("https://127.0.0.2:6777", []byte(
 		`{
 		"api_key": "asdf",
 		"metric_data":[
@@ -123,7 +153,6 @@ func TestBuildMetricAppendAPIRequest1(t *testing.T) {
 		"linux.disk.elapsed.iotime_weighted_sda":222 }
 	}
 	]}`))
-	assert.True(t, (client.Transport.(*http.Transport)).TLSClientConfig.InsecureSkipVerify)
 	assert.Equal(t, "https", req.URL.Scheme)
 	assert.Equal(t, "127.0.0.2:6777", req.URL.Host)
 	assert.Equal(t, "/metric/append", req.URL.Path)
@@ -131,3 +160,26 @@ func TestBuildMetricAppendAPIRequest1(t *testing.T) {
 	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
 	assert.Nil(t, err)
 }
+
+func TestExecCommandCombinedOutputWithLimit1(t *testing.T) {
+	exitCode, out, truncated, err := ExecCommandCombinedOutputWithLimit("", "seq", "1 10000", 10)
+	assert.EqualValues(t, 0, exitCode)
+	assert.Equal(t, "1\n2\n3\n4\n5\n", out)
+	assert.True(t, truncated)
+	assert.Nil(t, err)
+
+	exitCode, out, truncated, err = ExecCommandCombinedOutputWithLimit("", "echo", "'hoge'", 10)
+	assert.EqualValues(t, 0, exitCode)
+	assert.Equal(t, "hoge\n", out)
+	assert.False(t, truncated)
+	assert.Nil(t, err)
+}
+
+func TestExecCommandWithTimeout1(t *testing.T) {
+	begin := time.Now()
+	exitCode, _, _, err := ExecCommandWithTimeout(halib.ExecModeDirect, 100*time.Millisecond, "sleep", "10")
+	assert.EqualValues(t, -1, exitCode)
+	_, ok := err.(*TimeoutError)
+	assert.True(t, ok)
+	assert.True(t, time.Since(begin) < halib.DefaultCommandTimeout*time.Second)
+}
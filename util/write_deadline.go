@@ -0,0 +1,70 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --- Package Variables
+
+// writeDeadlineConns is accepted connections by remote address, to extend write deadline of streaming response
+var writeDeadlineConns = struct {
+	sync.Mutex
+	data map[string]*writeDeadlineConn
+}{data: map[string]*writeDeadlineConn{}}
+
+// --- Struct
+
+// WriteDeadlineListener registers accepted connections, so that handler can extend write deadline (http.Server.WriteTimeout)
+// by ExtendWriteDeadline. wrap raw listener (before tls.NewListener)
+type WriteDeadlineListener struct {
+	net.Listener
+}
+
+type writeDeadlineConn struct {
+	net.Conn
+	addr string
+	once sync.Once
+}
+
+// --- Method
+
+// Accept implements net.Listener
+func (l *WriteDeadlineListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &writeDeadlineConn{Conn: conn, addr: conn.RemoteAddr().String()}
+	writeDeadlineConns.Lock()
+	writeDeadlineConns.data[c.addr] = c
+	writeDeadlineConns.Unlock()
+	return c, nil
+}
+
+// Close implements net.Conn
+func (c *writeDeadlineConn) Close() error {
+	c.once.Do(func() {
+		writeDeadlineConns.Lock()
+		if writeDeadlineConns.data[c.addr] == c {
+			delete(writeDeadlineConns.data, c.addr)
+		}
+		writeDeadlineConns.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// ExtendWriteDeadline sets write deadline of connection of req to timeout from now. for response which is written longer than
+// http.Server.WriteTimeout (e.g. streaming), call it on each progress. returns false when connection is not accepted by WriteDeadlineListener
+func ExtendWriteDeadline(req *http.Request, timeout time.Duration) bool {
+	writeDeadlineConns.Lock()
+	c, ok := writeDeadlineConns.data[req.RemoteAddr]
+	writeDeadlineConns.Unlock()
+	if !ok {
+		return false
+	}
+	c.SetWriteDeadline(time.Now().Add(timeout))
+	return true
+}
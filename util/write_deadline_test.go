@@ -0,0 +1,67 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtendWriteDeadline1(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	extended := make(chan bool, 2)
+	server := &http.Server{
+		WriteTimeout: 200 * time.Millisecond,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			extend := req.URL.Path == "/extend"
+			for i := 0; i < 6; i++ {
+				if extend {
+					if !ExtendWriteDeadline(req, 200*time.Millisecond) {
+						extended <- false
+						return
+					}
+				}
+				fmt.Fprintf(w, "%d\n", i)
+				w.(http.Flusher).Flush()
+				time.Sleep(100 * time.Millisecond)
+			}
+			extended <- extend
+		}),
+	}
+	go server.Serve(&WriteDeadlineListener{Listener: listener})
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	url := "http://" + listener.Addr().String()
+
+	// whole response is written, over WriteTimeout
+	resp, err := client.Get(url + "/extend")
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "0\n1\n2\n3\n4\n5\n", string(body))
+	assert.True(t, <-extended)
+
+	// without extension, response is cut off at WriteTimeout
+	resp, err = client.Get(url + "/")
+	if err == nil {
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	assert.NotEqual(t, "0\n1\n2\n3\n4\n5\n", string(body))
+	<-extended
+
+	// connection is forgotten after closed
+	time.Sleep(100 * time.Millisecond)
+	writeDeadlineConns.Lock()
+	assert.Equal(t, 0, len(writeDeadlineConns.data))
+	writeDeadlineConns.Unlock()
+	assert.False(t, ExtendWriteDeadline(&http.Request{RemoteAddr: "192.0.2.1:1234"}, time.Second))
+}
@@ -1,9 +1,12 @@
 package util
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
 )
 
@@ -58,3 +61,59 @@ func (w *LogWriter) Write(output []byte) (int, error) {
 	}
 	return w.fp.Write(output)
 }
+
+// LimitedBuffer is buffer which discards bytes over limit
+type LimitedBuffer struct {
+	buf       bytes.Buffer
+	Limit     int // when Limit <= 0, unlimited
+	Truncated bool
+}
+
+func (b *LimitedBuffer) Write(p []byte) (int, error) {
+	if b.Limit <= 0 {
+		return b.buf.Write(p)
+	}
+	remain := b.Limit - b.buf.Len()
+	if remain < len(p) {
+		b.Truncated = true
+		if remain > 0 {
+			b.buf.Write(p[:remain])
+		}
+		// pretend to write all bytes, not to break command
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// String returns buffered bytes as string
+func (b *LimitedBuffer) String() string {
+	return b.buf.String()
+}
+
+// WriteFileAtomic writes data to temporary file in same directory, and renames it to filename.
+// readers see old file or new file, never partially written file
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	fp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := fp.Name()
+
+	_, err = fp.Write(data)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
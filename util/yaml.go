@@ -0,0 +1,83 @@
+package util
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// UnknownYAMLKeys returns keys in yaml which are not defined by yaml tags of out (struct, recursively).
+// e.g. `metrics[0].plugins[1].plugin_nmae`
+func UnknownYAMLKeys(buf []byte, out interface{}) ([]string, error) {
+	var node interface{}
+	err := yaml.Unmarshal(buf, &node)
+	if err != nil {
+		return nil, err
+	}
+
+	unknown := []string{}
+	collectUnknownYAMLKeys(node, reflect.TypeOf(out), "", &unknown)
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+func collectUnknownYAMLKeys(node interface{}, typ reflect.Type, path string, unknown *[]string) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		m, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return // type mismatch is reported by yaml.Unmarshal
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.PkgPath != "" {
+				continue // unexported
+			}
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			fields[name] = field.Type
+		}
+		for key, value := range m {
+			name := fmt.Sprint(key)
+			keyPath := name
+			if path != "" {
+				keyPath = path + "." + name
+			}
+			fieldType, ok := fields[name]
+			if !ok {
+				*unknown = append(*unknown, keyPath)
+				continue
+			}
+			collectUnknownYAMLKeys(value, fieldType, keyPath, unknown)
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := node.([]interface{})
+		if !ok {
+			return
+		}
+		for i, item := range items {
+			collectUnknownYAMLKeys(item, typ.Elem(), fmt.Sprintf("%s[%d]", path, i), unknown)
+		}
+	case reflect.Map:
+		m, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		for key, value := range m {
+			collectUnknownYAMLKeys(value, typ.Elem(), fmt.Sprintf("%s.%v", path, key), unknown)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/heartbeatsjp/happo-agent/halib"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnknownYAMLKeys1(t *testing.T) {
+	unknown, err := UnknownYAMLKeys([]byte(`metrics:
+- hostname: localhost
+  plugins:
+  - plugin_name: a
+    plugin_nmae: b
+  - plugin_name: c
+    exec_mode: direct
+- hostname: localhost2
+  host: x
+extra: 1
+`), halib.MetricConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"extra", "metrics[0].plugins[0].plugin_nmae", "metrics[1].host"}, unknown)
+
+	unknown, err = UnknownYAMLKeys([]byte(""), halib.MetricConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, unknown)
+
+	_, err = UnknownYAMLKeys([]byte("metrics: [\n"), halib.MetricConfig{})
+	assert.NotNil(t, err)
+}